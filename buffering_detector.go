@@ -0,0 +1,58 @@
+package eventsource
+
+import "io"
+
+// A reader that counts how many complete events are contained in the data returned by each read, and
+// calls a function if that is more than a threshold. This is used to implement
+// StreamOptionBufferingDetector.
+//
+// An event is recognized by a blank line that follows a non-comment line, the same way the Decoder
+// recognizes it. The data is passed on unchanged, since the Decoder may need the original line endings.
+type bufferingDetector struct {
+	r           io.Reader
+	threshold   int
+	onBuffering func()
+	atLineStart bool
+	inComment   bool
+	inEvent     bool
+	lastCR      bool
+}
+
+func newBufferingDetector(r io.Reader, threshold int, onBuffering func()) *bufferingDetector {
+	return &bufferingDetector{
+		r:           r,
+		threshold:   threshold,
+		onBuffering: onBuffering,
+		atLineStart: true,
+	}
+}
+
+func (d *bufferingDetector) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	events := 0
+	for _, c := range p[:n] {
+		if c == '\n' && d.lastCR { // the second half of a CRLF line ending
+			d.lastCR = false
+			continue
+		}
+		d.lastCR = c == '\r'
+		if c != '\n' && c != '\r' {
+			if d.atLineStart {
+				d.inComment = c == ':'
+				d.atLineStart = false
+			}
+			continue
+		}
+		if !d.atLineStart {
+			d.inEvent = d.inEvent || !d.inComment
+		} else if d.inEvent {
+			events++
+			d.inEvent = false
+		}
+		d.atLineStart = true
+	}
+	if events > d.threshold {
+		d.onBuffering()
+	}
+	return n, err
+}
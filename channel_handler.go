@@ -0,0 +1,61 @@
+package eventsource
+
+import (
+	"net/http"
+	"time"
+)
+
+// HandlerOptions contains optional settings for ChannelHandler. These have the same meaning as the
+// corresponding fields of Server.
+type HandlerOptions struct {
+	AllowCORS            bool          // Enable the handler to be accessible from any origin
+	Gzip                 bool          // Enable compression if client can accept it
+	MaxConnTime          time.Duration // If non-zero, the connection will be automatically closed after this time
+	Logger               Logger        // Logger is a logger that, when set, will be used for logging debug messages
+	ExtraResponseHeaders http.Header   // Additional headers for the response; see Server.Handler
+}
+
+// ChannelHandler creates an HTTP handler that streams events from a Go channel, without the publish and
+// subscribe features of Server. This is a simpler way to implement an endpoint that serves a single
+// stream of events which you are already producing on a channel.
+//
+// The handler writes each event it receives from the channel to the response, and ends the response when
+// the channel is closed. If the client disconnects first, or if MaxConnTime elapses, the handler returns
+// without reading any more events; since the channel is not shared with any other handler, it is normally
+// best to use it for only one request.
+func ChannelHandler(events <-chan Event, opts HandlerOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		useGzip := writeStreamHeaders(w, req, opts.AllowCORS, opts.Gzip, opts.ExtraResponseHeaders)
+		flusher := w.(http.Flusher)
+		flusher.Flush()
+		enc := NewEncoder(w, useGzip)
+
+		var maxConnTimeCh <-chan time.Time
+		if opts.MaxConnTime > 0 {
+			t := time.NewTimer(opts.MaxConnTime)
+			defer t.Stop()
+			maxConnTimeCh = t.C
+		}
+		closeNotify := req.Context().Done()
+
+		for {
+			select {
+			case <-closeNotify:
+				return
+			case <-maxConnTimeCh: // if MaxConnTime was not set, this is a nil channel and has no effect on the select
+				return
+			case ev, ok := <-events:
+				if !ok {
+					return
+				}
+				if err := enc.Encode(ev); err != nil {
+					if opts.Logger != nil {
+						opts.Logger.Println(err)
+					}
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package eventsource
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannelHandlerWritesEventsUntilChannelIsClosed(t *testing.T) {
+	events := make(chan Event, 2)
+	httpServer := httptest.NewServer(ChannelHandler(events, HandlerOptions{AllowCORS: true}))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"))
+
+	events <- &publication{id: "1", data: "my-event1"}
+	events <- &publication{data: "my-event2"}
+	close(events)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "id: 1\ndata: my-event1\n\ndata: my-event2\n\n", string(body))
+}
+
+func TestChannelHandlerCanEnforceMaxConnectionTime(t *testing.T) {
+	events := make(chan Event)
+	httpServer := httptest.NewServer(ChannelHandler(events, HandlerOptions{MaxConnTime: time.Millisecond * 100}))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	readCh := make(chan []byte)
+	go func() {
+		bytes, _ := ioutil.ReadAll(resp.Body)
+		readCh <- bytes
+	}()
+	select {
+	case body := <-readCh:
+		assert.Equal(t, "", string(body))
+	case <-time.After(time.Second):
+		assert.Fail(t, "Timed out waiting for response to end")
+	}
+}
@@ -2,6 +2,7 @@ package eventsource
 
 import (
 	"bytes"
+	"reflect"
 	"testing"
 )
 
@@ -65,3 +66,314 @@ func TestEncodeUnknownValue(t *testing.T) {
 		t.Error("Expected error")
 	}
 }
+
+func TestEncodeCounting(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf, false)
+	n1, err := enc.EncodeCounting(&testEvent{"1", "Add", "This is a test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n2, err := enc.EncodeCounting(comment{value: "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n1 != len("id: 1\nevent: Add\ndata: This is a test\n\n") || n2 != len(":hi\n") {
+		t.Errorf("Unexpected byte counts %d, %d", n1, n2)
+	}
+	if enc.BytesWritten() != int64(buf.Len()) {
+		t.Errorf("Expected total of %d, got %d", buf.Len(), enc.BytesWritten())
+	}
+}
+
+func TestEncodeCountingWithCompression(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf, true)
+	n, err := enc.EncodeCounting(&testEvent{"1", "Add", "This is a test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != buf.Len() || enc.BytesWritten() != int64(buf.Len()) {
+		t.Errorf("Expected count of %d compressed bytes, got %d (total %d)", buf.Len(), n, enc.BytesWritten())
+	}
+}
+
+func TestEncodeCommentThenEvent(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf, false)
+	if err := enc.Encode(comment{value: "keepalive"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Encode(&testEvent{"1", "Add", "This is a test"}); err != nil {
+		t.Fatal(err)
+	}
+	expected := ":keepalive\nid: 1\nevent: Add\ndata: This is a test\n\n"
+	if buf.String() != expected {
+		t.Errorf("Expected: %q Got: %q", expected, buf.String())
+	}
+	ev, err := NewDecoder(buf).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Id() != "1" || ev.Event() != "Add" || ev.Data() != "This is a test" {
+		t.Errorf("Unexpected event: %s %s %s", ev.Id(), ev.Event(), ev.Data())
+	}
+}
+
+func TestEncodeEventThenCommentThenEvent(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf, false)
+	for _, item := range []eventOrComment{
+		&testEvent{"1", "", "first"},
+		comment{value: "in between"},
+		&testEvent{"2", "", "second"},
+	} {
+		if err := enc.Encode(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dec := NewDecoder(buf)
+	for _, expected := range []string{"first", "second"} {
+		ev, err := dec.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.Data() != expected {
+			t.Errorf("Expected: %s Got: %s", expected, ev.Data())
+		}
+	}
+}
+
+func TestEncodeMultiLineCommentThenEvent(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf, false)
+	if err := enc.Encode(comment{value: "line1\nevent: oops\r\nline3\rdata: oops"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Encode(&testEvent{"", "", "This is a test"}); err != nil {
+		t.Fatal(err)
+	}
+	expected := ":line1\n:event: oops\n:line3\n:data: oops\ndata: This is a test\n\n"
+	if buf.String() != expected {
+		t.Errorf("Expected: %q Got: %q", expected, buf.String())
+	}
+	ev, err := NewDecoder(buf).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Event() != "" || ev.Data() != "This is a test" {
+		t.Errorf("Unexpected event: %q %q", ev.Event(), ev.Data())
+	}
+}
+
+type testEventWithExtraFields struct {
+	testEvent
+	fields map[string]string
+}
+
+func (e *testEventWithExtraFields) ExtraFields() map[string]string { return e.fields }
+
+func TestEncodeExtraFields(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf, false)
+	ev := &testEventWithExtraFields{
+		testEvent: testEvent{"1", "Add", "This is a test"},
+		fields:    map[string]string{"meta": "route=a", "cost": "3"},
+	}
+	if err := enc.Encode(ev); err != nil {
+		t.Fatal(err)
+	}
+	expected := "id: 1\nevent: Add\ncost: 3\nmeta: route=a\ndata: This is a test\n\n"
+	if buf.String() != expected {
+		t.Errorf("Expected: %q Got: %q", expected, buf.String())
+	}
+	decoded, err := NewDecoder(buf).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Id() != "1" || decoded.Event() != "Add" || decoded.Data() != "This is a test" {
+		t.Errorf("Unexpected event: %s %s %s", decoded.Id(), decoded.Event(), decoded.Data())
+	}
+}
+
+func TestEncodeExtraFieldsWithoutData(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf, false)
+	ev := &testEventWithExtraFields{fields: map[string]string{"meta": "x"}}
+	if err := enc.Encode(ev); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "meta: x\n\n" {
+		t.Errorf("Unexpected output: %q", buf.String())
+	}
+}
+
+func TestEncodeRejectsInvalidExtraFields(t *testing.T) {
+	for _, fields := range []map[string]string{
+		{"": "x"},
+		{"data": "x"},
+		{"retry": "1"},
+		{"a:b": "x"},
+		{"a\nb": "x"},
+		{"meta": "x\ndata: y"},
+	} {
+		buf := new(bytes.Buffer)
+		enc := NewEncoder(buf, false)
+		if err := enc.Encode(&testEventWithExtraFields{testEvent: testEvent{data: "x"}, fields: fields}); err == nil {
+			t.Errorf("Expected error for %v", fields)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("Expected nothing to be written for %v, got %q", fields, buf.String())
+		}
+	}
+}
+
+type testEventWithRetry struct {
+	testEvent
+	retryMillis int64
+}
+
+func (e *testEventWithRetry) RetryMillis() (int64, bool) { return e.retryMillis, e.retryMillis > 0 }
+
+func TestEncodeRetry(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf, false)
+	if err := enc.Encode(&testEventWithRetry{testEvent{"1", "", "This is a test"}, 3000}); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Encode(&testEventWithRetry{testEvent{"2", "", "No retry"}, 0}); err != nil {
+		t.Fatal(err)
+	}
+	expected := "id: 1\nretry: 3000\ndata: This is a test\n\nid: 2\ndata: No retry\n\n"
+	if buf.String() != expected {
+		t.Errorf("Expected: %q Got: %q", expected, buf.String())
+	}
+	decoded, err := NewDecoder(buf).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if millis, _ := decoded.(EventWithRetry).RetryMillis(); millis != 3000 {
+		t.Errorf("Unexpected retry value: %d", millis)
+	}
+}
+
+func TestEncodeCanSplitLongDataLines(t *testing.T) {
+	for _, tt := range []struct {
+		data          string
+		maxLineLength int
+		expected      string
+	}{
+		{"abcdefghij", 0, "data: abcdefghij\n\n"},
+		{"abcdefghij", 16, "data: abcdefghij\n\n"},
+		{"abcdefghij", 10, "data: abcd\ndata: efgh\ndata: ij\n\n"},
+		{"abcdef\nghi", 10, "data: abcd\ndata: ef\ndata: ghi\n\n"},
+		{"ab\u00e9cd", 9, "data: ab\ndata: \u00e9c\ndata: d\n\n"},
+		{"\u00e9\u00e9", 1, "data: \u00e9\ndata: \u00e9\n\n"},
+	} {
+		buf := new(bytes.Buffer)
+		enc := NewEncoderWithOptions(buf, false, EncoderOptionMaxLineLength(tt.maxLineLength))
+		if err := enc.Encode(&testEvent{data: tt.data}); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.expected {
+			t.Errorf("For %q with limit %d, expected: %q Got: %q", tt.data, tt.maxLineLength, tt.expected, buf.String())
+		}
+	}
+}
+
+func TestEncodeExactReproducesDecodedFields(t *testing.T) {
+	input := "meta: route=a\nid: 1\nx-custom\ndata: line1\nevent: Add\ndata:  line2\nretry: 100\n\n"
+	dec := NewDecoderWithOptions(bytes.NewBufferString(input), DecoderOptionPreserveFields(true))
+	ev, err := dec.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := NewEncoder(buf, false).EncodeExact(ev); err != nil {
+		t.Fatal(err)
+	}
+	expected := "meta: route=a\nid: 1\nx-custom: \ndata: line1\nevent: Add\ndata:  line2\nretry: 100\n\n"
+	if buf.String() != expected {
+		t.Errorf("Expected: %q Got: %q", expected, buf.String())
+	}
+	ev2, err := NewDecoderWithOptions(buf, DecoderOptionPreserveFields(true)).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ev, ev2) {
+		t.Errorf("Expected: %+v Got: %+v", ev, ev2)
+	}
+}
+
+func TestEncodeExactWithoutFieldsIsSameAsEncode(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := NewEncoder(buf, false).EncodeExact(&testEvent{"1", "Add", "This is a test"}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "id: 1\nevent: Add\ndata: This is a test\n\n" {
+		t.Errorf("Unexpected output: %q", buf.String())
+	}
+}
+
+func TestEncodeCanSanitizeFields(t *testing.T) {
+	forged := &testEvent{id: "1\nevent: forged", event: "a\rdata: forged", data: "x\ry"}
+	for _, tt := range []struct {
+		mode     FieldSanitizeMode
+		expected string
+	}{
+		{FieldSanitizeNone, "id: 1\nid: event: forged\nevent: a\rdata: forged\ndata: x\ry\n\n"},
+		{FieldSanitizeReplace, "id: 1\uFFFDevent: forged\nevent: a\uFFFDdata: forged\ndata: x\ndata: y\n\n"},
+		{FieldSanitizeReject, ""},
+	} {
+		buf := new(bytes.Buffer)
+		err := NewEncoderWithOptions(buf, false, EncoderOptionSanitizeFields(tt.mode)).Encode(forged)
+		if (err != nil) != (tt.mode == FieldSanitizeReject) {
+			t.Errorf("For mode %d, got unexpected error result: %v", tt.mode, err)
+		}
+		if buf.String() != tt.expected {
+			t.Errorf("For mode %d, expected: %q Got: %q", tt.mode, tt.expected, buf.String())
+		}
+	}
+}
+
+func TestEncodeWithSanitizedFieldsCannotForgeFields(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := NewEncoderWithOptions(buf, false, EncoderOptionSanitizeFields(FieldSanitizeReplace))
+	if err := enc.Encode(&testEvent{id: "1\ndata: forged\n\nid: 2", data: "real"}); err != nil {
+		t.Fatal(err)
+	}
+	ev, err := NewDecoder(buf).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Data() != "real" || ev.Id() != "1\uFFFDdata: forged\uFFFD\uFFFDid: 2" {
+		t.Errorf("Unexpected event: id %q, data %q", ev.Id(), ev.Data())
+	}
+}
+
+func TestWriteCommentIsSameAsEncodingComment(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := NewEncoder(buf, false).WriteComment("line1\nline2"); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != ":line1\n:line2\n" {
+		t.Errorf("Unexpected output: %q", buf.String())
+	}
+}
+
+func TestWriteRawWritesBytesUnchanged(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf, false)
+	if err := enc.WriteRaw([]byte("id: 1\r\ndata: a\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Encode(&testEvent{data: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "id: 1\r\ndata: a\r\n\r\ndata: b\n\n" {
+		t.Errorf("Unexpected output: %q", buf.String())
+	}
+	if enc.BytesWritten() != int64(buf.Len()) {
+		t.Errorf("Expected BytesWritten to be %d, got %d", buf.Len(), enc.BytesWritten())
+	}
+}
@@ -2,6 +2,9 @@ package eventsource
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"strconv"
 	"strings"
@@ -11,6 +14,9 @@ import (
 type publication struct {
 	id, event, data string
 	retry           int64
+	dataLineCount   int
+	fields          []Field
+	raw             []byte
 }
 
 //nolint:golint,stylecheck // should be ID; retained for backward compatibility
@@ -19,11 +25,104 @@ func (s *publication) Event() string { return s.event }
 func (s *publication) Data() string  { return s.data }
 func (s *publication) Retry() int64  { return s.retry }
 
+// DataLineCount returns the number of "data:" lines that were combined to produce the event's data.
+// This method is available on any Event returned by Decoder.Decode or received from a Stream, and
+// can be accessed with a type assertion to interface{ DataLineCount() int }.
+func (s *publication) DataLineCount() int { return s.dataLineCount }
+
+// Fields returns all of the fields that made up the event, in the order they were read, if the Decoder
+// was created with DecoderOptionPreserveFields; otherwise it returns nil. This implements
+// EventWithFields.
+func (s *publication) Fields() []Field { return s.fields }
+
+// RawBytes returns the bytes that the event was decoded from, if the Decoder was created with
+// DecoderOptionRawBytes; otherwise it returns nil. This implements EventWithRawBytes.
+func (s *publication) RawBytes() []byte { return s.raw }
+
+// RetryMillis returns the value of the event's "retry:" field, if any. This implements EventWithRetry.
+func (s *publication) RetryMillis() (int64, bool) { return s.retry, s.retry > 0 }
+
+type decodedComment struct {
+	text string
+}
+
+//nolint:golint,stylecheck // should be ID; retained for backward compatibility
+func (c decodedComment) Id() string          { return "" }
+func (c decodedComment) Event() string       { return "" }
+func (c decodedComment) Data() string        { return "" }
+func (c decodedComment) CommentText() string { return c.text }
+
 // A Decoder is capable of reading Events from a stream.
 type Decoder struct {
-	linesCh     <-chan string
-	errorCh     <-chan error
-	readTimeout time.Duration
+	linesCh        <-chan bufferedLine
+	errorCh        <-chan error
+	readTimeout    time.Duration
+	trimFieldNames bool
+	validateID     func(string) bool
+	gapObserver    func(time.Duration)
+	lastLineTime   time.Time
+	preserveFields bool
+	endedCleanly   bool
+	returnComments bool
+	maxEventSize   int
+	maxFieldSize   int
+	sentinel       func(string) bool
+	rawBytes       bool
+	partial        *publication // an event that was interrupted by returning a comment
+	moreBuffered   bool         // true if the last line that was read was not the end of the buffered data
+	idLine         bufferedLine // the line that set the ID of the event being decoded; see DecodeError
+}
+
+// ErrInvalidEventID is the error that Decoder.Decode reports, in a DecodeError, if an event's ID was
+// rejected by the function specified with DecoderOptionValidateID.
+var ErrInvalidEventID = errors.New("event ID was rejected by validator")
+
+// ErrEventTooLarge is the error that Decoder.Decode reports, in a DecodeError, if an event exceeded the
+// size limit specified with DecoderOptionMaxEventSize.
+var ErrEventTooLarge = errors.New("event exceeded maximum size")
+
+// ErrFieldTooLarge is the error that Decoder.Decode reports, in a DecodeError, if a field's value
+// exceeded the size limit specified with DecoderOptionMaxFieldValueSize.
+var ErrFieldTooLarge = errors.New("event field exceeded maximum size")
+
+// The maximum number of bytes of a line that are included in a DecodeError.
+const maxDecodeErrorLineLength = 100
+
+// DecodeError is the error returned by Decoder.Decode if the stream breaks one of the rules that were set
+// with DecoderOptions, or if StreamOptionContentSentinel detected unexpected content. It tells where the
+// problem was found, which can make it much easier to debug a server that sends malformed data. Err is one
+// of ErrEventTooLarge, ErrFieldTooLarge, ErrInvalidEventID, or ErrUnexpectedContent; since DecodeError
+// implements Unwrap, errors.Is(err, ErrEventTooLarge) can be used to check for these.
+//
+// A Stream reports a DecodeError as it would any other error that ends a connection.
+type DecodeError struct {
+	// Err is the underlying error.
+	Err error
+	// Offset is the number of bytes in the stream before the line where the problem was found, including
+	// the original line endings. For a Stream, it is counted from the start of the current connection.
+	Offset int64
+	// Line is the content of that line, without the line ending; if the line is longer than 100 bytes,
+	// only the first 100 are included. It is empty if the line was too long to be read at all (see
+	// DecoderOptionMaxEventSize). For ErrInvalidEventID, this is the line with the event's ID.
+	Line string
+}
+
+// Error returns a description of the error, including its position.
+func (e DecodeError) Error() string {
+	return fmt.Sprintf("%s (at byte offset %d: %q)", e.Err, e.Offset, e.Line)
+}
+
+// Unwrap returns the underlying error.
+func (e DecodeError) Unwrap() error {
+	return e.Err
+}
+
+func newDecodeError(err error, bl bufferedLine) DecodeError {
+	line := strings.TrimRight(bl.line, "\r\n")
+	if len(line) > maxDecodeErrorLineLength {
+		line = line[:maxDecodeErrorLineLength]
+	}
+	return DecodeError{Err: err, Offset: bl.offset, Line: line}
 }
 
 // DecoderOption is a common interface for optional configuration parameters that can be
@@ -45,23 +144,183 @@ func DecoderOptionReadTimeout(timeout time.Duration) DecoderOption {
 	return readTimeoutDecoderOption(timeout)
 }
 
+type trimFieldNamesDecoderOption bool
+
+func (o trimFieldNamesDecoderOption) apply(d *Decoder) {
+	d.trimFieldNames = bool(o)
+}
+
+// DecoderOptionTrimFieldNames returns an option that determines whether the Decoder ignores whitespace
+// around field names. This is meant for interoperability with servers that incorrectly write lines such
+// as " data: x".
+//
+// According to the SSE specification, " data" is a different field name from "data", so by default such
+// a line is ignored. If trimFieldNames is true, the Decoder trims surrounding whitespace from each field
+// name before matching it, so the line would be treated as a "data" field.
+func DecoderOptionTrimFieldNames(trimFieldNames bool) DecoderOption {
+	return trimFieldNamesDecoderOption(trimFieldNames)
+}
+
+type validateIDDecoderOption func(string) bool
+
+func (o validateIDDecoderOption) apply(d *Decoder) {
+	d.validateID = o
+}
+
+// DecoderOptionValidateID returns an option that sets a function for validating event IDs.
+//
+// An "id:" field always ends at the end of its line, so it cannot contain a newline; and, as the SSE
+// specification requires, an "id:" field whose value contains a null character is always ignored. If
+// you need to apply stricter rules, such as rejecting other control characters, you can provide a
+// function that returns false for any ID that is not acceptable. In that case, Decode reads the rest of
+// the event and then returns a DecodeError with ErrInvalidEventID instead of the event. The caller may
+// then call Decode again to skip to the next event, or treat the stream as broken.
+func DecoderOptionValidateID(validateID func(string) bool) DecoderOption {
+	return validateIDDecoderOption(validateID)
+}
+
+type gapObserverDecoderOption func(time.Duration)
+
+func (o gapObserverDecoderOption) apply(d *Decoder) {
+	d.gapObserver = o
+}
+
+// DecoderOptionInterEventGapObserver returns an option that sets a function to be called whenever the
+// Decoder reads a line, including comments and the blank lines between events. The parameter is the time
+// since the previous line was read, or, for the first line, since the Decoder was created.
+//
+// This is measured in the same way as the read timeout (see DecoderOptionReadTimeout), so it can be used
+// to find out what read timeout would be appropriate for a stream. The function is called synchronously
+// from Decode, so it should return quickly.
+func DecoderOptionInterEventGapObserver(observer func(gap time.Duration)) DecoderOption {
+	return gapObserverDecoderOption(observer)
+}
+
+type preserveFieldsDecoderOption bool
+
+func (o preserveFieldsDecoderOption) apply(d *Decoder) {
+	d.preserveFields = bool(o)
+}
+
+// DecoderOptionPreserveFields returns an option that determines whether the Decoder keeps a list of all
+// the fields in each event, including ones that it does not recognize, such as protocol extensions.
+// This is meant for proxies that decode events in order to inspect them, and then use
+// Encoder.EncodeExact to pass them on without losing anything.
+//
+// If preserveFields is true, the fields can be obtained by casting the Event to EventWithFields. Comment
+// lines are not included.
+func DecoderOptionPreserveFields(preserveFields bool) DecoderOption {
+	return preserveFieldsDecoderOption(preserveFields)
+}
+
+type returnCommentsDecoderOption bool
+
+func (o returnCommentsDecoderOption) apply(d *Decoder) {
+	d.returnComments = bool(o)
+}
+
+// DecoderOptionReturnComments returns an option that determines whether Decode returns comment lines,
+// which are normally ignored. Servers often send comments as heartbeats, or to carry information that
+// is not part of the event data.
+//
+// If returnComments is true, each comment line is returned as an Event that implements Comment. Its Id,
+// Event, and Data methods return empty strings, so code that does not expect comments should check for
+// that interface. A comment may appear in the middle of an event; in that case, Decode returns the
+// comment first, and then the event once it is complete.
+func DecoderOptionReturnComments(returnComments bool) DecoderOption {
+	return returnCommentsDecoderOption(returnComments)
+}
+
+// Used by StreamOptionContentSentinel.
+type contentSentinelDecoderOption func(string) bool
+
+func (o contentSentinelDecoderOption) apply(d *Decoder) {
+	d.sentinel = o
+}
+
+type rawBytesDecoderOption bool
+
+func (o rawBytesDecoderOption) apply(d *Decoder) {
+	d.rawBytes = bool(o)
+}
+
+// DecoderOptionRawBytes returns an option that determines whether the Decoder keeps the exact bytes that
+// each event was decoded from. This is meant for applications that need to verify a signature over the
+// data that the server sent, since encoding the event again would not necessarily reproduce it.
+//
+// If rawBytes is true, the bytes can be obtained by casting the Event to EventWithRawBytes. They start
+// with the event's first field and end with the blank line that ends the event, including any comments
+// in between and the original line endings. Comments before the first field are not included.
+//
+// In order to know whether a carriage return is followed by a line feed, the Decoder has to see the next
+// byte after it. So, if the server uses a carriage return alone as a line ending, each event is only
+// returned once the next data after it has been received.
+func DecoderOptionRawBytes(rawBytes bool) DecoderOption {
+	return rawBytesDecoderOption(rawBytes)
+}
+
+type maxEventSizeDecoderOption int
+
+func (o maxEventSizeDecoderOption) apply(d *Decoder) {
+	d.maxEventSize = int(o)
+}
+
+// DecoderOptionMaxEventSize returns an option that limits how much memory the Decoder will use for a
+// single event, to protect against a server that sends an unreasonably large event or an endless series
+// of "data:" lines.
+//
+// The limit applies to the combined size in bytes of the event's data (including the newlines between
+// data lines), ID, and event name. Any single line that is longer than the limit, even a comment, is
+// also rejected, since it would otherwise have to be read into memory in full. In either case, Decode
+// returns a DecodeError with ErrEventTooLarge; the Decoder should not be used after that, because the
+// rest of the stream cannot be parsed reliably. By default, or if maxBytes is zero or negative, there
+// is no limit.
+func DecoderOptionMaxEventSize(maxBytes int) DecoderOption {
+	return maxEventSizeDecoderOption(maxBytes)
+}
+
+type maxFieldValueSizeDecoderOption int
+
+func (o maxFieldValueSizeDecoderOption) apply(d *Decoder) {
+	d.maxFieldSize = int(o)
+}
+
+// DecoderOptionMaxFieldValueSize returns an option that limits the size in bytes of any single field's
+// value within an event. For "data", this is the combined value of all of the event's "data:" lines,
+// including the newlines between them; for any other field, it is the value on one line. This can be
+// used along with DecoderOptionMaxEventSize, for instance to allow large data but only short IDs.
+//
+// If a value exceeds the limit, Decode returns a DecodeError with ErrFieldTooLarge; the Decoder should
+// not be used after that. This option does not limit the length of a line that the Decoder reads before
+// it can examine the field, so to avoid reading an arbitrarily long line into memory,
+// DecoderOptionMaxEventSize should also be set. By default, or if maxBytes is zero or negative, there is
+// no limit.
+func DecoderOptionMaxFieldValueSize(maxBytes int) DecoderOption {
+	return maxFieldValueSizeDecoderOption(maxBytes)
+}
+
 // NewDecoder returns a new Decoder instance that reads events with the given io.Reader.
+//
+// The Decoder does not limit the length of a line or the size of an event: its buffer grows as needed,
+// so an event can have a single "data:" line of any size. To set a limit, use DecoderOptionMaxEventSize
+// or DecoderOptionMaxFieldValueSize.
 func NewDecoder(r io.Reader) *Decoder {
-	bufReader := bufio.NewReader(newNormaliser(r))
-	linesCh, errorCh := newLineStreamChannel(bufReader)
-	return &Decoder{
-		linesCh: linesCh,
-		errorCh: errorCh,
-	}
+	return NewDecoderWithOptions(r)
 }
 
 // NewDecoderWithOptions returns a new Decoder instance that reads events with the given
 // io.Reader, with optional configuration parameters.
 func NewDecoderWithOptions(r io.Reader, options ...DecoderOption) *Decoder {
-	d := NewDecoder(r)
+	d := &Decoder{lastLineTime: time.Now()}
 	for _, o := range options {
 		o.apply(d)
 	}
+	if d.rawBytes {
+		d.linesCh, d.errorCh = newLineStreamChannel(bufio.NewReader(r), nil, d.maxEventSize, readRawLine)
+	} else {
+		norm := newNormaliser(r)
+		d.linesCh, d.errorCh = newLineStreamChannel(bufio.NewReader(norm), norm, d.maxEventSize, readLine)
+	}
 	return d
 }
 
@@ -71,8 +330,11 @@ func NewDecoderWithOptions(r io.Reader, options ...DecoderOption) *Decoder {
 // Any error occurring mid-event is considered non-graceful and will
 // show up as some other error (most likely io.ErrUnexpectedEOF).
 func (dec *Decoder) Decode() (Event, error) {
-	pub := new(publication)
-	inDecoding := false
+	pub, inDecoding := dec.partial, dec.partial != nil
+	if pub == nil {
+		pub = new(publication)
+	}
+	dec.partial = nil
 	var timeoutTimer *time.Timer
 	var timeoutCh <-chan time.Time
 	if dec.readTimeout > 0 {
@@ -83,22 +345,47 @@ func (dec *Decoder) Decode() (Event, error) {
 ReadLoop:
 	for {
 		select {
-		case line := <-dec.linesCh:
+		case bl := <-dec.linesCh:
+			rawLine, line := bl.line, bl.line
+			dec.moreBuffered = bl.more
+			if dec.rawBytes {
+				line = normaliseLineEnding(rawLine)
+			}
 			if timeoutTimer != nil {
 				if !timeoutTimer.Stop() {
 					<-timeoutCh
 				}
 				timeoutTimer.Reset(dec.readTimeout)
 			}
+			if dec.gapObserver != nil {
+				now := time.Now()
+				dec.gapObserver(now.Sub(dec.lastLineTime))
+				dec.lastLineTime = now
+			}
+			if dec.sentinel != nil && dec.sentinel(strings.TrimSuffix(line, "\n")) {
+				return nil, newDecodeError(ErrUnexpectedContent, bl)
+			}
 			if line == "\n" && inDecoding {
 				// the empty line signals the end of an event
+				if dec.rawBytes {
+					pub.raw = append(pub.raw, rawLine...)
+				}
 				break ReadLoop
 			} else if line == "\n" && !inDecoding {
 				// only a newline was sent, so we don't want to publish an empty event but try to read again
 				continue ReadLoop
 			}
 			line = strings.TrimSuffix(line, "\n")
+			if dec.rawBytes && (inDecoding || !strings.HasPrefix(line, ":")) {
+				pub.raw = append(pub.raw, rawLine...)
+			}
 			if strings.HasPrefix(line, ":") {
+				if dec.returnComments {
+					if inDecoding {
+						dec.partial = pub
+					}
+					return decodedComment{strings.TrimPrefix(line[1:], " ")}, nil
+				}
 				continue ReadLoop
 			}
 			sections := strings.SplitN(line, ":", 2)
@@ -106,18 +393,51 @@ ReadLoop:
 			if len(sections) == 2 {
 				value = strings.TrimPrefix(sections[1], " ")
 			}
+			if dec.trimFieldNames {
+				field = strings.TrimSpace(field)
+			}
 			inDecoding = true
+			if dec.preserveFields {
+				pub.fields = append(pub.fields, Field{Name: field, Value: value})
+			}
 			switch field {
 			case "event":
 				pub.event = value
 			case "data":
 				pub.data += value + "\n"
+				pub.dataLineCount++
 			case "id":
-				pub.id = value
+				if !strings.ContainsRune(value, 0) {
+					pub.id = value
+					dec.idLine = bl
+				}
 			case "retry":
 				pub.retry, _ = strconv.ParseInt(value, 10, 64)
 			}
+			if dec.maxFieldSize > 0 {
+				size := len(value)
+				if field == "data" {
+					size = len(pub.data) - 1 // not counting the trailing newline
+				}
+				if size > dec.maxFieldSize {
+					return nil, newDecodeError(ErrFieldTooLarge, bl)
+				}
+			}
+			if dec.maxEventSize > 0 {
+				size := len(pub.data) + len(pub.id) + len(pub.event)
+				if pub.dataLineCount > 0 {
+					size-- // the trailing newline will be removed from the data
+				}
+				if size > dec.maxEventSize {
+					return nil, newDecodeError(ErrEventTooLarge, bl)
+				}
+			}
 		case err := <-dec.errorCh:
+			if err != nil {
+				// a partial line at the end of the stream is reported as io.ErrUnexpectedEOF; see
+				// newLineStreamChannel
+				dec.endedCleanly = err == io.EOF && !inDecoding
+			}
 			if err == io.ErrUnexpectedEOF && !inDecoding {
 				// if we're not in the middle of an event then just return EOF
 				err = io.EOF
@@ -131,27 +451,143 @@ ReadLoop:
 		}
 	}
 	pub.data = strings.TrimSuffix(pub.data, "\n")
+	if dec.validateID != nil && pub.id != "" && !dec.validateID(pub.id) {
+		return nil, newDecodeError(ErrInvalidEventID, dec.idLine)
+	}
 	return pub, nil
 }
 
+// EndedCleanly returns true if the stream has ended, so that Decode returned io.EOF, and the last
+// thing in the stream was the end of an event (or of a comment). It returns false if Decode has not
+// yet reached the end of the stream, or if the stream was truncated in the middle of an event or of
+// a line. Decode returns io.ErrUnexpectedEOF in the first case, but in the second case it returns
+// io.EOF if no event was in progress, so this method is the only way to tell it apart from a clean
+// end. This can be used to detect a server or proxy that closes connections abruptly.
+func (dec *Decoder) EndedCleanly() bool {
+	return dec.endedCleanly
+}
+
+// Returns true if the data that the Decoder has already read from the stream continues past the end of
+// the last event that Decode returned, so that another event may be decoded without waiting for a read.
+func (dec *Decoder) hasBufferedData() bool {
+	return dec.moreBuffered
+}
+
+type bufferedLine struct {
+	line   string
+	more   bool  // true if more data was already in the buffer after this line
+	offset int64 // the number of bytes before this line in the original stream
+}
+
 /**
  * Returns a channel that will receive lines of text as they are read. On any error
- * from the underlying reader, it stops and posts the error to a second channel.
+ * from the underlying reader, it stops and posts the error to a second channel. If
+ * maxLineLength is positive, a longer line (not counting the newline) is reported as
+ * ErrEventTooLarge without reading the rest of it. If the reader normalises line endings, norm is
+ * the normaliser, so that the position of each line in the original stream can be found.
  */
-func newLineStreamChannel(r *bufio.Reader) (<-chan string, <-chan error) {
-	linesCh := make(chan string)
+func newLineStreamChannel(
+	r *bufio.Reader,
+	norm *normaliser,
+	maxLineLength int,
+	readLine func(*bufio.Reader, int) (string, error),
+) (<-chan bufferedLine, <-chan error) {
+	linesCh := make(chan bufferedLine)
 	errorCh := make(chan error)
 	go func() {
 		defer close(linesCh)
 		defer close(errorCh)
+		var pos int64 // the position of the next line in the data that r returns
 		for {
-			line, err := r.ReadString('\n')
+			line, err := readLine(r, maxLineLength)
+			offset := pos
+			if norm != nil {
+				// this is done after reading the line, so that the LF of a CRLF just before it has been seen
+				offset = norm.originalOffset(pos)
+			}
+			pos += int64(len(line))
+			if err == io.EOF && line != "" {
+				// the stream ended in the middle of a line, which is discarded
+				err = io.ErrUnexpectedEOF
+			}
+			if err == ErrEventTooLarge {
+				err = DecodeError{Err: err, Offset: offset}
+			}
 			if err != nil {
 				errorCh <- err
 				return
 			}
-			linesCh <- line
+			linesCh <- bufferedLine{line, r.Buffered() > 0, offset}
 		}
 	}()
 	return linesCh, errorCh
 }
+
+func readLine(r *bufio.Reader, maxLineLength int) (string, error) {
+	if maxLineLength <= 0 {
+		return r.ReadString('\n')
+	}
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		length := len(line)
+		if length > 0 && line[length-1] == '\n' {
+			length--
+		}
+		if length > maxLineLength {
+			return "", ErrEventTooLarge
+		}
+		if err != bufio.ErrBufferFull {
+			return string(line), err
+		}
+	}
+}
+
+// Reads a line like readLine, but from a reader whose line endings have not been normalised; the line
+// ends with whichever of "\n", "\r", or "\r\n" ended it in the stream.
+func readRawLine(r *bufio.Reader, maxLineLength int) (string, error) {
+	var line []byte
+	for {
+		buf, err := r.Peek(1)
+		if err != nil {
+			return string(line), err
+		}
+		if n := r.Buffered(); n > 1 {
+			buf, _ = r.Peek(n)
+		}
+		end := bytes.IndexAny(buf, "\r\n")
+		length := len(line) + end
+		if end < 0 {
+			length = len(line) + len(buf)
+		}
+		if maxLineLength > 0 && length > maxLineLength {
+			return "", ErrEventTooLarge
+		}
+		if end < 0 {
+			line = append(line, buf...)
+			_, _ = r.Discard(len(buf))
+			continue
+		}
+		line = append(line, buf[:end+1]...)
+		_, _ = r.Discard(end + 1)
+		if line[len(line)-1] == '\r' {
+			if next, err := r.Peek(1); err == nil && next[0] == '\n' {
+				line = append(line, '\n')
+				_, _ = r.Discard(1)
+			}
+		}
+		return string(line), nil
+	}
+}
+
+// Converts the line ending of a line returned by readRawLine to "\n".
+func normaliseLineEnding(line string) string {
+	if strings.HasSuffix(line, "\r\n") {
+		return line[:len(line)-2] + "\n"
+	}
+	if strings.HasSuffix(line, "\r") {
+		return line[:len(line)-1] + "\n"
+	}
+	return line
+}
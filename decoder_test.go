@@ -5,8 +5,18 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
+// Returns the Err field of a DecodeError, or the error itself if it is some other kind of error.
+func decodeErrorCause(err error) error {
+	if e, ok := err.(DecodeError); ok {
+		return e.Err
+	}
+	return err
+}
+
 func TestDecode(t *testing.T) {
 	tests := []struct {
 		rawInput     string
@@ -14,7 +24,7 @@ func TestDecode(t *testing.T) {
 	}{
 		{
 			rawInput:     "event: eventName\ndata: {\"sample\":\"value\"}\n\n",
-			wantedEvents: []*publication{{event: "eventName", data: "{\"sample\":\"value\"}"}},
+			wantedEvents: []*publication{{event: "eventName", data: "{\"sample\":\"value\"}", dataLineCount: 1}},
 		},
 		{
 			// the newlines should not be parsed as empty event
@@ -45,3 +55,365 @@ func TestDecode(t *testing.T) {
 		}
 	}
 }
+
+func TestDecodeCountsDataLines(t *testing.T) {
+	tests := []struct {
+		rawInput  string
+		lineCount int
+	}{
+		{"event: noData\n\n", 0},
+		{"data:\n\n", 1},
+		{"data: a\n\n", 1},
+		{"data: a\ndata: b\nevent: x\ndata: c\n\n", 3},
+	}
+
+	for _, test := range tests {
+		decoder := NewDecoder(strings.NewReader(test.rawInput))
+		event, err := decoder.Decode()
+		if err != nil {
+			t.Fatalf("Unexpected error on decoding event: %s", err)
+		}
+		if n := event.(interface{ DataLineCount() int }).DataLineCount(); n != test.lineCount {
+			t.Errorf("Expected %d data lines for %q, got %d", test.lineCount, test.rawInput, n)
+		}
+	}
+}
+
+func TestDecodeIgnoresFieldNamesWithWhitespaceByDefault(t *testing.T) {
+	decoder := NewDecoder(strings.NewReader(" data: x\nevent: e\n\n"))
+	event, err := decoder.Decode()
+	if err != nil {
+		t.Fatalf("Unexpected error on decoding event: %s", err)
+	}
+	if event.Data() != "" || event.Event() != "e" {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+}
+
+func TestDecodeCanTrimFieldNames(t *testing.T) {
+	decoder := NewDecoderWithOptions(strings.NewReader(" data: x\n\tevent : e\n\n"), DecoderOptionTrimFieldNames(true))
+	event, err := decoder.Decode()
+	if err != nil {
+		t.Fatalf("Unexpected error on decoding event: %s", err)
+	}
+	if event.Data() != "x" || event.Event() != "e" {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+}
+
+func TestDecodeIDCannotContainNewlineOrNull(t *testing.T) {
+	decoder := NewDecoder(strings.NewReader("id: a\nid: b\ndata: x\n\nid: c\nid: d\x00e\ndata: y\n\n"))
+	event, err := decoder.Decode()
+	if err != nil {
+		t.Fatalf("Unexpected error on decoding event: %s", err)
+	}
+	if event.Id() != "b" {
+		t.Errorf("Expected ID %q, got %q", "b", event.Id())
+	}
+	event, err = decoder.Decode()
+	if err != nil {
+		t.Fatalf("Unexpected error on decoding event: %s", err)
+	}
+	if event.Id() != "c" {
+		t.Errorf("Expected ID %q, got %q", "c", event.Id())
+	}
+}
+
+func TestDecodeCanRejectInvalidID(t *testing.T) {
+	noControlChars := func(id string) bool {
+		for _, ch := range id {
+			if ch < 0x20 || ch == 0x7f {
+				return false
+			}
+		}
+		return true
+	}
+	decoder := NewDecoderWithOptions(strings.NewReader("id: a\x1bb\ndata: x\n\nid: c\ndata: y\n\n"),
+		DecoderOptionValidateID(noControlChars))
+	_, err := decoder.Decode()
+	if decodeErrorCause(err) != ErrInvalidEventID {
+		t.Fatalf("Expected ErrInvalidEventID, got %v", err)
+	}
+	event, err := decoder.Decode()
+	if err != nil {
+		t.Fatalf("Unexpected error on decoding event: %s", err)
+	}
+	if event.Id() != "c" || event.Data() != "y" {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+}
+
+func TestDecodeReportsInterEventGaps(t *testing.T) {
+	r, w := io.Pipe()
+	var gaps []time.Duration
+	decoder := NewDecoderWithOptions(r, DecoderOptionInterEventGapObserver(func(gap time.Duration) {
+		gaps = append(gaps, gap)
+	}))
+	go func() {
+		_, _ = io.WriteString(w, ":comment\ndata: x\n")
+		time.Sleep(time.Millisecond * 100)
+		_, _ = io.WriteString(w, "\n")
+	}()
+	if _, err := decoder.Decode(); err != nil {
+		t.Fatalf("Unexpected error on decoding event: %s", err)
+	}
+	if len(gaps) != 3 {
+		t.Fatalf("Expected 3 gaps, got %v", gaps)
+	}
+	if gaps[2] < time.Millisecond*100 {
+		t.Errorf("Expected last gap to be at least 100ms, got %s", gaps[2])
+	}
+}
+
+func TestDecodeDoesNotPreserveFieldsByDefault(t *testing.T) {
+	event, err := NewDecoder(strings.NewReader("meta: x\ndata: y\n\n")).Decode()
+	if err != nil {
+		t.Fatalf("Unexpected error on decoding event: %s", err)
+	}
+	if fields := event.(EventWithFields).Fields(); fields != nil {
+		t.Errorf("Expected no fields, got %+v", fields)
+	}
+}
+
+func TestDecodeCanPreserveFields(t *testing.T) {
+	event, err := NewDecoderWithOptions(strings.NewReader(":comment\nmeta: x\nid: a\x00b\ndata: y\n\n"),
+		DecoderOptionPreserveFields(true)).Decode()
+	if err != nil {
+		t.Fatalf("Unexpected error on decoding event: %s", err)
+	}
+	expected := []Field{{"meta", "x"}, {"id", "a\x00b"}, {"data", "y"}}
+	if fields := event.(EventWithFields).Fields(); !reflect.DeepEqual(expected, fields) {
+		t.Errorf("Expected %+v, got %+v", expected, fields)
+	}
+}
+
+func TestDecodeExposesRetryField(t *testing.T) {
+	for _, tt := range []struct {
+		input  string
+		millis int64
+		ok     bool
+	}{
+		{"retry: 1500\ndata: x\n\n", 1500, true},
+		{"data: x\n\n", 0, false},
+		{"retry: soon\ndata: x\n\n", 0, false},
+	} {
+		event, err := NewDecoder(strings.NewReader(tt.input)).Decode()
+		if err != nil {
+			t.Fatalf("Unexpected error on decoding event: %s", err)
+		}
+		millis, ok := event.(EventWithRetry).RetryMillis()
+		if millis != tt.millis || ok != tt.ok {
+			t.Errorf("For %q, expected (%d, %t), got (%d, %t)", tt.input, tt.millis, tt.ok, millis, ok)
+		}
+	}
+}
+
+func TestDecodeReportsWhetherStreamEndedCleanly(t *testing.T) {
+	for _, tt := range []struct {
+		input       string
+		expectedErr error
+		clean       bool
+	}{
+		{"data: x\n\n", io.EOF, true},
+		{"data: x\n\n: comment\n", io.EOF, true},
+		{"data: x\n\n: comm", io.EOF, false},
+		{"data: x\n\nda", io.EOF, false},
+		{"data: x\n\ndata: y\n", io.ErrUnexpectedEOF, false},
+	} {
+		dec := NewDecoder(strings.NewReader(tt.input))
+		if _, err := dec.Decode(); err != nil {
+			t.Fatalf("Unexpected error on decoding event: %s", err)
+		}
+		if dec.EndedCleanly() {
+			t.Errorf("For %q, expected EndedCleanly to be false before end of stream", tt.input)
+		}
+		if _, err := dec.Decode(); err != tt.expectedErr {
+			t.Errorf("For %q, expected error %v, got %v", tt.input, tt.expectedErr, err)
+		}
+		if dec.EndedCleanly() != tt.clean {
+			t.Errorf("For %q, expected EndedCleanly to be %t", tt.input, tt.clean)
+		}
+	}
+}
+
+func TestDecodeIgnoresCommentsByDefault(t *testing.T) {
+	event, err := NewDecoder(strings.NewReader(": hello\ndata: x\n\n")).Decode()
+	if err != nil {
+		t.Fatalf("Unexpected error on decoding event: %s", err)
+	}
+	if _, ok := event.(Comment); ok || event.Data() != "x" {
+		t.Errorf("Expected event with data, got %+v", event)
+	}
+}
+
+func TestDecodeCanReturnComments(t *testing.T) {
+	dec := NewDecoderWithOptions(strings.NewReader(": hello\ndata: x\n:in the middle\ndata: y\n\n"),
+		DecoderOptionReturnComments(true))
+	var results []string
+	for {
+		event, err := dec.Decode()
+		if err != nil {
+			break
+		}
+		if c, ok := event.(Comment); ok {
+			results = append(results, "comment: "+c.CommentText())
+		} else {
+			results = append(results, "data: "+event.Data())
+		}
+	}
+	expected := []string{"comment: hello", "comment: in the middle", "data: x\ny"}
+	if !reflect.DeepEqual(expected, results) {
+		t.Errorf("Expected %+v, got %+v", expected, results)
+	}
+}
+
+func TestDecodeEnforcesMaxEventSize(t *testing.T) {
+	for _, tt := range []struct {
+		input       string
+		expectedErr error
+	}{
+		{"id: abc\nevent: def\ndata: 1234\n\n", nil},
+		{"data: 12\ndata: 345\n\n", nil},
+		{"id: abc\nevent: def\ndata: 12345\n\n", ErrEventTooLarge},
+		{"data: 1234\ndata: 5678\ndata: 9\n\n", ErrEventTooLarge},
+		{": this comment is too long\ndata: x\n\n", ErrEventTooLarge},
+		{"data: 1\n\ndata: 2\n\n", nil},
+	} {
+		dec := NewDecoderWithOptions(strings.NewReader(tt.input), DecoderOptionMaxEventSize(10))
+		if _, err := dec.Decode(); decodeErrorCause(err) != tt.expectedErr {
+			t.Errorf("For %q, expected error %v, got %v", tt.input, tt.expectedErr, err)
+		}
+	}
+}
+
+func TestDecodeEnforcesMaxFieldValueSize(t *testing.T) {
+	for _, tt := range []struct {
+		input       string
+		expectedErr error
+	}{
+		{"id: 12345\nevent: 12345\ndata: 12345\n\n", nil},
+		{"data: 12\ndata: 3\n\n", nil},
+		{"id: 123456\ndata: x\n\n", ErrFieldTooLarge},
+		{"event: 123456\ndata: x\n\n", ErrFieldTooLarge},
+		{"data: 123\ndata: 45\n\n", ErrFieldTooLarge},
+		{"other: 123456\ndata: x\n\n", ErrFieldTooLarge},
+		{": comments are not fields\ndata: x\n\n", nil},
+	} {
+		dec := NewDecoderWithOptions(strings.NewReader(tt.input), DecoderOptionMaxFieldValueSize(5))
+		if _, err := dec.Decode(); decodeErrorCause(err) != tt.expectedErr {
+			t.Errorf("For %q, expected error %v, got %v", tt.input, tt.expectedErr, err)
+		}
+	}
+}
+
+func TestDecodeErrorReportsPositionOfLine(t *testing.T) {
+	long := strings.Repeat("x", 150)
+	for _, tt := range []struct {
+		input    string
+		options  []DecoderOption
+		expected DecodeError
+	}{
+		{"data: a\n\nid: 123456\ndata: b\n\n", []DecoderOption{DecoderOptionMaxFieldValueSize(5)},
+			DecodeError{Err: ErrFieldTooLarge, Offset: 9, Line: "id: 123456"}},
+		{"data: a\r\n\r\nid: 123456\r\ndata: b\r\n\r\n", []DecoderOption{DecoderOptionMaxFieldValueSize(5)},
+			DecodeError{Err: ErrFieldTooLarge, Offset: 11, Line: "id: 123456"}},
+		{"data: a\r\n\r\nid: 123456\r\ndata: b\r\n\r\n", []DecoderOption{DecoderOptionMaxFieldValueSize(5), DecoderOptionRawBytes(true)},
+			DecodeError{Err: ErrFieldTooLarge, Offset: 11, Line: "id: 123456"}},
+		{"data: a\r\rid: 1\x1b\rdata: b\r\r", []DecoderOption{DecoderOptionValidateID(func(id string) bool { return !strings.Contains(id, "\x1b") })},
+			DecodeError{Err: ErrInvalidEventID, Offset: 9, Line: "id: 1\x1b"}},
+		{"data: a\n\ndata: " + long + "\n\n", []DecoderOption{DecoderOptionMaxFieldValueSize(120)},
+			DecodeError{Err: ErrFieldTooLarge, Offset: 9, Line: "data: " + long[:94]}},
+		{"data: a\r\n\r\n: " + long + "\r\n\r\n", []DecoderOption{DecoderOptionMaxEventSize(100)},
+			DecodeError{Err: ErrEventTooLarge, Offset: 11}}, // the line was too long to read
+	} {
+		dec := NewDecoderWithOptions(strings.NewReader(tt.input), tt.options...)
+		if _, err := dec.Decode(); err != nil {
+			t.Fatalf("For %q, unexpected error on first event: %s", tt.input, err)
+		}
+		_, err := dec.Decode()
+		decodeErr, ok := err.(DecodeError)
+		if !ok {
+			t.Errorf("For %q, expected DecodeError, got %v", tt.input, err)
+		} else if decodeErr != tt.expected {
+			t.Errorf("For %q, expected %+v, got %+v", tt.input, tt.expected, decodeErr)
+		}
+	}
+}
+
+func TestDecodeHasNoMaxEventOrLineSizeByDefault(t *testing.T) {
+	data := strings.Repeat("x", 256*1024) // larger than the default maximum token size of bufio.Scanner
+	event, err := NewDecoder(strings.NewReader("data: " + data + "\n\n")).Decode()
+	if err != nil {
+		t.Fatalf("Unexpected error on decoding event: %s", err)
+	}
+	if event.Data() != data {
+		t.Errorf("Expected data of length %d, got %d", len(data), len(event.Data()))
+	}
+}
+
+func TestDecodeWithMixedLineEndings(t *testing.T) {
+	input := "id: 1\r\ndata: a\rdata: b\n\r\nevent: e\rdata: c\r\r: comment\r\ndata: d\n\n"
+	expected := []testEvent{{id: "1", data: "a\nb"}, {event: "e", data: "c"}, {data: "d"}}
+	for _, reader := range []io.Reader{strings.NewReader(input), iotest.OneByteReader(strings.NewReader(input))} {
+		dec := NewDecoder(reader)
+		var events []testEvent
+		for {
+			event, err := dec.Decode()
+			if err != nil {
+				break
+			}
+			events = append(events, testEvent{id: event.Id(), event: event.Event(), data: event.Data()})
+		}
+		if !reflect.DeepEqual(expected, events) {
+			t.Errorf("Expected %+v, got %+v", expected, events)
+		}
+	}
+}
+
+func TestDecodeCanKeepRawBytes(t *testing.T) {
+	input := ": before\r\nid: 1\r\ndata: a\r\n: inside\r\n\r\n\n\nevent: e\rdata: b\r\rdata: c\n\n"
+	expected := []string{"id: 1\r\ndata: a\r\n: inside\r\n\r\n", "event: e\rdata: b\r\r", "data: c\n\n"}
+	for _, reader := range []io.Reader{strings.NewReader(input), iotest.OneByteReader(strings.NewReader(input))} {
+		dec := NewDecoderWithOptions(reader, DecoderOptionRawBytes(true))
+		var raw []string
+		for {
+			event, err := dec.Decode()
+			if err != nil {
+				break
+			}
+			raw = append(raw, string(event.(EventWithRawBytes).RawBytes()))
+		}
+		if !reflect.DeepEqual(expected, raw) {
+			t.Errorf("Expected %q, got %q", expected, raw)
+		}
+	}
+}
+
+func TestDecodeWithRawBytesParsesEventsTheSameWay(t *testing.T) {
+	input := "id: 1\r\ndata: a\rdata: b\n\r\nevent: e\rdata: c\r\r: comment\r\ndata: d\n\ndata: partial"
+	decode := func(dec *Decoder) []testEvent {
+		var events []testEvent
+		for {
+			event, err := dec.Decode()
+			if err != nil {
+				return append(events, testEvent{data: err.Error()})
+			}
+			events = append(events, testEvent{id: event.Id(), event: event.Event(), data: event.Data()})
+		}
+	}
+	expected := decode(NewDecoder(strings.NewReader(input)))
+	actual := decode(NewDecoderWithOptions(strings.NewReader(input), DecoderOptionRawBytes(true)))
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Expected %+v, got %+v", expected, actual)
+	}
+}
+
+func TestDecodeDoesNotKeepRawBytesByDefault(t *testing.T) {
+	event, err := NewDecoder(strings.NewReader("data: x\n\n")).Decode()
+	if err != nil {
+		t.Fatalf("Unexpected error on decoding event: %s", err)
+	}
+	if raw := event.(EventWithRawBytes).RawBytes(); raw != nil {
+		t.Errorf("Expected no raw bytes, got %q", raw)
+	}
+}
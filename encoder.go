@@ -1,10 +1,14 @@
 package eventsource
 
 import (
+	"bytes"
 	"compress/gzip"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 var (
@@ -16,35 +20,278 @@ var (
 		{"event: ", Event.Event},
 		{"data: ", Event.Data},
 	}
+
+	lineBreaks = strings.NewReplacer("\r\n", "\n", "\r", "\n") //nolint:gochecknoglobals // treated as a constant
 )
 
 // An Encoder is capable of writing Events to a stream. Optionally
 // Events can be gzip compressed in this process.
 type Encoder struct {
-	w          io.Writer
-	compressed bool
+	w             io.Writer
+	compressed    bool
+	counter       *countingWriter
+	maxLineLength int
+	sanitize      FieldSanitizeMode
+	deferFlush    bool // set by Server.Handler while it is replaying events; see flushCompressed
+	unflushed     bool // true if something was written while deferFlush was set
+}
+
+// EncoderOption is a common interface for optional configuration parameters that can be
+// used in creating an Encoder.
+type EncoderOption interface {
+	apply(e *Encoder)
+}
+
+type maxLineLengthEncoderOption int
+
+func (o maxLineLengthEncoderOption) apply(e *Encoder) {
+	e.maxLineLength = int(o)
+}
+
+// EncoderOptionMaxLineLength returns an option that makes the Encoder split the data of an event into
+// several "data:" lines, if necessary, so that no line is longer than the specified number of bytes
+// (including the "data: " prefix, but not the line break). This is meant for interoperability with
+// clients that cannot handle long lines; the SSE specification itself has no limit. Lines are only split
+// between UTF-8 characters, so a line may still be longer than the limit if the limit is very small. By
+// default, or if the limit is zero or negative, lines are not split.
+//
+// A client joins multiple "data:" lines with line breaks, so the data that it receives will have a line
+// break at each point where a line was split: the content is not preserved exactly. Only use this option
+// if the clients can tolerate that, for instance because they remove line breaks from the data, or the
+// data is in a format where the split points can be recognized.
+func EncoderOptionMaxLineLength(maxLineLength int) EncoderOption {
+	return maxLineLengthEncoderOption(maxLineLength)
+}
+
+// FieldSanitizeMode is used with EncoderOptionSanitizeFields to determine what the Encoder does with
+// control characters in the ID or event name of an event.
+type FieldSanitizeMode int
+
+const (
+	// FieldSanitizeNone means that IDs and event names are written as they are. A line break in one of
+	// them is written as a second "id:" or "event:" line, but a carriage return is not escaped, so a client
+	// would treat whatever follows it as a separate field. This is the default.
+	FieldSanitizeNone FieldSanitizeMode = iota
+	// FieldSanitizeReplace means that each control character in an ID or event name is replaced with the
+	// Unicode replacement character, U+FFFD.
+	FieldSanitizeReplace
+	// FieldSanitizeReject means that Encode returns an error, without writing anything, for an event whose
+	// ID or event name contains a control character.
+	FieldSanitizeReject
+)
+
+type sanitizeFieldsEncoderOption FieldSanitizeMode
+
+func (o sanitizeFieldsEncoderOption) apply(e *Encoder) {
+	e.sanitize = FieldSanitizeMode(o)
+}
+
+// EncoderOptionSanitizeFields returns an option that protects against events whose ID or event name
+// contains a line break or other control character. If such values come from an untrusted source, they
+// could otherwise be used to inject fields into the stream, such as a forged "data:" line. See
+// FieldSanitizeMode for the choices.
+//
+// With either FieldSanitizeReplace or FieldSanitizeReject, the Encoder also converts any carriage returns
+// in an event's data into line breaks, so that each line of the data gets its own "data:" prefix; this is
+// how a client would interpret them anyway.
+func EncoderOptionSanitizeFields(mode FieldSanitizeMode) EncoderOption {
+	return sanitizeFieldsEncoderOption(mode)
+}
+
+// Replaces any control characters in a field value with U+FFFD.
+func replaceControlChars(value string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return utf8.RuneError
+		}
+		return r
+	}, value)
+}
+
+func containsControlChar(value string) bool {
+	return strings.IndexFunc(value, unicode.IsControl) >= 0
+}
+
+// A writer that keeps track of how many bytes have been written to the underlying writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
 }
 
 // NewEncoder returns an Encoder for a given io.Writer.
 // When compressed is set to true, a gzip writer will be
 // created.
 func NewEncoder(w io.Writer, compressed bool) *Encoder {
+	counter := &countingWriter{w: w}
 	if compressed {
-		return &Encoder{w: gzip.NewWriter(w), compressed: true}
+		return &Encoder{w: gzip.NewWriter(counter), compressed: true, counter: counter}
+	}
+	return &Encoder{w: counter, counter: counter}
+}
+
+// NewEncoderWithOptions returns an Encoder for a given io.Writer, with optional configuration
+// parameters. The compressed parameter is the same as for NewEncoder.
+func NewEncoderWithOptions(w io.Writer, compressed bool, options ...EncoderOption) *Encoder {
+	enc := NewEncoder(w, compressed)
+	for _, o := range options {
+		o.apply(enc)
 	}
-	return &Encoder{w: w}
+	return enc
+}
+
+// Splits a line of data into pieces that will each fit into a "data:" line of at most maxLength bytes.
+func splitDataLine(line string, maxLength int) []string {
+	maxLength -= len("data: ")
+	if maxLength < 1 {
+		maxLength = 1
+	}
+	var pieces []string
+	for len(line) > maxLength {
+		n := maxLength
+		for n > 0 && !utf8.RuneStart(line[n]) {
+			n--
+		}
+		if n == 0 { // the limit is too small for even one character
+			_, n = utf8.DecodeRuneInString(line)
+		}
+		pieces = append(pieces, line[:n])
+		line = line[n:]
+	}
+	if line == "" && len(pieces) > 0 {
+		return pieces
+	}
+	return append(pieces, line)
+}
+
+// EncodeCounting is the same as Encode, but also returns the number of bytes that were written to the
+// underlying io.Writer. If the Encoder is compressed, this is the compressed size.
+func (enc *Encoder) EncodeCounting(ec eventOrComment) (int, error) {
+	before := enc.counter.n
+	err := enc.Encode(ec)
+	return int(enc.counter.n - before), err
+}
+
+// BytesWritten returns the total number of bytes that the Encoder has written to the underlying
+// io.Writer. If the Encoder is compressed, this is the compressed size.
+func (enc *Encoder) BytesWritten() int64 {
+	return enc.counter.n
+}
+
+// Returns the lines for the fields of an EventWithExtraFields, or an empty string if there are none.
+func encodeExtraFields(ev Event) (string, error) {
+	e, ok := ev.(EventWithExtraFields)
+	if !ok {
+		return "", nil
+	}
+	fields := e.ExtraFields()
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b bytes.Buffer
+	for _, name := range names {
+		value := fields[name]
+		switch name {
+		case "", "id", "event", "data", "retry":
+			return "", fmt.Errorf("eventsource encode: invalid extra field name %q", name)
+		}
+		if strings.ContainsAny(name, ":\r\n") {
+			return "", fmt.Errorf("eventsource encode: invalid extra field name %q", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return "", fmt.Errorf("eventsource encode: value of extra field %q contains a line break", name)
+		}
+		b.WriteString(name + ": " + value + "\n")
+	}
+	return b.String(), nil
+}
+
+// EncodeExact writes an event, reproducing all of its fields in their original order if it implements
+// EventWithFields and its Fields method returns a non-nil list; this includes fields that are not part
+// of the SSE specification, which Encode would drop. Otherwise, it is the same as Encode.
+//
+// Each field is written as "name: value", so a decoder will see the same fields and values that were in
+// the original stream, although optional whitespace after the colon may differ. Field values are written
+// as they are; since a decoder never produces a value with a line break, no escaping is needed.
+func (enc *Encoder) EncodeExact(ev Event) error {
+	e, ok := ev.(EventWithFields)
+	if !ok || e.Fields() == nil {
+		return enc.Encode(ev)
+	}
+	var b bytes.Buffer
+	for _, field := range e.Fields() {
+		if field.Name == "" || strings.ContainsAny(field.Name, ":\r\n") || strings.ContainsAny(field.Value, "\r\n") {
+			return fmt.Errorf("eventsource encode: invalid field %q", field.Name)
+		}
+		b.WriteString(field.Name + ": " + field.Value + "\n")
+	}
+	b.WriteString("\n")
+	if _, err := io.WriteString(enc.w, b.String()); err != nil {
+		return fmt.Errorf("eventsource encode: %v", err)
+	}
+	if enc.deferFlush {
+		enc.unflushed = true
+		return nil
+	}
+	return enc.flushCompressed()
 }
 
 // Encode writes an event or comment in the format specified by the
 // server-sent events protocol.
+//
+// If the event implements EventWithRetry and has a retry value, it is written as a "retry:" field,
+// which tells clients how long to wait before reconnecting.
 func (enc *Encoder) Encode(ec eventOrComment) error {
 	switch item := ec.(type) {
 	case Event:
+		if enc.sanitize == FieldSanitizeReject {
+			if containsControlChar(item.Id()) {
+				return fmt.Errorf("eventsource encode: event ID %q contains a control character", item.Id())
+			}
+			if containsControlChar(item.Event()) {
+				return fmt.Errorf("eventsource encode: event name %q contains a control character", item.Event())
+			}
+		}
+		extraFields, err := encodeExtraFields(item)
+		if err != nil {
+			return err
+		}
+		if e, ok := item.(EventWithRetry); ok {
+			if millis, ok := e.RetryMillis(); ok {
+				extraFields = fmt.Sprintf("retry: %d\n", millis) + extraFields
+			}
+		}
 		for _, field := range encFields {
 			prefix, value := field.prefix, field.value(item)
+			if prefix == "data: " && extraFields != "" {
+				if _, err := io.WriteString(enc.w, extraFields); err != nil {
+					return fmt.Errorf("eventsource encode: %v", err)
+				}
+			}
 			if len(value) == 0 {
 				continue
 			}
+			if enc.sanitize != FieldSanitizeNone {
+				if prefix == "data: " {
+					value = lineBreaks.Replace(value)
+				} else {
+					value = replaceControlChars(value)
+				}
+			}
+			if prefix == "data: " && enc.maxLineLength > 0 {
+				var lines []string
+				for _, line := range strings.Split(value, "\n") {
+					lines = append(lines, splitDataLine(line, enc.maxLineLength)...)
+				}
+				value = strings.Join(lines, "\n")
+			}
 			value = strings.Replace(value, "\n", "\n"+prefix, -1)
 			if _, err := io.WriteString(enc.w, prefix+value+"\n"); err != nil {
 				return fmt.Errorf("eventsource encode: %v", err)
@@ -54,13 +301,55 @@ func (enc *Encoder) Encode(ec eventOrComment) error {
 			return fmt.Errorf("eventsource encode: %v", err)
 		}
 	case comment:
-		line := ":" + item.value + "\n"
+		// Every line of a multi-line comment needs its own colon prefix; otherwise the lines after
+		// the first would be parsed as fields, and could become part of the next event.
+		value := lineBreaks.Replace(item.value)
+		line := ":" + strings.Replace(value, "\n", "\n:", -1) + "\n"
 		if _, err := io.WriteString(enc.w, line); err != nil {
 			return fmt.Errorf("eventsource encode: %v", err)
 		}
 	default:
 		return fmt.Errorf("unexpected parameter to Encode: %v", ec)
 	}
+	if enc.deferFlush {
+		enc.unflushed = true
+		return nil
+	}
+	return enc.flushCompressed()
+}
+
+// WriteComment writes a comment, which clients ignore; this is the same as what a Server writes for
+// PublishComment. A colon is added at the start of each line of the text, so a multi-line comment cannot
+// be mistaken for fields of an event.
+func (enc *Encoder) WriteComment(text string) error {
+	return enc.Encode(comment{value: text})
+}
+
+// WriteRaw writes bytes to the stream exactly as they are, for instance an event that has already been
+// encoded, or padding in a format that a particular client expects. The Encoder does not check them at
+// all, so they must be valid for the protocol: in particular, an event must end with an empty line, or
+// it will be combined with whatever is written next. If the Encoder is compressed, the bytes are
+// compressed like everything else.
+func (enc *Encoder) WriteRaw(data []byte) error {
+	if _, err := enc.w.Write(data); err != nil {
+		return fmt.Errorf("eventsource encode: %v", err)
+	}
+	if enc.deferFlush {
+		enc.unflushed = true
+		return nil
+	}
+	return enc.flushCompressed()
+}
+
+// Writes out any compressed data that the gzip writer is holding. The Encoder normally does this after
+// every event or comment, so that the client can decode each one as soon as it arrives; but if deferFlush
+// is set, it is up to the caller, so that a series of events can be compressed together. Flushing when
+// nothing has been written since the last flush would still add an empty block, so that is skipped.
+func (enc *Encoder) flushCompressed() error {
+	if enc.deferFlush && !enc.unflushed {
+		return nil
+	}
+	enc.unflushed = false
 	if enc.compressed {
 		return enc.w.(*gzip.Writer).Flush()
 	}
@@ -0,0 +1,109 @@
+package eventsource
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// StreamErrorCategory describes the general kind of a stream error, as determined by ClassifyStreamError.
+type StreamErrorCategory int
+
+const (
+	// StreamErrorOther is an error that does not fit any of the other categories.
+	StreamErrorOther StreamErrorCategory = iota
+	// StreamErrorHTTPStatus is an HTTP error response status, represented by SubscriptionError.
+	StreamErrorHTTPStatus
+	// StreamErrorDNS is a failure to resolve the server's host name.
+	StreamErrorDNS
+	// StreamErrorTLS is a failure in the TLS handshake, such as an invalid certificate.
+	StreamErrorTLS
+	// StreamErrorConnectionRefused means that the server host did not accept a connection.
+	StreamErrorConnectionRefused
+	// StreamErrorTimeout is a network timeout, ErrReadTimeout, or ErrInitialDataTimeout.
+	StreamErrorTimeout
+	// StreamErrorConnectionClosed means that an existing connection was closed or reset.
+	StreamErrorConnectionClosed
+)
+
+// String returns a description of the category.
+func (c StreamErrorCategory) String() string {
+	switch c {
+	case StreamErrorHTTPStatus:
+		return "HTTP status"
+	case StreamErrorDNS:
+		return "DNS"
+	case StreamErrorTLS:
+		return "TLS"
+	case StreamErrorConnectionRefused:
+		return "connection refused"
+	case StreamErrorTimeout:
+		return "timeout"
+	case StreamErrorConnectionClosed:
+		return "connection closed"
+	default:
+		return "other"
+	}
+}
+
+// ClassifyStreamError determines the general category of an error reported by a Stream, such as an error
+// passed to a StreamErrorHandler or received from the Errors channel. This can be used to apply different
+// logic to different kinds of failures: for instance, a DNS failure is less likely to resolve itself
+// quickly than a refused connection.
+//
+// The classification is based on the error types returned by Go's networking packages, so errors from a
+// custom http.RoundTripper that does not use those types may be reported as StreamErrorOther.
+func ClassifyStreamError(err error) StreamErrorCategory {
+	for err != nil {
+		switch e := err.(type) {
+		case SubscriptionError:
+			return StreamErrorHTTPStatus
+		case *net.DNSError:
+			return StreamErrorDNS
+		case tls.RecordHeaderError, x509.UnknownAuthorityError, x509.CertificateInvalidError, x509.HostnameError:
+			return StreamErrorTLS
+		case syscall.Errno:
+			switch e {
+			case syscall.ECONNREFUSED:
+				return StreamErrorConnectionRefused
+			case syscall.ECONNRESET, syscall.EPIPE:
+				return StreamErrorConnectionClosed
+			}
+		case *url.Error:
+			err = e.Err
+			continue
+		case *net.OpError:
+			if e.Timeout() {
+				return StreamErrorTimeout
+			}
+			err = e.Err
+			continue
+		case *os.SyscallError:
+			err = e.Err
+			continue
+		}
+		if err == ErrReadTimeout || err == ErrInitialDataTimeout {
+			return StreamErrorTimeout
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return StreamErrorConnectionClosed
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return StreamErrorTimeout
+		}
+		if strings.HasPrefix(err.Error(), "tls: ") {
+			return StreamErrorTLS // errors such as TLS alerts are not exported as specific types
+		}
+		if u, ok := err.(interface{ Unwrap() error }); ok {
+			err = u.Unwrap()
+			continue
+		}
+		break
+	}
+	return StreamErrorOther
+}
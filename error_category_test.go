@@ -0,0 +1,50 @@
+package eventsource
+
+import (
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyStreamError(t *testing.T) {
+	wrap := func(err error) error {
+		return &url.Error{Op: "Get", URL: "http://example", Err: &net.OpError{Op: "dial", Net: "tcp", Err: err}}
+	}
+	tests := []struct {
+		err      error
+		category StreamErrorCategory
+	}{
+		{SubscriptionError{Code: 401}, StreamErrorHTTPStatus},
+		{wrap(&net.DNSError{Err: "no such host", Name: "example"}), StreamErrorDNS},
+		{&url.Error{Op: "Get", URL: "https://example", Err: x509.UnknownAuthorityError{}}, StreamErrorTLS},
+		{wrap(errors.New("tls: handshake failure")), StreamErrorTLS},
+		{wrap(&os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}), StreamErrorConnectionRefused},
+		{wrap(&os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET}), StreamErrorConnectionClosed},
+		{ErrReadTimeout, StreamErrorTimeout},
+		{io.EOF, StreamErrorConnectionClosed},
+		{io.ErrUnexpectedEOF, StreamErrorConnectionClosed},
+		{errors.New("something else"), StreamErrorOther},
+		{nil, StreamErrorOther},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.category, ClassifyStreamError(test.err), "for error: %v", test.err)
+	}
+}
+
+func TestClassifyStreamErrorForRefusedConnection(t *testing.T) {
+	httpServer := httptest.NewServer(http.NotFoundHandler())
+	url := httpServer.URL
+	httpServer.Close()
+
+	_, err := SubscribeWithURL(url)
+	assert.Equal(t, StreamErrorConnectionRefused, ClassifyStreamError(err))
+}
@@ -0,0 +1,46 @@
+package eventsource
+
+import "strings"
+
+// EventData is a concrete representation of an event, for applications that need to store events or
+// pass them to another system. It can be marshaled with encoding/json or similar packages.
+type EventData struct {
+	// ID is the value of Event.Id.
+	ID string `json:"id,omitempty"`
+	// Event is the value of Event.Event.
+	Event string `json:"event,omitempty"`
+	// Data is the value of Event.Data.
+	Data string `json:"data,omitempty"`
+	// Retry is the reconnection delay in milliseconds from a "retry:" field, or zero if there was none;
+	// see EventWithRetry.
+	Retry int64 `json:"retry,omitempty"`
+}
+
+// ToEventData converts any Event to an EventData. Properties that are not part of EventData, such as the
+// priority of an EventWithPriority, are not included.
+func ToEventData(ev Event) EventData {
+	data := EventData{
+		ID:    ev.Id(),
+		Event: ev.Event(),
+		Data:  ev.Data(),
+	}
+	if e, ok := ev.(EventWithRetry); ok {
+		data.Retry, _ = e.RetryMillis()
+	}
+	return data
+}
+
+// NewEventFromData creates an Event from an EventData. The Event is of the same type as the events that
+// are read by a Decoder, so it also implements EventWithRetry.
+func NewEventFromData(data EventData) Event {
+	pub := &publication{
+		id:    data.ID,
+		event: data.Event,
+		data:  data.Data,
+		retry: data.Retry,
+	}
+	if data.Data != "" {
+		pub.dataLineCount = strings.Count(data.Data, "\n") + 1
+	}
+	return pub
+}
@@ -0,0 +1,31 @@
+package eventsource
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventDataRoundTrip(t *testing.T) {
+	ev := &publication{id: "1", event: "put", data: "a\nb", retry: 3000, dataLineCount: 2}
+	data := ToEventData(ev)
+	assert.Equal(t, EventData{ID: "1", Event: "put", Data: "a\nb", Retry: 3000}, data)
+	assert.Equal(t, ev, NewEventFromData(data))
+}
+
+func TestEventDataFromEventWithoutRetry(t *testing.T) {
+	data := ToEventData(&testEvent{id: "1", data: "x"})
+	assert.Equal(t, EventData{ID: "1", Data: "x"}, data)
+}
+
+func TestEventDataJSONEncoding(t *testing.T) {
+	bytes, err := json.Marshal(EventData{ID: "1", Data: "x"})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"id":"1","data":"x"}`, string(bytes))
+
+	var data EventData
+	require.NoError(t, json.Unmarshal([]byte(`{"event":"put","data":"y","retry":500}`), &data))
+	assert.Equal(t, EventData{Event: "put", Data: "y", Retry: 500}, data)
+}
@@ -0,0 +1,141 @@
+// Package eventsourcetest provides helpers for testing code that consumes events from an
+// eventsource.Stream, without needing to run an HTTP server.
+package eventsourcetest
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/launchdarkly/eventsource"
+)
+
+const testStreamURL = "http://eventsourcetest.invalid/stream"
+
+// TestStream is a fully functional eventsource.Stream whose input is controlled by the test code.
+//
+// Instead of making HTTP requests, the Stream receives data from an in-memory connection. Events that
+// are passed to Send are delivered on the Stream's Events channel as if a server had sent them. Fail
+// and EndConnection simulate the connection being broken, in which case the Stream reports an error and
+// reconnects in the same way it would for a real server; subsequent calls to Send then write to the
+// new connection.
+type TestStream struct {
+	// Stream is the stream that is being controlled. Its methods and fields, such as Events, Errors,
+	// and Close, can also be accessed directly on the TestStream.
+	*eventsource.Stream
+	lock      sync.Mutex
+	current   *io.PipeWriter
+	connected chan struct{}
+}
+
+type testStreamTransport struct {
+	owner *TestStream
+}
+
+// NewTestStream creates a TestStream that is already connected.
+//
+// Any options are applied to the Stream in the same way as for eventsource.SubscribeWithURL, except for
+// StreamOptionHTTPClient, which would prevent the TestStream from working. By default, the Stream uses a
+// retry delay of one millisecond so that tests of reconnection behavior are not slowed down; this can be
+// changed with StreamOptionInitialRetry. NewTestStream panics if any of the options are invalid.
+func NewTestStream(options ...eventsource.StreamOption) *TestStream {
+	ts := &TestStream{connected: make(chan struct{}, 1)}
+	client := &http.Client{Transport: testStreamTransport{owner: ts}}
+	allOptions := append([]eventsource.StreamOption{
+		eventsource.StreamOptionInitialRetry(time.Millisecond),
+	}, options...)
+	allOptions = append(allOptions, eventsource.StreamOptionHTTPClient(client))
+	stream, err := eventsource.SubscribeWithURL(testStreamURL, allOptions...)
+	if err != nil {
+		panic("eventsourcetest: could not create stream: " + err.Error())
+	}
+	ts.Stream = stream
+	return ts
+}
+
+// Send sends an event on the current connection. If the connection has been broken with Fail or
+// EndConnection, it waits until the Stream has reconnected.
+//
+// Like a real connection, this blocks if the Stream is not reading data, which will be the case if
+// nothing is consuming the Events channel. It returns an error only if the Stream has been closed.
+func (ts *TestStream) Send(event eventsource.Event) error {
+	for {
+		w, err := ts.connection()
+		if err != nil {
+			return err
+		}
+		err = eventsource.NewEncoder(w, false).Encode(event)
+		if err != io.ErrClosedPipe {
+			return err
+		}
+		// The Stream closed this connection, for instance because Restart was called; try the next one
+		ts.dropConnection(w, nil)
+	}
+}
+
+// Fail breaks the current connection, causing the Stream to receive the specified error when it tries
+// to read from it. The Stream will report the error and then reconnect.
+func (ts *TestStream) Fail(err error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	if ts.current != nil {
+		_ = ts.current.CloseWithError(err)
+		ts.current = nil
+	}
+}
+
+// EndConnection closes the current connection normally, as if the server had ended the response. The
+// Stream will report io.EOF and then reconnect.
+func (ts *TestStream) EndConnection() {
+	ts.Fail(nil)
+}
+
+func (ts *TestStream) connection() (*io.PipeWriter, error) {
+	for {
+		ts.lock.Lock()
+		w := ts.current
+		ts.lock.Unlock()
+		if w != nil {
+			return w, nil
+		}
+		select {
+		case <-ts.connected:
+		case <-ts.Done():
+			return nil, io.ErrClosedPipe
+		}
+	}
+}
+
+func (ts *TestStream) dropConnection(w *io.PipeWriter, err error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	if ts.current == w {
+		_ = w.CloseWithError(err)
+		ts.current = nil
+	}
+}
+
+func (t testStreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r, w := io.Pipe()
+	t.owner.lock.Lock()
+	if t.owner.current != nil {
+		_ = t.owner.current.Close()
+	}
+	t.owner.current = w
+	t.owner.lock.Unlock()
+	select {
+	case t.owner.connected <- struct{}{}:
+	default:
+	}
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+		Body:       r,
+		Request:    req,
+	}, nil
+}
@@ -0,0 +1,85 @@
+package eventsourcetest
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/launchdarkly/eventsource"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testEvent struct {
+	id, event, data string
+}
+
+func (e testEvent) Id() string    { return e.id }
+func (e testEvent) Event() string { return e.event }
+func (e testEvent) Data() string  { return e.data }
+
+func requireEvent(t *testing.T, stream *TestStream) eventsource.Event {
+	select {
+	case ev := <-stream.Events:
+		return ev
+	case <-time.After(time.Second):
+		require.Fail(t, "timed out waiting for event")
+		return nil
+	}
+}
+
+func requireError(t *testing.T, stream *TestStream) error {
+	select {
+	case err := <-stream.Errors:
+		return err
+	case <-time.After(time.Second):
+		require.Fail(t, "timed out waiting for error")
+		return nil
+	}
+}
+
+func TestSendDeliversEvent(t *testing.T) {
+	stream := NewTestStream()
+	defer stream.Close()
+
+	go func() { _ = stream.Send(testEvent{id: "1", event: "put", data: "hello"}) }()
+
+	ev := requireEvent(t, stream)
+	assert.Equal(t, "1", ev.Id())
+	assert.Equal(t, "put", ev.Event())
+	assert.Equal(t, "hello", ev.Data())
+}
+
+func TestFailReportsErrorAndReconnects(t *testing.T) {
+	myError := errors.New("sorry")
+	stream := NewTestStream()
+	defer stream.Close()
+
+	stream.Fail(myError)
+	assert.Equal(t, myError, requireError(t, stream))
+
+	go func() { _ = stream.Send(testEvent{id: "2", data: "after"}) }()
+	ev := requireEvent(t, stream)
+	assert.Equal(t, "after", ev.Data())
+}
+
+func TestEndConnectionReportsEOFAndReconnects(t *testing.T) {
+	stream := NewTestStream()
+	defer stream.Close()
+
+	stream.EndConnection()
+	assert.Equal(t, io.EOF, requireError(t, stream))
+
+	go func() { _ = stream.Send(testEvent{data: "after"}) }()
+	ev := requireEvent(t, stream)
+	assert.Equal(t, "after", ev.Data())
+}
+
+func TestSendReturnsErrorAfterStreamIsClosed(t *testing.T) {
+	stream := NewTestStream()
+	stream.Close()
+	<-stream.Done()
+
+	assert.Error(t, stream.Send(testEvent{data: "x"}))
+}
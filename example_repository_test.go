@@ -57,7 +57,8 @@ func ExampleRepository() {
 		fmt.Println(err)
 		return
 	}
-	// This will replay the events in order of id
+	// This will replay the events in order of id, starting with the Last-Event-ID; a repository created
+	// with NewOrderedSliceRepository would replay them in the order they were added instead
 	for i := 0; i < 3; i++ {
 		ev := <-stream.Events
 		fmt.Println(ev.Id(), ev.Event(), ev.Data())
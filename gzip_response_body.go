@@ -0,0 +1,29 @@
+package eventsource
+
+import (
+	"compress/gzip"
+	"io"
+)
+
+// A response body that was sent with "Content-Encoding: gzip" and that the HTTP client did not decompress,
+// because the application set its own Accept-Encoding header or used a client with DisableCompression.
+//
+// The gzip reader is created on the first Read, rather than when the response is received, since creating
+// it reads the gzip header and the server might not send anything for a while. Close closes only the
+// underlying body: the gzip reader has nothing else to release, and closing the body is what unblocks a
+// Read that is waiting for data on another goroutine.
+type gzipResponseBody struct {
+	io.ReadCloser
+	gz *gzip.Reader
+}
+
+func (b *gzipResponseBody) Read(p []byte) (int, error) {
+	if b.gz == nil {
+		gz, err := gzip.NewReader(b.ReadCloser)
+		if err != nil {
+			return 0, err
+		}
+		b.gz = gz
+	}
+	return b.gz.Read(p)
+}
@@ -0,0 +1,50 @@
+package eventsource
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	initialDataWaiting int32 = iota
+	initialDataReceived
+	initialDataTimedOut
+)
+
+// A response body that is closed if no data has been read from it within a timeout, after which any read
+// returns ErrInitialDataTimeout. This is used to implement StreamOptionInitialDataTimeout.
+type initialDataTimeoutBody struct {
+	io.ReadCloser
+	state int32 // accessed atomically
+	timer *time.Timer
+}
+
+func newInitialDataTimeoutBody(body io.ReadCloser, timeout time.Duration) *initialDataTimeoutBody {
+	b := &initialDataTimeoutBody{ReadCloser: body}
+	b.timer = time.AfterFunc(timeout, func() {
+		if atomic.CompareAndSwapInt32(&b.state, initialDataWaiting, initialDataTimedOut) {
+			_ = b.ReadCloser.Close() // unblocks the read that is waiting for data
+		}
+	})
+	return b
+}
+
+func (b *initialDataTimeoutBody) Read(p []byte) (int, error) {
+	if atomic.LoadInt32(&b.state) == initialDataTimedOut {
+		return 0, ErrInitialDataTimeout
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && atomic.CompareAndSwapInt32(&b.state, initialDataWaiting, initialDataReceived) {
+		b.timer.Stop()
+	}
+	if err != nil && atomic.LoadInt32(&b.state) == initialDataTimedOut {
+		return n, ErrInitialDataTimeout
+	}
+	return n, err
+}
+
+func (b *initialDataTimeoutBody) Close() error {
+	b.timer.Stop()
+	return b.ReadCloser.Close()
+}
@@ -5,6 +5,8 @@
 // If the Repository interface is implemented on the server, events can be replayed in case of a network disconnection.
 package eventsource
 
+import "time"
+
 // Event is the interface for any event received by the client or sent by the server.
 type Event interface {
 	// Id is an identifier that can be used to allow a client to replay
@@ -17,6 +19,86 @@ type Event interface {
 	Data() string
 }
 
+// EventWithPriority is an optional interface that an Event published by a Server can implement to be
+// delivered ahead of other events. If a subscriber has fallen behind, so that several events are waiting
+// to be sent to it, the one with the highest priority is sent first; events that do not implement this
+// interface have a priority of zero. Events with equal priority are sent in the order they were published.
+// An event is never sent ahead of an event that has an ID, or ahead of replayed events.
+type EventWithPriority interface {
+	Event
+	// Priority returns the priority of the event. Higher values are sent first.
+	Priority() int
+}
+
+// EventWithExtraFields is an optional interface that an Event can implement to have the Encoder write
+// additional fields, for protocol extensions such as a "meta:" field. Each field is written as a
+// "name: value" line, after the "id:" and "event:" lines and before the "data:" lines; fields are written
+// in alphabetical order of their names.
+//
+// Clients that follow the SSE specification ignore fields that they do not recognize. A field name must
+// not be empty, must not contain a colon or a line break, and must not be one of the standard field names
+// ("id", "event", "data", or "retry"); a value must not contain a line break. Otherwise, the Encoder
+// returns an error instead of writing the event.
+type EventWithExtraFields interface {
+	Event
+	// ExtraFields returns the names and values of the additional fields.
+	ExtraFields() map[string]string
+}
+
+// Field is a single "name: value" line of an event.
+type Field struct {
+	Name  string
+	Value string
+}
+
+// EventWithFields is an optional interface for an Event that knows the exact list of fields that it
+// consists of, in order. Events read by a Decoder implement this interface, but they only have a list
+// of fields if DecoderOptionPreserveFields (or StreamOptionPreserveFields) was used. See
+// Encoder.EncodeExact.
+type EventWithFields interface {
+	Event
+	// Fields returns the fields of the event, or nil if they are not known.
+	Fields() []Field
+}
+
+// EventWithRawBytes is an optional interface for an Event that knows the exact bytes it was decoded from.
+// Events read by a Decoder implement this interface, but they only have the bytes if DecoderOptionRawBytes
+// (or StreamOptionWithRawBytes) was used.
+type EventWithRawBytes interface {
+	Event
+	// RawBytes returns the bytes that the event was decoded from, or nil if they are not known.
+	RawBytes() []byte
+}
+
+// EventWithAck is an interface for an Event that the application must acknowledge after processing it.
+// Events delivered by a Stream implement this interface if StreamOptionManualAck was used.
+type EventWithAck interface {
+	Event
+	// Ack acknowledges the event. It is safe to call from any goroutine, and calling it more than once
+	// has no additional effect.
+	Ack()
+}
+
+// EventWithRetry is an optional interface for an Event that may include a "retry:" field, which is how an
+// SSE server asks clients to change their reconnection delay. Events read by a Decoder, including events
+// received from a Stream, implement this interface. The Encoder writes a "retry:" field for any event that
+// implements it, so a server can also use it to send the field.
+type EventWithRetry interface {
+	Event
+	// RetryMillis returns the value of the event's "retry:" field in milliseconds, and true; or zero and
+	// false if the event had no such field, or its value was not a positive integer. The Stream ignores
+	// the field in the latter case too.
+	RetryMillis() (int64, bool)
+}
+
+// Comment is the interface for a comment line that was read by a Decoder, if DecoderOptionReturnComments
+// was used. It is returned by Decoder.Decode in place of an Event.
+type Comment interface {
+	Event
+	// CommentText returns the text of the comment, without the leading colon and space.
+	CommentText() string
+}
+
 // Repository is an interface to be used with Server.Register() allowing clients to replay previous events
 // through the server, if history is required.
 type Repository interface {
@@ -31,12 +113,80 @@ type Repository interface {
 	Replay(channel, id string) chan Event
 }
 
+// Compactable is an optional interface for a Repository that can discard or reorganize its stored events
+// on a schedule, rather than only when events are added. If server.RepositoryCompactInterval is set, the
+// Server calls Compact at that interval for each registered Repository that implements this interface.
+//
+// Compact is called from a goroutine of its own, so it may run at the same time as Replay or as the
+// application adding events; it must be safe for concurrent access. The Server does not call Compact
+// again until the previous call has returned.
+type Compactable interface {
+	Compact()
+}
+
 // Logger is the interface for a custom logging implementation that can handle log output for a Stream.
 type Logger interface {
 	Println(...interface{})
 	Printf(string, ...interface{})
 }
 
+// LoggerWithWarnings is an optional interface for a Logger that distinguishes warnings, such as failed
+// connection attempts, from informational messages. If the Logger does not implement it, warnings are
+// logged with Printf like everything else.
+type LoggerWithWarnings interface {
+	Logger
+	// Warnf logs a warning message.
+	Warnf(string, ...interface{})
+}
+
+func logWarning(logger Logger, format string, args ...interface{}) {
+	if w, ok := logger.(LoggerWithWarnings); ok {
+		w.Warnf(format, args...)
+	} else {
+		logger.Printf(format, args...)
+	}
+}
+
+// RetryDelayStrategy is an interface for a custom implementation of a Stream's reconnection delays, which
+// can be specified with StreamOptionRetryStrategy. The Stream calls NextRetryDelay each time it is about
+// to wait before reconnecting, with the current time.
+//
+// A RetryDelayStrategy can also implement any of the optional interfaces RetryDelayStrategyWithBaseDelay,
+// RetryDelayStrategyWithMinDelay, and RetryDelayStrategyWithGoodSince, to be notified of events that the
+// default strategy takes into account. The Stream calls all of these methods from a single goroutine at
+// a time, so they do not need to be safe for concurrent use unless the strategy is shared between streams.
+type RetryDelayStrategy interface {
+	// NextRetryDelay returns the delay before the next reconnection attempt.
+	NextRetryDelay(currentTime time.Time) time.Duration
+}
+
+// RetryDelayStrategyWithBaseDelay is an optional interface for a RetryDelayStrategy that supports changing
+// its base delay when the server sends a "retry:" directive (with the default RetryDirectiveResetBackoff
+// mode). If the strategy does not implement it, "retry:" directives have no effect on the delay.
+type RetryDelayStrategyWithBaseDelay interface {
+	RetryDelayStrategy
+	// SetBaseDelay is called with the delay requested by the server.
+	SetBaseDelay(baseDelay time.Duration)
+}
+
+// RetryDelayStrategyWithMinDelay is an optional interface for a RetryDelayStrategy that supports a lower
+// bound for the delay, set by a "retry:" directive from the server when the mode is RetryDirectiveSetFloor.
+// If the strategy does not implement it, "retry:" directives have no effect on the delay.
+type RetryDelayStrategyWithMinDelay interface {
+	RetryDelayStrategy
+	// SetMinDelay is called with the delay requested by the server.
+	SetMinDelay(minDelay time.Duration)
+}
+
+// RetryDelayStrategyWithGoodSince is an optional interface for a RetryDelayStrategy that needs to know when
+// the stream has successfully received data, for instance to reset a backoff after a connection has been
+// working for a while (as StreamOptionRetryResetInterval does for the default strategy).
+type RetryDelayStrategyWithGoodSince interface {
+	RetryDelayStrategy
+	// SetGoodSince is called with the current time whenever the stream receives an event.
+	SetGoodSince(goodSince time.Time)
+}
+
 // StreamErrorHandlerResult contains values returned by StreamErrorHandler.
 type StreamErrorHandlerResult struct {
 	// CloseNow can be set to true to tell the Stream to immediately stop and not retry, as if Close had
@@ -0,0 +1,123 @@
+package eventsource
+
+import (
+	"fmt"
+	"sync"
+)
+
+// MergedStream combines the events and errors from several Streams into a single pair of channels, for an
+// application that needs to consume several SSE endpoints as one feed.
+type MergedStream struct {
+	// Events emits the events received by all of the streams.
+	Events chan MergedEvent
+	// Errors emits the errors from all of the streams that do not have an error handler (see
+	// StreamOptionErrorHandler).
+	Errors    chan MergedError
+	streams   []*Stream
+	closer    chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// MergedEvent is an event received by a MergedStream, along with the Stream it came from.
+type MergedEvent struct {
+	// Event is the event that was received.
+	Event Event
+	// Source is the index of the Stream that the event came from, in the order they were passed to
+	// NewMergedStream.
+	Source int
+}
+
+// MergedError is an error received by a MergedStream, along with the Stream it came from.
+type MergedError struct {
+	Err error
+	// Source is the index of the Stream that the error came from, in the order they were passed to
+	// NewMergedStream.
+	Source int
+}
+
+// Error returns the message of the underlying error, with the index of the stream.
+func (e MergedError) Error() string {
+	return fmt.Sprintf("stream %d: %s", e.Source, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e MergedError) Unwrap() error {
+	return e.Err
+}
+
+// NewMergedStream creates a MergedStream that reads from the specified streams, which the MergedStream
+// takes ownership of: the application should no longer read from their Events and Errors channels.
+//
+// Events and errors from the same stream are delivered in the order they were received, but there is no
+// ordering between different streams. The Events and Errors channels are closed after all of the streams
+// have been closed, either by MergedStream.Close or on their own (for instance, if an error handler told
+// one of them to stop).
+func NewMergedStream(streams ...*Stream) *MergedStream {
+	m := &MergedStream{
+		Events:  make(chan MergedEvent),
+		Errors:  make(chan MergedError),
+		streams: streams,
+		closer:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	var wg sync.WaitGroup
+	wg.Add(len(streams))
+	for i, stream := range streams {
+		go func(source int, stream *Stream) {
+			defer wg.Done()
+			m.forward(source, stream)
+		}(i, stream)
+	}
+	go func() {
+		wg.Wait()
+		close(m.Events)
+		close(m.Errors)
+		close(m.done)
+	}()
+	return m
+}
+
+// Reads from one stream's channels until the stream has ended. After the MergedStream is closed, anything
+// that is still received is discarded, so that the stream is not blocked from shutting down.
+func (m *MergedStream) forward(source int, stream *Stream) {
+	events, errs := stream.Events, stream.Errors
+	for events != nil || errs != nil {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			select {
+			case m.Events <- MergedEvent{Event: ev, Source: source}:
+			case <-m.closer:
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			select {
+			case m.Errors <- MergedError{Err: err, Source: source}:
+			case <-m.closer:
+			}
+		}
+	}
+}
+
+// Close closes all of the streams. It is safe for concurrent access and can be called multiple times.
+func (m *MergedStream) Close() {
+	m.closeOnce.Do(func() {
+		close(m.closer)
+		for _, stream := range m.streams {
+			stream.Close()
+		}
+	})
+}
+
+// Done returns a channel that is closed when all of the streams have shut down, after the Events and
+// Errors channels have been closed.
+func (m *MergedStream) Done() <-chan struct{} {
+	return m.done
+}
@@ -0,0 +1,67 @@
+package eventsource
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/launchdarkly/go-test-helpers/v2/httphelpers"
+)
+
+func TestMergedStreamTagsEventsAndErrorsWithSource(t *testing.T) {
+	streamHandler1, streamControl1 := httphelpers.SSEHandler(nil)
+	defer streamControl1.Close()
+	httpServer1 := httptest.NewServer(streamHandler1)
+	defer httpServer1.Close()
+	streamHandler2, streamControl2 := httphelpers.SSEHandler(nil)
+	defer streamControl2.Close()
+	httpServer2 := httptest.NewServer(streamHandler2)
+	defer httpServer2.Close()
+
+	merged := NewMergedStream(
+		mustSubscribe(t, httpServer1.URL, StreamOptionInitialRetry(time.Hour)),
+		mustSubscribe(t, httpServer2.URL))
+	defer merged.Close()
+
+	streamControl2.Send(httphelpers.SSEEvent{Data: "b"})
+	ev := <-merged.Events
+	assert.Equal(t, "b", ev.Event.Data())
+	assert.Equal(t, 1, ev.Source)
+
+	streamControl1.Send(httphelpers.SSEEvent{Data: "a"})
+	ev = <-merged.Events
+	assert.Equal(t, "a", ev.Event.Data())
+	assert.Equal(t, 0, ev.Source)
+
+	streamControl1.EndAll()
+	err := <-merged.Errors
+	assert.Equal(t, MergedError{Err: io.EOF, Source: 0}, err)
+	assert.Equal(t, io.EOF, err.Unwrap())
+}
+
+func TestMergedStreamCloseClosesAllStreams(t *testing.T) {
+	streamHandler, streamControl := httphelpers.SSEHandler(nil)
+	defer streamControl.Close()
+	httpServer := httptest.NewServer(streamHandler)
+	defer httpServer.Close()
+
+	stream1, stream2 := mustSubscribe(t, httpServer.URL), mustSubscribe(t, httpServer.URL)
+	merged := NewMergedStream(stream1, stream2)
+
+	// an event that nobody reads must not prevent the streams from shutting down
+	streamControl.Send(httphelpers.SSEEvent{Data: "a"})
+	merged.Close()
+
+	select {
+	case <-merged.Done():
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for merged stream to close")
+	}
+	<-stream1.Done()
+	<-stream2.Done()
+	_, ok := <-merged.Events
+	assert.False(t, ok)
+}
@@ -9,6 +9,9 @@ import (
 type normaliser struct {
 	r        io.Reader
 	lastChar byte
+	written  int64   // number of bytes that Read has returned
+	dropped  []int64 // positions in the output of converted CRs whose LFs were dropped; see originalOffset
+	counted  int64   // number of dropped LFs before the position last passed to originalOffset
 }
 
 func newNormaliser(r io.Reader) *normaliser {
@@ -20,8 +23,11 @@ func (norm *normaliser) Read(p []byte) (n int, err error) {
 	for i := 0; i < n; i++ {
 		switch {
 		case p[i] == '\n' && norm.lastChar == '\r':
-			copy(p[i:n], p[i+1:])
-			norm.lastChar = p[i]
+			// the CR has already been converted, so drop the LF; lastChar must not be taken from the
+			// shifted buffer, since anything past the end of the data is stale
+			norm.dropped = append(norm.dropped, norm.written+int64(i)-1)
+			copy(p[i:n-1], p[i+1:n])
+			norm.lastChar = '\n'
 			n--
 			i--
 		case p[i] == '\r':
@@ -31,5 +37,17 @@ func (norm *normaliser) Read(p []byte) (n int, err error) {
 			norm.lastChar = p[i]
 		}
 	}
+	norm.written += int64(n)
 	return
 }
+
+// Converts a position in the normalised output to the corresponding position in the original data, by
+// adding the number of LFs that were dropped before it. Each call must pass a position that is not less
+// than the one before, and any LF that comes before the position must already have been read.
+func (norm *normaliser) originalOffset(pos int64) int64 {
+	for len(norm.dropped) > 0 && norm.dropped[0] < pos {
+		norm.dropped = norm.dropped[1:]
+		norm.counted++
+	}
+	return pos + norm.counted
+}
@@ -3,6 +3,7 @@ package eventsource
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"strings"
 	"testing"
 )
@@ -40,3 +41,41 @@ func TestNormaliser(t *testing.T) {
 		}
 	}
 }
+
+func TestNormaliserIgnoresStaleBufferContents(t *testing.T) {
+	// If a CRLF is at the end of one read, whatever is left in the caller's buffer after it must not
+	// affect how the next read is handled.
+	r := newNormaliser(io.MultiReader(strings.NewReader("a\r\n"), strings.NewReader("\nb")))
+	buf := []byte("\r\r\r\r\r\r")
+	var out []byte
+	for {
+		n, err := r.Read(buf)
+		out = append(out, buf[:n]...)
+		if err != nil {
+			break
+		}
+	}
+	if string(out) != "a\n\nb" {
+		t.Errorf(`Expected "a\n\nb", got %q`, out)
+	}
+}
+
+func TestNormaliserCanFindOriginalOffset(t *testing.T) {
+	// The CRLF after "b" is split between two reads.
+	norm := newNormaliser(io.MultiReader(strings.NewReader("a\r\nb\r"), strings.NewReader("\nc\rd\n")))
+	r := bufio.NewReader(norm)
+	var offsets []int64
+	pos := int64(0)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		offsets = append(offsets, norm.originalOffset(pos))
+		pos += int64(len(line))
+	}
+	expected := []int64{0, 3, 6, 8}
+	if fmt.Sprint(offsets) != fmt.Sprint(expected) {
+		t.Errorf("Expected offsets %v, got %v", expected, offsets)
+	}
+}
@@ -3,15 +3,28 @@ package eventsource
 import (
 	"sort"
 	"sync"
+	"time"
 )
 
 // SliceRepository is an example repository that uses a slice as storage for past events.
+//
+// A SliceRepository created with NewSliceRepository keeps each channel's events sorted by ID, comparing
+// the IDs as strings, and replays them in that order regardless of the order in which they were added;
+// when a client reconnects, it replays the events whose IDs are not less than the client's Last-Event-ID,
+// including the event with that ID. This only makes sense if IDs increase in string order. A
+// SliceRepository created with NewOrderedSliceRepository instead keeps the events in the order they were
+// added, which is usually the order in which they were published.
+//
+// A SliceRepository keeps every event that is added to it, unless a limit is set with SetMaxEvents and
+// Compact is called, for instance by setting server.RepositoryCompactInterval.
 type SliceRepository struct {
-	events map[string][]Event
-	lock   *sync.RWMutex
+	events    map[string][]Event
+	lock      *sync.RWMutex
+	ordered   bool
+	maxEvents int
 }
 
-// NewSliceRepository creates a SliceRepository.
+// NewSliceRepository creates a SliceRepository that keeps events sorted by ID.
 func NewSliceRepository() *SliceRepository {
 	return &SliceRepository{
 		events: make(map[string][]Event),
@@ -19,20 +32,64 @@ func NewSliceRepository() *SliceRepository {
 	}
 }
 
+// NewOrderedSliceRepository creates a SliceRepository that keeps events in the order they were added,
+// without comparing their IDs. Add always appends the event, even if there is already an event with the
+// same ID in the channel.
+//
+// When a client reconnects, the repository finds the most recently added event whose ID is the client's
+// Last-Event-ID, and replays only the events that were added after it. If there is no event with that ID,
+// nothing is replayed, since the repository cannot tell which of its events the client has missed.
+func NewOrderedSliceRepository() *SliceRepository {
+	repo := NewSliceRepository()
+	repo.ordered = true
+	return repo
+}
+
+// NewSliceRepositoryFromEvents creates a SliceRepository that already contains the specified events for
+// the specified channel, as if Add had been called for each of them. This is convenient for tests, or for
+// a server that loads its event history from some other storage at startup.
+func NewSliceRepositoryFromEvents(channel string, events []Event) *SliceRepository {
+	repo := NewSliceRepository()
+	for _, event := range events {
+		repo.Add(channel, event)
+	}
+	return repo
+}
+
 func (repo SliceRepository) indexOfEvent(channel, id string) int {
 	return sort.Search(len(repo.events[channel]), func(i int) bool {
 		return repo.events[channel][i].Id() >= id
 	})
 }
 
-// Replay implements the event replay logic for the Repository interface.
+// Returns the index of the event after the last one with the specified ID, or -1 if there is none;
+// this is used instead of indexOfEvent if the repository is ordered.
+func (repo SliceRepository) indexAfterEvent(channel, id string) int {
+	events := repo.events[channel]
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].Id() == id {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// Replay implements the event replay logic for the Repository interface. See SliceRepository for the
+// order in which events are replayed.
 func (repo SliceRepository) Replay(channel, id string) (out chan Event) {
 	out = make(chan Event)
 	go func() {
 		defer close(out)
 		repo.lock.RLock()
 		defer repo.lock.RUnlock()
-		events := repo.events[channel][repo.indexOfEvent(channel, id):]
+		var events []Event
+		if !repo.ordered {
+			events = repo.events[channel][repo.indexOfEvent(channel, id):]
+		} else if id == "" {
+			events = repo.events[channel]
+		} else if i := repo.indexAfterEvent(channel, id); i >= 0 {
+			events = repo.events[channel][i:]
+		}
 		for i := range events {
 			out <- events[i]
 		}
@@ -40,10 +97,15 @@ func (repo SliceRepository) Replay(channel, id string) (out chan Event) {
 	return
 }
 
-// Add adds an event to the repository history.
+// Add adds an event to the repository history. Unless the repository was created with
+// NewOrderedSliceRepository, an existing event with the same ID in the same channel is replaced.
 func (repo *SliceRepository) Add(channel string, event Event) {
 	repo.lock.Lock()
 	defer repo.lock.Unlock()
+	if repo.ordered {
+		repo.events[channel] = append(repo.events[channel], event)
+		return
+	}
 	i := repo.indexOfEvent(channel, event.Id())
 	if i < len(repo.events[channel]) && repo.events[channel][i].Id() == event.Id() {
 		repo.events[channel][i] = event
@@ -51,3 +113,246 @@ func (repo *SliceRepository) Add(channel string, event Event) {
 		repo.events[channel] = append(repo.events[channel][:i], append([]Event{event}, repo.events[channel][i:]...)...)
 	}
 }
+
+// SetMaxEvents sets the number of events that Compact keeps for each channel. If a channel has more
+// events than that, Compact discards the ones that would be replayed first: the ones with the lowest IDs,
+// or, if the repository was created with NewOrderedSliceRepository, the ones that were added first. Add
+// does not check the limit, so a channel can have more events until the next call to Compact. If
+// maxEvents is zero or negative, which is the default, there is no limit and Compact does nothing.
+//
+// SetMaxEvents should be called before the repository is used.
+func (repo *SliceRepository) SetMaxEvents(maxEvents int) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	repo.maxEvents = maxEvents
+}
+
+// Compact discards events from any channel that has more than the limit that was set with SetMaxEvents.
+// This implements Compactable.
+func (repo *SliceRepository) Compact() {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	if repo.maxEvents <= 0 {
+		return
+	}
+	for channel, events := range repo.events {
+		if len(events) > repo.maxEvents {
+			// copy the events that are kept, so that the discarded ones can be garbage-collected
+			repo.events[channel] = append([]Event(nil), events[len(events)-repo.maxEvents:]...)
+		}
+	}
+}
+
+// SortedRepository is a repository that stores past events in order of their IDs, according to an
+// ordering that is provided by the application. Unlike SliceRepository, it does not assume that IDs
+// can be compared as strings; for instance, numeric IDs can be ordered numerically.
+type SortedRepository struct {
+	events map[string][]Event
+	less   func(a, b string) bool
+	lock   *sync.RWMutex
+}
+
+// NewSortedRepository creates a SortedRepository. The less function must return true if the event
+// ID a should come before the event ID b.
+func NewSortedRepository(less func(a, b string) bool) *SortedRepository {
+	return &SortedRepository{
+		events: make(map[string][]Event),
+		less:   less,
+		lock:   &sync.RWMutex{},
+	}
+}
+
+// Returns the index of the first event whose ID is not less than the specified ID.
+func (repo *SortedRepository) indexOfEvent(channel, id string) int {
+	return sort.Search(len(repo.events[channel]), func(i int) bool {
+		return !repo.less(repo.events[channel][i].Id(), id)
+	})
+}
+
+// Replay implements the event replay logic for the Repository interface. If id is non-empty, only
+// events whose IDs come after it are replayed; otherwise, all events are replayed. Events are
+// always replayed in order of their IDs, regardless of the order in which they were added.
+func (repo *SortedRepository) Replay(channel, id string) (out chan Event) {
+	out = make(chan Event)
+	go func() {
+		defer close(out)
+		repo.lock.RLock()
+		defer repo.lock.RUnlock()
+		events := repo.events[channel]
+		if id != "" {
+			i := repo.indexOfEvent(channel, id)
+			for i < len(events) && !repo.less(id, events[i].Id()) {
+				i++ // skip the event with the same ID as the last one the client received
+			}
+			events = events[i:]
+		}
+		for i := range events {
+			out <- events[i]
+		}
+	}()
+	return
+}
+
+// Add adds an event to the repository history. If there is already an event with the same ID in
+// the same channel, it is replaced.
+func (repo *SortedRepository) Add(channel string, event Event) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	i := repo.indexOfEvent(channel, event.Id())
+	events := repo.events[channel]
+	if i < len(events) && !repo.less(event.Id(), events[i].Id()) {
+		events[i] = event
+	} else {
+		repo.events[channel] = append(events[:i], append([]Event{event}, events[i:]...)...)
+	}
+}
+
+// BoundedRepository is a repository that keeps only a limited number of recent events for each channel,
+// so that its memory use does not grow without limit. Events are kept in the order they were added,
+// regardless of their IDs.
+type BoundedRepository struct {
+	channels  map[string]*boundedChannel
+	maxEvents int
+	maxAge    time.Duration
+	now       func() time.Time
+	lock      *sync.Mutex
+}
+
+// A ring buffer of the most recent events for one channel.
+type boundedChannel struct {
+	entries []boundedEntry
+	start   int // index of the oldest entry
+	count   int
+}
+
+type boundedEntry struct {
+	event Event
+	added time.Time
+}
+
+// NewBoundedRepository creates a BoundedRepository. Each channel keeps at most maxEvents events, and
+// events are discarded once they are older than maxAge. When a new event is added to a channel that
+// already has maxEvents events, the oldest one is discarded. If maxAge is zero or negative, events are
+// only discarded when there are too many. If maxEvents is less than 1, it is treated as 1.
+func NewBoundedRepository(maxEvents int, maxAge time.Duration) *BoundedRepository {
+	if maxEvents < 1 {
+		maxEvents = 1
+	}
+	return &BoundedRepository{
+		channels:  make(map[string]*boundedChannel),
+		maxEvents: maxEvents,
+		maxAge:    maxAge,
+		now:       time.Now,
+		lock:      &sync.Mutex{},
+	}
+}
+
+// Replay implements the event replay logic for the Repository interface.
+//
+// If id is empty, all of the channel's events that are still retained are replayed. Otherwise, only the
+// events that were added after the event with that ID are replayed. If there is no event with that ID,
+// because it has already been discarded or was never added, nothing is replayed: the repository cannot
+// tell which of its events the client has missed.
+func (repo *BoundedRepository) Replay(channel, id string) (out chan Event) {
+	repo.lock.Lock()
+	events := repo.retainedEvents(channel)
+	repo.lock.Unlock()
+	if id != "" {
+		found := false
+		for i := len(events) - 1; i >= 0; i-- {
+			if events[i].Id() == id {
+				events, found = events[i+1:], true
+				break
+			}
+		}
+		if !found {
+			events = nil
+		}
+	}
+	out = make(chan Event)
+	go func() {
+		defer close(out)
+		for _, e := range events {
+			out <- e
+		}
+	}()
+	return
+}
+
+// Add adds an event to the repository history, discarding the oldest event for the channel if
+// necessary.
+func (repo *BoundedRepository) Add(channel string, event Event) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	c := repo.channels[channel]
+	if c == nil {
+		c = &boundedChannel{}
+		repo.channels[channel] = c
+	}
+	if c.count == len(c.entries) && len(c.entries) < repo.maxEvents {
+		// the buffer is full but has not reached its maximum size, so grow it rather than discarding anything
+		size := 2 * len(c.entries)
+		if size < 16 {
+			size = 16
+		}
+		if size > repo.maxEvents {
+			size = repo.maxEvents
+		}
+		grown := make([]boundedEntry, size)
+		for i := 0; i < c.count; i++ {
+			grown[i] = c.entries[(c.start+i)%len(c.entries)]
+		}
+		c.entries, c.start = grown, 0
+	}
+	entry := boundedEntry{event: event, added: repo.now()}
+	if c.count < len(c.entries) {
+		c.entries[(c.start+c.count)%len(c.entries)] = entry
+		c.count++
+	} else {
+		c.entries[c.start] = entry
+		c.start = (c.start + 1) % len(c.entries)
+	}
+	repo.discardExpired(channel)
+}
+
+// Compact discards any events that have expired, in all channels. Otherwise, expired events are only
+// discarded when events are added to or replayed from the same channel. This implements Compactable.
+func (repo *BoundedRepository) Compact() {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	for channel := range repo.channels {
+		repo.discardExpired(channel)
+	}
+}
+
+// Returns a copy of the channel's events, oldest first, after discarding any that have expired. The
+// caller must hold the lock.
+func (repo *BoundedRepository) retainedEvents(channel string) []Event {
+	repo.discardExpired(channel)
+	c := repo.channels[channel]
+	if c == nil {
+		return nil
+	}
+	events := make([]Event, 0, c.count)
+	for i := 0; i < c.count; i++ {
+		events = append(events, c.entries[(c.start+i)%len(c.entries)].event)
+	}
+	return events
+}
+
+// Discards events that are older than maxAge from a channel. The caller must hold the lock.
+func (repo *BoundedRepository) discardExpired(channel string) {
+	c := repo.channels[channel]
+	if c == nil || repo.maxAge <= 0 {
+		return
+	}
+	cutoff := repo.now().Add(-repo.maxAge)
+	for c.count > 0 && c.entries[c.start].added.Before(cutoff) {
+		c.entries[c.start] = boundedEntry{} // allow the event to be garbage-collected
+		c.start = (c.start + 1) % len(c.entries)
+		c.count--
+	}
+	if c.count == 0 {
+		delete(repo.channels, channel)
+	}
+}
@@ -0,0 +1,170 @@
+package eventsource
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func numericLess(a, b string) bool {
+	m, _ := strconv.Atoi(a)
+	n, _ := strconv.Atoi(b)
+	return m < n
+}
+
+func replayedIDs(repo Repository, channel, id string) []string {
+	var ids []string
+	for e := range repo.Replay(channel, id) {
+		ids = append(ids, e.Id())
+	}
+	return ids
+}
+
+func TestSliceRepositoryFromEvents(t *testing.T) {
+	repo := NewSliceRepositoryFromEvents("test", []Event{&publication{id: "b"}, &publication{id: "a"}, &publication{id: "c"}})
+
+	assert.Equal(t, []string{"a", "b", "c"}, replayedIDs(repo, "test", ""))
+	assert.Nil(t, replayedIDs(repo, "other", ""))
+
+	repo.Add("test", &publication{id: "d"})
+	assert.Equal(t, []string{"c", "d"}, replayedIDs(repo, "test", "c"))
+}
+
+func TestSliceRepositoryCompactKeepsAllEventsByDefault(t *testing.T) {
+	repo := NewSliceRepositoryFromEvents("test", []Event{&publication{id: "a"}, &publication{id: "b"}, &publication{id: "c"}})
+
+	repo.Compact()
+	assert.Equal(t, []string{"a", "b", "c"}, replayedIDs(repo, "test", ""))
+}
+
+func TestSliceRepositoryCompactDiscardsEventsOverMaxEvents(t *testing.T) {
+	repo := NewSliceRepositoryFromEvents("test", []Event{&publication{id: "c"}, &publication{id: "a"}, &publication{id: "b"}})
+	repo.Add("other", &publication{id: "x"})
+	repo.SetMaxEvents(2)
+
+	repo.Add("test", &publication{id: "d"})
+	assert.Equal(t, []string{"a", "b", "c", "d"}, replayedIDs(repo, "test", ""))
+
+	repo.Compact()
+	assert.Equal(t, []string{"c", "d"}, replayedIDs(repo, "test", ""))
+	assert.Equal(t, []string{"x"}, replayedIDs(repo, "other", ""))
+	assert.Equal(t, 2, cap(repo.events["test"]))
+}
+
+func TestOrderedSliceRepositoryCompactDiscardsEventsAddedFirst(t *testing.T) {
+	repo := NewOrderedSliceRepository()
+	repo.SetMaxEvents(2)
+	for _, id := range []string{"c", "a", "b"} {
+		repo.Add("test", &publication{id: id})
+	}
+
+	repo.Compact()
+	assert.Equal(t, []string{"a", "b"}, replayedIDs(repo, "test", ""))
+}
+
+func TestOrderedSliceRepositoryReplaysEventsInOrderAdded(t *testing.T) {
+	repo := NewOrderedSliceRepository()
+	for _, id := range []string{"b", "a", "c", "a", "d"} {
+		repo.Add("test", &publication{id: id})
+	}
+
+	assert.Equal(t, []string{"b", "a", "c", "a", "d"}, replayedIDs(repo, "test", ""))
+	assert.Equal(t, []string{"a", "c", "a", "d"}, replayedIDs(repo, "test", "b"))
+	assert.Equal(t, []string{"d"}, replayedIDs(repo, "test", "a")) // resumes after the latest event with the ID
+	assert.Nil(t, replayedIDs(repo, "test", "d"))
+	assert.Nil(t, replayedIDs(repo, "test", "unknown"))
+	assert.Nil(t, replayedIDs(repo, "other", ""))
+}
+
+func TestSortedRepositoryReplaysAllEventsInOrderOfID(t *testing.T) {
+	repo := NewSortedRepository(numericLess)
+	for _, id := range []string{"10", "2", "33", "1"} {
+		repo.Add("test", &publication{id: id})
+	}
+	repo.Add("other", &publication{id: "5"})
+
+	assert.Equal(t, []string{"1", "2", "10", "33"}, replayedIDs(repo, "test", ""))
+}
+
+func TestSortedRepositoryReplaysEventsAfterLastEventID(t *testing.T) {
+	repo := NewSortedRepository(numericLess)
+	for _, id := range []string{"10", "2", "33", "1"} {
+		repo.Add("test", &publication{id: id})
+	}
+
+	assert.Equal(t, []string{"10", "33"}, replayedIDs(repo, "test", "2"))
+	assert.Equal(t, []string{"10", "33"}, replayedIDs(repo, "test", "3"))
+	assert.Nil(t, replayedIDs(repo, "test", "33"))
+}
+
+func TestSortedRepositoryReplacesEventWithSameID(t *testing.T) {
+	repo := NewSortedRepository(numericLess)
+	repo.Add("test", &publication{id: "1", data: "a"})
+	repo.Add("test", &publication{id: "2", data: "b"})
+	repo.Add("test", &publication{id: "1", data: "c"})
+
+	var data []string
+	for e := range repo.Replay("test", "") {
+		data = append(data, e.Data())
+	}
+	assert.Equal(t, []string{"c", "b"}, data)
+}
+
+func TestBoundedRepositoryDiscardsOldestEventsOverMaxEvents(t *testing.T) {
+	repo := NewBoundedRepository(3, 0)
+	for _, id := range []string{"5", "4", "3", "2", "1"} {
+		repo.Add("test", &publication{id: id})
+	}
+	repo.Add("other", &publication{id: "9"})
+
+	assert.Equal(t, []string{"3", "2", "1"}, replayedIDs(repo, "test", ""))
+	assert.Equal(t, []string{"1"}, replayedIDs(repo, "test", "2"))
+	assert.Nil(t, replayedIDs(repo, "test", "1"))
+	assert.Nil(t, replayedIDs(repo, "test", "4")) // already discarded
+	assert.Equal(t, []string{"9"}, replayedIDs(repo, "other", ""))
+}
+
+func TestBoundedRepositoryDiscardsEventsOlderThanMaxAge(t *testing.T) {
+	repo := NewBoundedRepository(100, time.Minute)
+	now := time.Now()
+	repo.now = func() time.Time { return now }
+	repo.Add("test", &publication{id: "a"})
+	now = now.Add(time.Second * 30)
+	repo.Add("test", &publication{id: "b"})
+	now = now.Add(time.Second * 45)
+
+	assert.Equal(t, []string{"b"}, replayedIDs(repo, "test", ""))
+	assert.Nil(t, replayedIDs(repo, "test", "a"))
+
+	now = now.Add(time.Minute)
+	assert.Nil(t, replayedIDs(repo, "test", ""))
+}
+
+func TestBoundedRepositoryCompactDiscardsExpiredEventsInAllChannels(t *testing.T) {
+	repo := NewBoundedRepository(100, time.Minute)
+	now := time.Now()
+	repo.now = func() time.Time { return now }
+	repo.Add("a", &publication{id: "1"})
+	repo.Add("b", &publication{id: "2"})
+	now = now.Add(time.Second * 30)
+	repo.Add("b", &publication{id: "3"})
+	now = now.Add(time.Second * 45)
+
+	repo.Compact()
+	assert.Len(t, repo.channels, 1)
+	assert.Equal(t, 1, repo.channels["b"].count)
+}
+
+func TestBoundedRepositoryCanGrowPastInitialBufferSize(t *testing.T) {
+	repo := NewBoundedRepository(40, 0)
+	var expected []string
+	for i := 0; i < 50; i++ {
+		repo.Add("test", &publication{id: strconv.Itoa(i)})
+		if i >= 10 {
+			expected = append(expected, strconv.Itoa(i))
+		}
+	}
+	assert.Equal(t, expected, replayedIDs(repo, "test", ""))
+}
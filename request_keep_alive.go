@@ -0,0 +1,61 @@
+package eventsource
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// The data that is written to the request body at each keep-alive interval.
+const requestKeepAliveData = "\n"
+
+// A request body that first sends the original body, if any, and then writes a newline at regular
+// intervals until it is stopped. This is used to implement StreamOptionRequestKeepAlive.
+//
+// The returned function stops the keep-alive writer and closes the pipe. It is safe to call it more
+// than once.
+func newRequestKeepAliveBody(body io.ReadCloser, interval time.Duration) (io.ReadCloser, func()) {
+	pr, pw := io.Pipe()
+	stopCh := make(chan struct{})
+	var stopOnce sync.Once
+	stop := func() {
+		stopOnce.Do(func() {
+			close(stopCh)
+			_ = pw.Close() // unblocks any write that is waiting for the transport to read
+		})
+	}
+	go func() {
+		if body != nil {
+			_, err := io.Copy(pw, body)
+			_ = body.Close()
+			if err != nil {
+				_ = pw.CloseWithError(err)
+				return
+			}
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+				if _, err := io.WriteString(pw, requestKeepAliveData); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return pr, stop
+}
+
+// Wraps a response body so that closing it also stops the request keep-alive writer.
+type keepAliveResponseBody struct {
+	io.ReadCloser
+	stopKeepAlive func()
+}
+
+func (b keepAliveResponseBody) Close() error {
+	b.stopKeepAlive()
+	return b.ReadCloser.Close()
+}
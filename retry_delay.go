@@ -25,6 +25,7 @@ type retryDelayStrategy struct {
 	jitter        jitterStrategy
 	resetInterval time.Duration
 	retryCount    int
+	minDelay      time.Duration
 	goodSince     time.Time // nonzero only if the state is currently "good"
 }
 
@@ -112,6 +113,9 @@ func (r *retryDelayStrategy) NextRetryDelay(currentTime time.Time) time.Duration
 	if r.jitter != nil {
 		delay = r.jitter.applyJitter(delay)
 	}
+	if delay < r.minDelay {
+		delay = r.minDelay
+	}
 	return delay
 }
 
@@ -131,6 +135,15 @@ func (r *retryDelayStrategy) SetBaseDelay(baseDelay time.Duration) {
 	r.retryCount = 0
 }
 
+// SetMinDelay sets a lower bound for all subsequent retry delays, without changing the base delay or the
+// current backoff progression.
+//
+// This is used to implement RetryDirectiveSetFloor, where a "retry:" command from the server is treated as
+// a minimum rather than as a new starting point.
+func (r *retryDelayStrategy) SetMinDelay(minDelay time.Duration) {
+	r.minDelay = minDelay
+}
+
 func (r *retryDelayStrategy) hasJitter() bool { //nolint:megacheck // used only in tests
 	return r.jitter != nil
 }
@@ -104,3 +104,31 @@ func TestBackoffAndJitterWorkWithHighRetryCount(t *testing.T) {
 	_ = jitter.applyJitter(d1)
 	// No assertion - the test just needs to not panic.
 }
+
+func TestSetBaseDelayDuringBackoffResetsProgression(t *testing.T) {
+	d0 := time.Second
+	max := time.Minute
+	r := newRetryDelayStrategy(d0, 0, newDefaultBackoff(max), nil)
+	t0 := time.Now().Add(-time.Minute)
+	_ = r.NextRetryDelay(t0)
+	_ = r.NextRetryDelay(t0.Add(time.Second))
+	r.SetBaseDelay(time.Second * 3)
+	d1 := r.NextRetryDelay(t0.Add(time.Second * 2))
+	d2 := r.NextRetryDelay(t0.Add(time.Second * 3))
+	assert.Equal(t, time.Second*3, d1)
+	assert.Equal(t, time.Second*6, d2)
+}
+
+func TestSetMinDelayDuringBackoffKeepsProgression(t *testing.T) {
+	d0 := time.Second
+	max := time.Minute
+	r := newRetryDelayStrategy(d0, 0, newDefaultBackoff(max), nil)
+	t0 := time.Now().Add(-time.Minute)
+	_ = r.NextRetryDelay(t0)
+	_ = r.NextRetryDelay(t0.Add(time.Second))
+	r.SetMinDelay(time.Second * 5)
+	d1 := r.NextRetryDelay(t0.Add(time.Second * 2))
+	d2 := r.NextRetryDelay(t0.Add(time.Second * 3))
+	assert.Equal(t, time.Second*5, d1) // backoff would have given 4s
+	assert.Equal(t, time.Second*8, d2)
+}
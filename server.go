@@ -1,16 +1,32 @@
 package eventsource
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net"
 	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type subscription struct {
-	channel     string
-	lastEventID string
-	out         chan<- eventOrComment
+	held          int32         // taken from the handler's channel but not yet handled; accessed atomically
+	handled       chan struct{} // signaled when held decreases; used only if SendGracePeriod is set
+	channel       string
+	lastEventID   string
+	replayAll     bool
+	out           chan<- eventOrComment
+	bufferedBytes int64  // guarded by Server.bufferLock; used only if MaxTotalBufferedBytes is set
+	evicted       bool   // guarded by Server.bufferLock
+	removed       bool   // guarded by Server.bufferLock; set when bufferedBytes no longer counts toward the total
+	connectionID  string // assigned by Server.run()
+	remoteAddr    string
 }
 
 type eventOrComment interface{}
@@ -19,11 +35,16 @@ type outbound struct {
 	channels       []string
 	eventOrComment eventOrComment
 	ackCh          chan<- struct{}
+	ordered        bool
+	seq            uint64
+	allChannels    bool
 }
 
 type registration struct {
-	channel    string
-	repository Repository
+	channel        string
+	repository     Repository
+	previousCh     chan<- Repository // used only by ReplaceRepository
+	lastAssignedID uint64            // used only if AutoAssignIDs is set
 }
 
 type unregistration struct {
@@ -31,6 +52,109 @@ type unregistration struct {
 	forceDisconnect bool
 }
 
+type presenceRegistration struct {
+	channel         string
+	presenceChannel string
+}
+
+// PresenceEvent is the Event that a Server publishes on a presence channel when a subscriber joins or
+// leaves a channel; see Server.EnablePresence.
+//
+// Its event name is "join" or "leave", and it has no ID. Its data is a JSON object with the properties
+// "channel", "connectionId", and "remoteAddr", corresponding to the fields of the same names.
+type PresenceEvent struct {
+	// Joined is true if the subscriber has joined the channel, or false if it has left.
+	Joined bool
+	// Channel is the channel that the subscriber joined or left.
+	Channel string
+	// ConnectionID is an identifier that the Server assigns to each subscription. It is unique within the
+	// Server, so it can be used to match a "leave" event to the corresponding "join" event.
+	ConnectionID string
+	// RemoteAddr is the network address of the client, from the RemoteAddr of the HTTP request.
+	RemoteAddr string
+}
+
+//nolint:golint,stylecheck // should be ID; required by the Event interface
+func (e PresenceEvent) Id() string { return "" }
+
+// Event returns "join" or "leave".
+func (e PresenceEvent) Event() string {
+	if e.Joined {
+		return "join"
+	}
+	return "leave"
+}
+
+// Data returns a JSON representation of the event's properties.
+func (e PresenceEvent) Data() string {
+	data, _ := json.Marshal(struct {
+		Channel      string `json:"channel"`
+		ConnectionID string `json:"connectionId"`
+		RemoteAddr   string `json:"remoteAddr"`
+	}{e.Channel, e.ConnectionID, e.RemoteAddr})
+	return string(data)
+}
+
+// An event that was published without an ID, with an ID assigned by the server because AutoAssignIDs was
+// set. It implements all of the optional event interfaces that the Encoder and Server use, returning the
+// same values as the original event would (or the defaults, if the original event does not implement
+// them), so that wrapping the event does not change how it is sent.
+type eventWithAssignedID struct {
+	event Event
+	id    string
+}
+
+//nolint:golint,stylecheck // should be ID; required by the Event interface
+func (e eventWithAssignedID) Id() string    { return e.id }
+func (e eventWithAssignedID) Event() string { return e.event.Event() }
+func (e eventWithAssignedID) Data() string  { return e.event.Data() }
+func (e eventWithAssignedID) Priority() int { return priorityOf(e.event) }
+
+func (e eventWithAssignedID) ExtraFields() map[string]string {
+	if ef, ok := e.event.(EventWithExtraFields); ok {
+		return ef.ExtraFields()
+	}
+	return nil
+}
+
+func (e eventWithAssignedID) RetryMillis() (int64, bool) {
+	if er, ok := e.event.(EventWithRetry); ok {
+		return er.RetryMillis()
+	}
+	return 0, false
+}
+
+// Any Repository with an Add method, which the Server uses to store events whose IDs it has assigned.
+type repositoryWithAdd interface {
+	Add(channel string, event Event)
+}
+
+// The number of digits in an ID assigned by AutoAssignIDs. This is enough for any uint64, so padding the
+// IDs with zeroes to this width makes them sort correctly as strings.
+const assignedIDWidth = 20
+
+func formatAssignedID(n uint64) string {
+	s := strconv.FormatUint(n, 10)
+	return strings.Repeat("0", assignedIDWidth-len(s)) + s
+}
+
+// Returns the largest ID in a channel's Repository that is a decimal number, so that AutoAssignIDs can
+// continue from there instead of reusing IDs that are already in the Repository. Since this reads the
+// whole history, it is called by the goroutine that registers the Repository, not by Server.run().
+func lastNumericID(repo Repository, channel string) uint64 {
+	var last uint64
+	events := repo.Replay(channel, "")
+	if events == nil {
+		return 0
+	}
+	for e := range events {
+		if n, err := strconv.ParseUint(e.Id(), 10, 64); err == nil && n > last {
+			last = n
+		}
+	}
+	return last
+}
+
 type comment struct {
 	value string
 }
@@ -42,27 +166,76 @@ type eventBatch struct {
 // Server manages any number of event-publishing channels and allows subscribers to consume them.
 // To use it within an HTTP server, create a handler for each channel with Handler().
 type Server struct {
-	AllowCORS       bool          // Enable all handlers to be accessible from any origin
-	ReplayAll       bool          // Replay repository even if there's no Last-Event-Id specified
-	BufferSize      int           // How many messages do we let the client get behind before disconnecting
-	Gzip            bool          // Enable compression if client can accept it
-	MaxConnTime     time.Duration // If non-zero, HTTP connections will be automatically closed after this time
-	Logger          Logger        // Logger is a logger that, when set, will be used for logging debug messages
+	AllowCORS             bool          // Enable all handlers to be accessible from any origin
+	ReplayAll             bool          // Replay repository even if there's no Last-Event-Id specified
+	BufferSize            int           // How many messages do we let the client get behind before disconnecting
+	Gzip                  bool          // Enable compression if client can accept it
+	MaxConnTime           time.Duration // If non-zero, HTTP connections will be automatically closed after this time
+	Logger                Logger        // Logger is a logger that, when set, will be used for logging debug messages
+	OrderedPublishTimeout time.Duration // If non-zero, PublishOrdered will skip a missing sequence number after this time
+	ExtraResponseHeaders  http.Header   // Additional headers for every response; see Handler for how they interact with the defaults
+	MaxReplayDuration     time.Duration // If non-zero, replaying events from a Repository will be cut short after this time
+	ReplayTimeoutComment  string        // If non-empty, a comment that is sent to the client when MaxReplayDuration elapses
+	CoalesceWindow        time.Duration // If non-zero, events with the same ID published within this time are merged; see Handler
+	MaxTotalBufferedBytes int64         // If non-zero, an approximate limit on unsent event data across all subscribers; see Handler
+	MaxConnectionsPerIP   int           // If non-zero, Handler rejects connections from a client IP that already has this many
+	SendGracePeriod       time.Duration // If non-zero, how long a subscriber that is behind by BufferSize can take to catch up; see Handler
+	KeepAlive             time.Duration // If non-zero, handlers send an empty comment after this much time without sending anything
+	FlushInterval         time.Duration // If non-zero, handlers flush at most this often rather than after every event; see Handler
+	// AutoAssignIDs, if true, gives sequential IDs to published events that have no ID; see Publish. It must
+	// be set before a Repository is registered, since Register and ReplaceRepository then read the whole
+	// history of the channel from the Repository to find where the numbering should continue, so they can
+	// take a while to return if the Repository is large.
+	AutoAssignIDs bool
+	// RepositoryCompactInterval, if non-zero, is how often the server calls Compact on each registered
+	// Repository that implements Compactable. It must be set before the first Repository is registered.
+	RepositoryCompactInterval time.Duration
+	// AllowClientReplayRequest, if true, lets a client ask for all of the events in the channel's
+	// Repository to be replayed, as if ReplayAll were set for that one connection, by adding the query
+	// parameter "replay=all" to the request URL. This is off by default since any client could use it.
+	AllowClientReplayRequest bool
+	// OnUnknownChannel, if set, is called when an event or comment is published to a channel that has no
+	// subscribers and no registered Repository, which may mean that the channel name is wrong. It is
+	// called from the server's own goroutine, so it must not call any Server methods, and it should
+	// return quickly.
+	OnUnknownChannel func(channel string)
+	// OnEncodeError, if set, is called when a handler fails to write an event or comment to a client, just
+	// before the handler closes the connection. This usually means that the client has gone away. The meta
+	// parameter is the item that could not be written: either an Event, or a string for a comment.
+	OnEncodeError   func(channel string, meta interface{}, err error)
 	registrations   chan *registration
 	unregistrations chan *unregistration
+	presenceRegs    chan *presenceRegistration
+	disconnects     chan string
+	queries         chan func(subs map[string]map[*subscription]struct{})
+	runDone         chan struct{}
 	pub             chan *outbound
 	subs            chan *subscription
 	unsubs          chan *subscription
 	quit            chan bool
 	isClosed        bool
 	isClosedMutex   sync.RWMutex
+	bufferLock      sync.Mutex
+	bufferedTotal   int64
+	connsPerIP      map[string]int
+	connsPerIPLock  sync.Mutex
+	subFilter       func(channel string, req *http.Request) (bool, int)
+	subFilterLock   sync.RWMutex
+	activeHandlers  sync.WaitGroup
 }
 
+// The most events that PublishOrdered will hold while waiting for a missing sequence number.
+const maxPendingOrdered = 10000
+
 // NewServer creates a new Server instance.
 func NewServer() *Server {
 	srv := &Server{
 		registrations:   make(chan *registration),
 		unregistrations: make(chan *unregistration),
+		presenceRegs:    make(chan *presenceRegistration),
+		disconnects:     make(chan string),
+		queries:         make(chan func(map[string]map[*subscription]struct{})),
+		runDone:         make(chan struct{}),
 		pub:             make(chan *outbound),
 		subs:            make(chan *subscription),
 		unsubs:          make(chan *subscription, 2),
@@ -79,31 +252,139 @@ func (srv *Server) Close() {
 	srv.markServerClosed()
 }
 
+// CloseWithNotice sends a final event to every subscriber on every channel, and then closes the server
+// as Close does. This can be used to tell clients about a planned shutdown, so that they can reconnect
+// elsewhere right away.
+//
+// After closing the server, CloseWithNotice waits until all handlers have finished writing the notice
+// and any other events that were already waiting to be sent, or until the timeout elapses, whichever
+// comes first. A zero timeout means it does not wait at all. Like Close, it should only be called once.
+func (srv *Server) CloseWithNotice(ev Event, timeout time.Duration) {
+	ackCh := make(chan struct{}, 1)
+	srv.pub <- &outbound{
+		eventOrComment: ev,
+		ackCh:          ackCh,
+		allChannels:    true,
+	}
+	<-ackCh
+	srv.CloseGracefully(timeout)
+}
+
+// CloseGracefully shuts down the Server as Close does, and then waits until all handlers have finished
+// writing the events and comments that were already waiting to be sent to their clients, or until the
+// timeout elapses, whichever comes first. A zero timeout means it does not wait at all.
+//
+// Close does not discard those items either, but it returns right away, so if the application exits
+// after calling Close, clients may not receive them. To make sure that everything that was published
+// before the shutdown has been processed by the server first, use PublishWithAcknowledgment for the last
+// event. Like Close, CloseGracefully should only be called once, and no other Server methods should be
+// called after it.
+func (srv *Server) CloseGracefully(timeout time.Duration) {
+	srv.Close()
+	if timeout <= 0 {
+		return
+	}
+	handlersDone := make(chan struct{})
+	go func() {
+		srv.activeHandlers.Wait()
+		close(handlersDone)
+	}()
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-handlersDone:
+	case <-t.C:
+	}
+}
+
 // Handler creates a new HTTP handler for serving a specified channel.
 //
 // The channel does not have to have been previously registered with Register, but if it has been, the
 // handler may replay events from the registered Repository depending on the setting of server.ReplayAll
-// and the Last-Event-Id header of the request.
+// and the Last-Event-Id header of the request. If server.AllowClientReplayRequest is set, a request with
+// the query parameter "replay=all" also gets all of the events, even if ReplayAll is not set.
+//
+// Any headers in server.ExtraResponseHeaders are added to the response, and will replace the default
+// values of Cache-Control, Connection, and Access-Control-Allow-Origin if they specify those headers.
+// However, Content-Type and Content-Encoding are always determined by the server, since the response
+// could not be read correctly otherwise.
+//
+// If server.CoalesceWindow is set, the handler holds each published event for up to that length of time
+// before sending it. If another event with the same non-empty ID is published to the channel during that
+// time, only the newer one is sent, in the position of the newer one. This means that a client which is
+// falling behind will receive only the latest version of each ID, rather than every intermediate update.
+// Events without an ID, comments, and replayed events are never merged.
+//
+// Normally events are sent in the order they were published. However, if the client has fallen behind so
+// that there are several events waiting to be sent, an event that implements EventWithPriority will be
+// sent ahead of waiting events that have a lower priority. Events that have an ID, and replayed events,
+// are never reordered: an event is only moved ahead of waiting events that have no ID. The events that
+// are waiting to be reordered count toward server.BufferSize.
+//
+// If server.MaxTotalBufferedBytes is set, the server keeps track of the approximate size of the events
+// that are waiting to be sent to each client (counting the ID, event name, and data of each event). If
+// the total for all clients exceeds the limit, the clients with the most data waiting are disconnected,
+// and the events that were waiting for them are discarded, until the total is within the limit again.
+//
+// Normally, if a client falls behind so that server.BufferSize events are waiting to be sent to it, the
+// server disconnects it the next time an event is published. If server.SendGracePeriod is set, the
+// server instead keeps up to another BufferSize events for the client, and only disconnects it if the
+// handler has not been able to take the next event within SendGracePeriod, or if that second buffer is
+// also full. The waiting is done on a separate goroutine for each client, so it does not delay delivery
+// of events to other clients.
+//
+// If server.KeepAlive is set, the handler writes an empty comment line (":") whenever that much time has
+// passed since it last sent anything to the client, so that proxies and load balancers do not close the
+// connection for being idle.
+//
+// Normally the handler flushes the response after writing each event, so that the client receives it
+// right away. If server.FlushInterval is set, the handler instead flushes when that much time has passed
+// since it wrote the first event that has not been flushed yet, so that a channel with many events can be
+// sent in fewer, larger network writes. It still flushes right away if the client has fallen so far behind
+// that server.BufferSize events are waiting for it.
+//
+// Events that are replayed from a Repository are not flushed one at a time, whether or not FlushInterval
+// is set: the handler flushes once after the last one, or when server.MaxReplayDuration elapses, so that a
+// replay takes as few network writes as possible and, if the response is compressed, the replayed events
+// are compressed together.
+//
+// If server.MaxConnectionsPerIP is set, a request from a client IP address that already has that many
+// active connections to the server (on any channel) is rejected with a 429 status. The address is taken
+// from the request's RemoteAddr, so if the server is behind a proxy, it will be the proxy's address.
+//
+// If a filter has been set with SetSubscriptionFilter, it is called before anything else, and the request
+// is rejected if the filter does not accept it.
 func (srv *Server) Handler(channel string) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
-		h := w.Header()
-		h.Set("Content-Type", "text/event-stream; charset=utf-8")
-		h.Set("Cache-Control", "no-cache, no-store, must-revalidate")
-		h.Set("Connection", "keep-alive")
-		if srv.AllowCORS {
-			h.Set("Access-Control-Allow-Origin", "*")
+		if filter := srv.getSubscriptionFilter(); filter != nil {
+			if accept, status := filter(channel, req); !accept {
+				if status == 0 {
+					status = http.StatusForbidden
+				}
+				http.Error(w, http.StatusText(status), status)
+				return
+			}
 		}
-		useGzip := srv.Gzip && strings.Contains(req.Header.Get("Accept-Encoding"), "gzip")
-		if useGzip {
-			h.Set("Content-Encoding", "gzip")
+		if srv.MaxConnectionsPerIP > 0 {
+			ip := clientIP(req)
+			if !srv.addConnectionForIP(ip) {
+				if srv.Logger != nil {
+					srv.Logger.Printf("Rejecting connection from %s: too many connections", ip)
+				}
+				http.Error(w, "Too many connections", http.StatusTooManyRequests)
+				return
+			}
+			defer srv.removeConnectionForIP(ip)
 		}
-		w.WriteHeader(http.StatusOK)
+
+		useGzip := writeStreamHeaders(w, req, srv.AllowCORS, srv.Gzip, srv.ExtraResponseHeaders)
 
 		// If the Handler is still active even though the server is closed, stop here.
 		// Otherwise the Handler will block while publishing to srv.subs indefinitely.
-		if srv.isServerClosed() {
+		if !srv.addActiveHandler() {
 			return
 		}
+		defer srv.activeHandlers.Done()
 
 		var maxConnTimeCh <-chan time.Time
 		if srv.MaxConnTime > 0 {
@@ -116,22 +397,96 @@ func (srv *Server) Handler(channel string) http.HandlerFunc {
 		sub := &subscription{
 			channel:     channel,
 			lastEventID: req.Header.Get("Last-Event-ID"),
+			replayAll:   srv.AllowClientReplayRequest && req.URL.Query().Get("replay") == "all",
 			out:         eventCh,
+			remoteAddr:  req.RemoteAddr,
+		}
+		if srv.SendGracePeriod > 0 {
+			// The server sends to an intermediate channel, and a separate goroutine forwards items from it to
+			// eventCh, so that it can wait for this handler without blocking the server.
+			inCh := make(chan eventOrComment, srv.BufferSize)
+			sub.out = inCh
+			sub.handled = make(chan struct{}, 1)
+			handlerDone := make(chan struct{})
+			defer close(handlerDone)
+			go srv.forwardWithGracePeriod(sub, inCh, eventCh, handlerDone)
 		}
 		srv.subs <- sub
+		// Returns false if the item should be discarded because the subscription was evicted for exceeding
+		// MaxTotalBufferedBytes.
+		received := func(ec eventOrComment) bool {
+			if srv.MaxTotalBufferedBytes > 0 {
+				return srv.updateBufferedBytes(sub, -estimatedSize(ec))
+			}
+			return true
+		}
 		flusher := w.(http.Flusher)
-		flusher.Flush()
-		enc := NewEncoder(w, useGzip)
+		var keepAliveTimer *time.Timer
+		var keepAliveCh <-chan time.Time
+		if srv.KeepAlive > 0 {
+			keepAliveTimer = time.NewTimer(srv.KeepAlive)
+			defer keepAliveTimer.Stop()
+			keepAliveCh = keepAliveTimer.C
+		}
+		// Flushes the response, and restarts the KeepAlive interval since the client has just received data.
+		var flushTimer *time.Timer // used only if FlushInterval is set
+		var flushCh <-chan time.Time
+		defer func() {
+			if flushTimer != nil {
+				flushTimer.Stop()
+			}
+		}()
+		var enc *Encoder
+		flush := func() {
+			if enc != nil && enc.deferFlush {
+				_ = enc.flushCompressed() // if this fails, the next write will fail too
+			}
+			flusher.Flush()
+			if flushTimer != nil {
+				flushTimer.Stop()
+				flushTimer, flushCh = nil, nil
+			}
+			if keepAliveTimer != nil {
+				if !keepAliveTimer.Stop() {
+					select {
+					case <-keepAliveTimer.C:
+					default:
+					}
+				}
+				keepAliveTimer.Reset(srv.KeepAlive)
+			}
+		}
+		flush()
+		enc = NewEncoder(w, useGzip)
 
-		writeEventOrComment := func(ec eventOrComment) bool {
+		// Writes an item without flushing it; returns false if the handler should exit.
+		encodeEventOrComment := func(ec eventOrComment) bool {
 			if err := enc.Encode(ec); err != nil {
 				srv.unsubs <- sub
 				if srv.Logger != nil {
 					srv.Logger.Println(err)
 				}
+				if srv.OnEncodeError != nil {
+					var meta interface{} = ec
+					if c, ok := ec.(comment); ok {
+						meta = c.value
+					}
+					srv.OnEncodeError(channel, meta, err)
+				}
 				return false // if this happens, we'll end the handler early because something's clearly broken
 			}
-			flusher.Flush()
+			return true
+		}
+		writeEventOrComment := func(ec eventOrComment) bool {
+			if !encodeEventOrComment(ec) {
+				return false
+			}
+			if srv.FlushInterval <= 0 || len(eventCh) >= cap(eventCh) {
+				flush()
+			} else if flushTimer == nil {
+				flushTimer = time.NewTimer(srv.FlushInterval)
+				flushCh = flushTimer.C
+			}
 			return true
 		}
 
@@ -148,12 +503,170 @@ func (srv *Server) Handler(channel string) http.HandlerFunc {
 		// - So, instead, Server.run() now takes the channel from Replay and wraps it in an eventBatch. When
 		//   the handler sees an eventBatch, it switches over to reading events from that channel until the
 		//   channel is closed. Then it switches back to reading events from the regular channel.
-		// - The Server can close eventCh at any time to indicate that the stream is done. The handler exits.
+		// - Events from the batch are not flushed as they are written. When the batch channel is closed, or
+		//   when MaxReplayDuration elapses, the handler flushes before handling any live events. If the
+		//   response is compressed, the encoder does not flush the compressed data after each replayed event
+		//   either, so that the events are compressed together; the handler's flush does that too.
+		// - If MaxReplayDuration elapses before the batch channel is closed, the handler stops reading from it
+		//   and switches back to the regular channel. The rest of the batch is read and discarded by another
+		//   goroutine, so that the Repository is not blocked forever.
+		//   The same is done if the handler exits in the middle of a batch.
+		// - If CoalesceWindow is set, events from eventCh are collected in a pending list rather than written
+		//   immediately; a newer event with the same ID replaces the earlier one. The list is written out when
+		//   the window elapses, or before anything else (a comment, or a batch) is written.
+		// - Items from eventCh go into a backlog. Before handling the next item, the handler reads whatever
+		//   else is already available in eventCh, and then picks the item with the highest priority (see
+		//   EventWithPriority); items with equal priority are handled in the order they arrived. A batch or
+		//   an event with an ID is never reordered: only the items before the first such item are candidates.
+		// - Items in the backlog count toward BufferSize, since the server and forwardWithGracePeriod check
+		//   sub.held as well as the length of the channel; so the backlog does not let the client fall
+		//   further behind than it otherwise could.
+		// - If FlushInterval is set, writing an event or comment starts a timer, unless it is already running,
+		//   instead of flushing; the handler flushes when the timer fires. Any other flush stops the timer.
+		// - If KeepAlive is set, a timer is restarted every time the handler flushes the response, and an empty
+		//   comment is written whenever the timer fires.
+		// - The Server can close eventCh at any time to indicate that the stream is done. The handler exits
+		//   after it has handled everything in the backlog.
 		// - If the client closes the connection, or if MaxConnTime elapses, the handler exits after telling
 		//   the Server to stop publishing events to it.
 
 		var readMainCh <-chan eventOrComment = eventCh
 		var readBatchCh <-chan Event
+		var replayTimer *time.Timer
+		var replayTimeoutCh <-chan time.Time
+		stopReplayTimer := func() {
+			if replayTimer != nil {
+				replayTimer.Stop()
+				replayTimer, replayTimeoutCh = nil, nil
+			}
+		}
+		defer stopReplayTimer()
+		var pendingEvents []Event
+		var coalesceTimer *time.Timer
+		var coalesceTimeoutCh <-chan time.Time
+		addPendingEvent := func(ev Event) {
+			for i, p := range pendingEvents {
+				if p.Id() == ev.Id() {
+					pendingEvents = append(pendingEvents[:i], pendingEvents[i+1:]...)
+					break
+				}
+			}
+			pendingEvents = append(pendingEvents, ev)
+			if coalesceTimer == nil {
+				coalesceTimer = time.NewTimer(srv.CoalesceWindow)
+				coalesceTimeoutCh = coalesceTimer.C
+			}
+		}
+		writePendingEvents := func() bool {
+			if coalesceTimer != nil {
+				coalesceTimer.Stop()
+				coalesceTimer, coalesceTimeoutCh = nil, nil
+			}
+			events := pendingEvents
+			pendingEvents = nil
+			for _, ev := range events {
+				if !writeEventOrComment(ev) {
+					return false
+				}
+			}
+			return true
+		}
+		defer func() {
+			if coalesceTimer != nil {
+				coalesceTimer.Stop()
+			}
+		}()
+		// Items that have been read from eventCh but not yet handled, so that higher-priority events can be
+		// handled first; see writeNextBacklogItems.
+		var backlog []eventOrComment
+		backlogLimit := cap(eventCh)
+		if backlogLimit < 1 {
+			backlogLimit = 1
+		}
+		addToBacklog := func(ev eventOrComment) {
+			backlog = append(backlog, ev)
+			atomic.AddInt32(&sub.held, 1)
+		}
+		takeFromBacklog := func(i int) eventOrComment {
+			item := backlog[i]
+			backlog = append(backlog[:i], backlog[i+1:]...)
+			atomic.AddInt32(&sub.held, -1)
+			if sub.handled != nil {
+				select {
+				case sub.handled <- struct{}{}:
+				default:
+				}
+			}
+			return item
+		}
+		mainClosed := false
+		readAvailableItems := func() {
+			for len(backlog) < backlogLimit && !mainClosed {
+				select {
+				case ev, ok := <-eventCh:
+					if !ok {
+						mainClosed = true
+						readMainCh = nil
+						return
+					}
+					if received(ev) {
+						addToBacklog(ev)
+					}
+				default:
+					return
+				}
+			}
+		}
+		handleMainItem := func(ev eventOrComment) bool {
+			if e, ok := ev.(Event); ok && srv.CoalesceWindow > 0 && e.Id() != "" {
+				addPendingEvent(e)
+				return true
+			}
+			if !writePendingEvents() {
+				return false
+			}
+			if batch, ok := ev.(eventBatch); ok {
+				readBatchCh = batch.events
+				readMainCh = nil
+				enc.deferFlush = true
+				if srv.MaxReplayDuration > 0 {
+					replayTimer = time.NewTimer(srv.MaxReplayDuration)
+					replayTimeoutCh = replayTimer.C
+				}
+				return true
+			}
+			return writeEventOrComment(ev)
+		}
+		// Handles backlog items, highest priority first, until the backlog is empty or we have switched to
+		// reading a batch. Returns false if the handler should exit.
+		writeNextBacklogItems := func() bool {
+			for readBatchCh == nil {
+				readAvailableItems()
+				if len(backlog) == 0 {
+					break
+				}
+				next := 0
+				for i, item := range backlog {
+					if isReorderBarrier(item) {
+						break
+					}
+					if priorityOf(item) > priorityOf(backlog[next]) {
+						next = i
+					}
+				}
+				if !handleMainItem(takeFromBacklog(next)) {
+					return false
+				}
+			}
+			return true
+		}
+		switchToMainChannel := func() {
+			readBatchCh = nil
+			enc.deferFlush = false
+			if !mainClosed {
+				readMainCh = eventCh
+			}
+		}
 		closedNormally := false
 		closeNotify := req.Context().Done()
 
@@ -165,41 +678,246 @@ func (srv *Server) Handler(channel string) http.HandlerFunc {
 			case <-maxConnTimeCh: // if MaxConnTime was not set, this is a nil channel and has no effect on the select
 				break ReadLoop
 			case ev, ok := <-readMainCh:
-				if !ok {
-					closedNormally = true
-					break ReadLoop
-				}
-				if batch, ok := ev.(eventBatch); ok {
-					readBatchCh = batch.events
+				if ok {
+					if received(ev) {
+						addToBacklog(ev)
+					}
+				} else {
+					mainClosed = true
 					readMainCh = nil
-				} else if !writeEventOrComment(ev) {
-					break ReadLoop
 				}
 			case ev, ok := <-readBatchCh:
 				if !ok { // end of batch
-					readBatchCh = nil
-					readMainCh = eventCh
-				} else if !writeEventOrComment(ev) {
+					flush()
+					switchToMainChannel()
+					stopReplayTimer()
+					break
+				}
+				if !encodeEventOrComment(ev) {
 					break ReadLoop
 				}
+			case <-flushCh: // if FlushInterval was not set, this is a nil channel
+				flushTimer, flushCh = nil, nil
+				flush()
+			case <-keepAliveCh: // if KeepAlive was not set, this is a nil channel
+				if !writeEventOrComment(comment{}) {
+					break ReadLoop
+				}
+			case <-coalesceTimeoutCh: // if CoalesceWindow was not set, this is a nil channel
+				if !writePendingEvents() {
+					break ReadLoop
+				}
+			case <-replayTimeoutCh: // if MaxReplayDuration was not set, this is a nil channel
+				replayTimer, replayTimeoutCh = nil, nil
+				if srv.Logger != nil {
+					srv.Logger.Printf("Replay for channel %s exceeded %s; switching to live events", channel, srv.MaxReplayDuration)
+				}
+				go func(ch <-chan Event) {
+					for range ch {
+					}
+				}(readBatchCh)
+				flush()
+				switchToMainChannel()
+				if srv.ReplayTimeoutComment != "" && !writeEventOrComment(comment{value: srv.ReplayTimeoutComment}) {
+					break ReadLoop
+				}
+			}
+			if mainClosed && srv.wasEvicted(sub) {
+				closedNormally = true // the server has already removed the subscription
+				break ReadLoop        // and anything still waiting to be sent is discarded
+			}
+			if !writeNextBacklogItems() {
+				break ReadLoop
+			}
+			if mainClosed && len(backlog) == 0 && readBatchCh == nil {
+				closedNormally = true
+				_ = writePendingEvents()
+				break ReadLoop
 			}
 		}
 		if !closedNormally {
 			srv.unsubs <- sub // the server didn't tell us to close, so we must tell it that we're closing
 		}
+		if readBatchCh != nil {
+			go func(ch <-chan Event) { // don't leave the Repository blocked on the rest of the batch
+				for range ch {
+				}
+			}(readBatchCh)
+		}
+	}
+}
+
+// FiniteHandler creates an HTTP handler that sends a fixed list of events and then ends the response, for
+// an endpoint that only provides a known set of events rather than a long-lived stream; clients will
+// normally reconnect after the response ends, unless the application tells them not to.
+//
+// The whole response is encoded before it is sent, so it has a Content-Length header instead of using
+// chunked encoding. It is not connected to any channel of the Server, so it is not affected by Publish
+// or by a Repository. The server.AllowCORS, server.Gzip, and server.ExtraResponseHeaders settings apply as
+// they do for Handler. If one of the events cannot be encoded, the handler logs the error with
+// server.Logger, if any, and responds with a 500 status.
+func (srv *Server) FiniteHandler(events []Event) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		srv.writeFiniteResponse(w, req, events)
+	}
+}
+
+// SnapshotHandler creates an HTTP handler for a snapshot endpoint that goes with the stream from
+// Handler(channel): it calls snapshot to get an event describing the current state, along with the ID of
+// the last event on the channel that the state includes, and sends that event with the ID as its "id:"
+// field. A client can then subscribe to the stream with that ID as its Last-Event-ID, and the channel's
+// Repository will replay any events that were published after the snapshot was taken.
+//
+// The snapshot function is called on the same goroutine that dispatches published events, so it does not
+// run concurrently with the delivery of an event to the channel's subscribers; it should return quickly,
+// since nothing can be published until it does. If the Server has been closed, the handler responds with
+// a 503 status. If snapshot returns a nil Event, meaning that there is no state to send, the handler
+// responds with a 204 status and no body. Otherwise the response is written as it is for FiniteHandler.
+func (srv *Server) SnapshotHandler(channel string, snapshot func() (Event, string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var ev Event
+		taken := false
+		srv.query(func(map[string]map[*subscription]struct{}) {
+			var id string
+			ev, id = snapshot()
+			if ev != nil {
+				ev = eventWithAssignedID{event: ev, id: id}
+			}
+			taken = true
+		})
+		if !taken {
+			http.Error(w, "Server is closed", http.StatusServiceUnavailable)
+			return
+		}
+		if ev == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		srv.writeFiniteResponse(w, req, []Event{ev})
 	}
 }
 
+func (srv *Server) writeFiniteResponse(w http.ResponseWriter, req *http.Request, events []Event) {
+	var body bytes.Buffer
+	enc := NewEncoder(&body, false)
+	for _, ev := range events {
+		if err := enc.Encode(ev); err != nil {
+			if srv.Logger != nil {
+				srv.Logger.Println(err)
+			}
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if setStreamHeaders(w, req, srv.AllowCORS, srv.Gzip, srv.ExtraResponseHeaders) {
+		var compressed bytes.Buffer
+		zw := gzip.NewWriter(&compressed)
+		_, _ = zw.Write(body.Bytes())
+		_ = zw.Close()
+		body = compressed
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body.Bytes())
+}
+
+// Sets the standard headers for an SSE response and writes the status, returning true if the response
+// should be compressed. This is shared by Server.Handler and ChannelHandler.
+func writeStreamHeaders(
+	w http.ResponseWriter,
+	req *http.Request,
+	allowCORS, allowGzip bool,
+	extraHeaders http.Header,
+) bool {
+	useGzip := setStreamHeaders(w, req, allowCORS, allowGzip, extraHeaders)
+	w.WriteHeader(http.StatusOK)
+	return useGzip
+}
+
+// Sets the standard headers for an SSE response, as writeStreamHeaders does, but does not write the status.
+func setStreamHeaders(
+	w http.ResponseWriter,
+	req *http.Request,
+	allowCORS, allowGzip bool,
+	extraHeaders http.Header,
+) bool {
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream; charset=utf-8")
+	h.Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	h.Set("Connection", "keep-alive")
+	if allowCORS {
+		h.Set("Access-Control-Allow-Origin", "*")
+	}
+	for name, values := range extraHeaders {
+		name = http.CanonicalHeaderKey(name)
+		if name == "Content-Type" || name == "Content-Encoding" {
+			continue
+		}
+		h[name] = append([]string(nil), values...)
+	}
+	useGzip := allowGzip && strings.Contains(req.Header.Get("Accept-Encoding"), "gzip")
+	if useGzip {
+		h.Set("Content-Encoding", "gzip")
+	}
+	return useGzip
+}
+
 // Register registers a Repository to be used for the specified channel. The Repository will be used to
 // determine whether new subscribers should receive data that was generated before they subscribed.
 //
 // Channels do not have to be registered unless you want to specify a Repository. An unregistered channel can
 // still be subscribed to with Handler, and published to with Publish.
 func (srv *Server) Register(channel string, repo Repository) {
-	srv.registrations <- &registration{
+	reg := &registration{
 		channel:    channel,
 		repository: repo,
 	}
+	if srv.AutoAssignIDs && repo != nil {
+		reg.lastAssignedID = lastNumericID(repo, channel)
+	}
+	srv.registrations <- reg
+}
+
+// ReplaceRepository is like Register, but it returns the Repository that was previously registered for
+// the channel (or nil if there was none), and it has no effect on the channel's subscribers. A nil repo
+// removes the channel's Repository without unregistering the channel. This can be used to switch to a
+// different source of history, for instance after a data migration.
+//
+// When ReplaceRepository returns, the new Repository is used for all subscriptions from then on. Existing
+// connections stay open and keep receiving published events. If a connection is still receiving events
+// from a replay that started before the change, it finishes that replay, so the previous Repository must
+// keep providing them until the channel that its Replay method returned is closed. If the server has been
+// closed, ReplaceRepository does nothing and returns nil.
+func (srv *Server) ReplaceRepository(channel string, repo Repository) Repository {
+	previousCh := make(chan Repository, 1)
+	reg := &registration{channel: channel, repository: repo, previousCh: previousCh}
+	if srv.AutoAssignIDs && repo != nil {
+		reg.lastAssignedID = lastNumericID(repo, channel)
+	}
+	select {
+	case srv.registrations <- reg:
+		return <-previousCh
+	case <-srv.runDone:
+		return nil
+	}
+}
+
+// SetSubscriptionFilter sets a function that Handler calls for each request, before the client is
+// subscribed to the channel, for instance to check authorization or to reject unknown channels. If it
+// returns false, the handler responds with the returned status (or 403 if the status is zero) and does
+// not start the stream. The filter may be called from many goroutines at once. Calling
+// SetSubscriptionFilter with nil removes the filter; the change applies to requests that arrive after
+// it is made.
+func (srv *Server) SetSubscriptionFilter(filter func(channel string, req *http.Request) (accept bool, status int)) {
+	srv.subFilterLock.Lock()
+	defer srv.subFilterLock.Unlock()
+	srv.subFilter = filter
+}
+
+func (srv *Server) getSubscriptionFilter() func(channel string, req *http.Request) (bool, int) {
+	srv.subFilterLock.RLock()
+	defer srv.subFilterLock.RUnlock()
+	return srv.subFilter
 }
 
 // Unregister removes a channel registration that was created by Register. If forceDisconnect is true, it also
@@ -216,7 +934,50 @@ func (srv *Server) Unregister(channel string, forceDisconnect bool) {
 	}
 }
 
+// DisconnectAll causes all currently active handlers for a channel to close their connections, as
+// Unregister does if forceDisconnect is true, but without removing the channel's Repository. This can be
+// used to make clients reconnect, for instance so that their credentials are checked again after a
+// credential rotation: a client that reconnects right away is subscribed as usual, and receives events
+// from the Repository starting after its Last-Event-ID. If the server has been closed, DisconnectAll does
+// nothing.
+func (srv *Server) DisconnectAll(channel string) {
+	select {
+	case srv.disconnects <- channel:
+	case <-srv.runDone:
+	}
+}
+
+// EnablePresence causes the server to publish a PresenceEvent on presenceChannel whenever a subscriber
+// joins or leaves channel. Applications can use this to show which clients are connected, by subscribing
+// to presenceChannel like any other channel. An empty presenceChannel turns this off again for channel.
+//
+// A subscriber leaves a channel when its connection is closed for any reason, or when the channel is
+// unregistered with Unregister. No events are published for subscribers that were already connected
+// when EnablePresence was called, or when the server is closed.
+func (srv *Server) EnablePresence(channel, presenceChannel string) {
+	srv.presenceRegs <- &presenceRegistration{
+		channel:         channel,
+		presenceChannel: presenceChannel,
+	}
+}
+
 // Publish publishes an event to one or more channels.
+//
+// If server.AutoAssignIDs is true, and the event's ID is empty, the server gives it an ID before sending
+// it: a decimal number that increases by 1 for each such event in a channel. The number is padded with
+// zeroes to 20 digits, such as "00000000000000000001", so that the IDs sort correctly as strings, as
+// SliceRepository requires. An event that is published to several channels gets a separate ID for each.
+//
+// If a Repository has been registered for the channel, and it has an Add(channel string, event Event)
+// method, as all of this package's Repository types do, the event is also added to the Repository with its
+// new ID, so that it can be replayed; the application should not add such events itself. The numbering
+// continues from the largest decimal ID that the Repository already had when it was registered, so
+// AutoAssignIDs must be set before calling Register. To find that ID, Register and ReplaceRepository
+// replay the channel's whole history from the Repository before they return, which can be slow for a large
+// Repository. The events are added by a separate goroutine, in the order they were published, so that a
+// Repository that is busy cannot hold up the server; a client that subscribes in the meantime is not sent
+// its replayed events until the Repository has all of the events that were published before.
+// PublishWithAcknowledgment does not signal until the event has been added.
 func (srv *Server) Publish(channels []string, ev Event) {
 	srv.pub <- &outbound{
 		channels:       channels,
@@ -242,6 +1003,33 @@ func (srv *Server) PublishWithAcknowledgment(channels []string, ev Event) <-chan
 	return ackCh
 }
 
+// PublishOrdered publishes an event to one or more channels, using a caller-assigned sequence number to
+// guarantee the order of delivery.
+//
+// When Publish is called from several goroutines, the order in which the events reach the server is not
+// deterministic. PublishOrdered instead delivers events in order of their sequence numbers, which must
+// start at 1 and increase by 1 for each call; an atomic counter is a convenient way to generate them.
+// If an event arrives before the ones preceding it, the server holds it until the missing events have
+// been published. If OrderedPublishTimeout is set and a missing sequence number has not arrived within
+// that time, the server gives up on it and continues with the next available event. An event whose
+// sequence number has already been passed is discarded.
+//
+// Whether or not OrderedPublishTimeout is set, the server holds at most 10000 events while waiting for a
+// missing sequence number. If another one arrives, the server logs a warning with server.Logger, if any,
+// and gives up on the missing sequence number as if the timeout had elapsed, so a sequence number that
+// never arrives cannot make it keep events forever.
+//
+// The sequence is shared by all channels on the Server. Events published with Publish are not affected
+// by it, and are delivered as soon as they are received.
+func (srv *Server) PublishOrdered(seq uint64, channels []string, ev Event) {
+	srv.pub <- &outbound{
+		channels:       channels,
+		eventOrComment: ev,
+		ordered:        true,
+		seq:            seq,
+	}
+}
+
 // PublishComment publishes a comment to one or more channels.
 func (srv *Server) PublishComment(channels []string, text string) {
 	srv.pub <- &outbound{
@@ -250,53 +1038,378 @@ func (srv *Server) PublishComment(channels []string, text string) {
 	}
 }
 
+// PublishToAll publishes an event to every channel that currently has subscribers, such as an
+// administrative message that all clients should see. Unlike calling Publish with the result of Channels,
+// this cannot miss a channel that gets its first subscriber in between. Each subscriber receives the event
+// only once, even if it is subscribed to several channels.
+func (srv *Server) PublishToAll(ev Event) {
+	srv.pub <- &outbound{
+		eventOrComment: ev,
+		allChannels:    true,
+	}
+}
+
+// PublishCommentToAll publishes a comment to every channel that currently has subscribers, as
+// PublishToAll does for an event.
+func (srv *Server) PublishCommentToAll(text string) {
+	srv.pub <- &outbound{
+		eventOrComment: comment{value: text},
+		allChannels:    true,
+	}
+}
+
+// SubscriberCount returns the number of clients that are currently subscribed to a channel. It returns
+// zero if the server has been closed.
+func (srv *Server) SubscriberCount(channel string) int {
+	count := 0
+	srv.query(func(subs map[string]map[*subscription]struct{}) {
+		count = len(subs[channel])
+	})
+	return count
+}
+
+// Channels returns the names of all channels that currently have at least one subscriber, in
+// alphabetical order. It returns nil if the server has been closed.
+func (srv *Server) Channels() []string {
+	var channels []string
+	srv.query(func(subs map[string]map[*subscription]struct{}) {
+		for c, channelSubs := range subs {
+			if len(channelSubs) > 0 {
+				channels = append(channels, c)
+			}
+		}
+	})
+	sort.Strings(channels)
+	return channels
+}
+
+// Runs a function on the Server.run() goroutine, so that it can safely read the server's state, and waits
+// for it to finish. If the server has been closed, the function is not called.
+func (srv *Server) query(fn func(subs map[string]map[*subscription]struct{})) {
+	doneCh := make(chan struct{})
+	select {
+	case srv.queries <- func(subs map[string]map[*subscription]struct{}) {
+		fn(subs)
+		close(doneCh)
+	}:
+		<-doneCh
+	case <-srv.runDone:
+	}
+}
+
 func (srv *Server) run() {
+	defer close(srv.runDone)
 	// All access to the subs and repos maps is done from the same goroutine, so modifications are safe.
 	subs := make(map[string]map[*subscription]struct{})
 	repos := make(map[string]Repository)
-	trySend := func(sub *subscription, ec eventOrComment) {
-		if !sub.send(ec) {
-			sub.close()
+	presenceChannels := make(map[string]string)
+	lastAssignedIDs := make(map[string]uint64) // used only if AutoAssignIDs is set
+	// Calls to repositories that must happen in order, but that might block, are queued here and made by a
+	// separate goroutine, so that they cannot hold up the server. This is used only if AutoAssignIDs is set.
+	var repoTasks []func()
+	var repoTaskCh chan func()       // created when the first task is queued
+	var nextRepoTaskCh chan<- func() // same as repoTaskCh if repoTasks is not empty, otherwise nil
+	var nextRepoTask func()          // the first item in repoTasks, if any
+	enqueueRepositoryTask := func(task func()) {
+		if repoTaskCh == nil {
+			repoTaskCh = make(chan func())
+			go func(ch <-chan func()) {
+				for task := range ch {
+					task()
+				}
+			}(repoTaskCh)
+		}
+		repoTasks = append(repoTasks, task)
+		nextRepoTaskCh, nextRepoTask = repoTaskCh, repoTasks[0]
+	}
+	// Returns the item to publish to a channel, assigning an ID to it first if necessary. The second
+	// return value is true if the item is being added to the channel's Repository.
+	itemForChannel := func(pub *outbound, channel string) (eventOrComment, bool) {
+		e, ok := pub.eventOrComment.(Event)
+		if !srv.AutoAssignIDs || !ok || e.Id() != "" {
+			return pub.eventOrComment, false
+		}
+		lastAssignedIDs[channel]++
+		e = eventWithAssignedID{event: e, id: formatAssignedID(lastAssignedIDs[channel])}
+		if repo, ok := repos[channel].(repositoryWithAdd); ok {
+			enqueueRepositoryTask(func() { repo.Add(channel, e) })
+			return e, true
+		}
+		return e, false
+	}
+	acknowledge := func(ackCh chan<- struct{}) {
+		select {
+		// It shouldn't be possible for this channel to block since it is created for a single use, but
+		// we'll do a non-blocking push just to be safe
+		case ackCh <- struct{}{}:
+		default:
+		}
+	}
+	nextConnectionID := 0
+	var publish func(pub *outbound)
+	publishPresence := func(sub *subscription, joined bool) {
+		if presenceChannel, ok := presenceChannels[sub.channel]; ok {
+			publish(&outbound{
+				channels: []string{presenceChannel},
+				eventOrComment: PresenceEvent{
+					Joined:       joined,
+					Channel:      sub.channel,
+					ConnectionID: sub.connectionID,
+					RemoteAddr:   sub.remoteAddr,
+				},
+			})
+		}
+	}
+	removeSub := func(sub *subscription) {
+		if _, ok := subs[sub.channel][sub]; ok {
 			delete(subs[sub.channel], sub)
+			if srv.MaxTotalBufferedBytes > 0 {
+				srv.releaseBufferedBytes(sub)
+			}
+			publishPresence(sub, false)
+		}
+	}
+	trySend := func(sub *subscription, ec eventOrComment) {
+		if !sub.send(ec) { // send has already closed the subscription's channel
+			removeSub(sub)
+		}
+	}
+	publish = func(pub *outbound) {
+		channels := pub.channels
+		if pub.allChannels {
+			channels = nil
+			for c := range subs {
+				channels = append(channels, c)
+			}
+		}
+		// A subscription should receive each published item only once, even if it is listed under more
+		// than one of the channels (or if the same channel was specified twice).
+		var delivered map[*subscription]struct{}
+		var seenChannels map[string]struct{}
+		addedToRepository := false
+		if len(channels) > 1 {
+			delivered = make(map[*subscription]struct{})
+			seenChannels = make(map[string]struct{})
+		}
+		for _, c := range channels {
+			if seenChannels != nil {
+				if _, ok := seenChannels[c]; ok {
+					continue
+				}
+				seenChannels[c] = struct{}{}
+			}
+			if srv.OnUnknownChannel != nil && len(subs[c]) == 0 && !pub.allChannels {
+				if _, ok := repos[c]; !ok {
+					srv.OnUnknownChannel(c)
+				}
+			}
+			item, added := itemForChannel(pub, c)
+			addedToRepository = addedToRepository || added
+			for s := range subs[c] {
+				if delivered != nil {
+					if _, ok := delivered[s]; ok {
+						continue
+					}
+					delivered[s] = struct{}{}
+				}
+				trySend(s, item)
+				if srv.MaxTotalBufferedBytes > 0 && s.out != nil {
+					srv.updateBufferedBytes(s, estimatedSize(item))
+				}
+			}
+		}
+		if srv.MaxTotalBufferedBytes > 0 {
+			for _, s := range srv.evictSubscribersOverBufferLimit(subs) {
+				removeSub(s)
+			}
+		}
+		if pub.ackCh != nil {
+			if addedToRepository {
+				ackCh := pub.ackCh
+				enqueueRepositoryTask(func() { acknowledge(ackCh) })
+			} else {
+				acknowledge(pub.ackCh)
+			}
 		}
 	}
+	// State for PublishOrdered: events that arrived ahead of their turn are held in pendingOrdered.
+	nextSeq := uint64(1)
+	pendingOrdered := make(map[uint64]*outbound)
+	var orderedTimer *time.Timer
+	var orderedTimeoutCh <-chan time.Time
+	publishPendingOrdered := func() {
+		for {
+			pub, ok := pendingOrdered[nextSeq]
+			if !ok {
+				break
+			}
+			delete(pendingOrdered, nextSeq)
+			publish(pub)
+			nextSeq++
+		}
+		// (re)start the timer for the next gap, if any
+		if orderedTimer != nil {
+			orderedTimer.Stop()
+			orderedTimer, orderedTimeoutCh = nil, nil
+		}
+		if len(pendingOrdered) > 0 && srv.OrderedPublishTimeout > 0 {
+			orderedTimer = time.NewTimer(srv.OrderedPublishTimeout)
+			orderedTimeoutCh = orderedTimer.C
+		}
+	}
+	// Gives up on the missing event(s) and skips ahead to the lowest sequence number that we do have.
+	skipMissingOrdered := func() {
+		var lowest uint64
+		for seq := range pendingOrdered {
+			if lowest == 0 || seq < lowest {
+				lowest = seq
+			}
+		}
+		nextSeq = lowest
+		publishPendingOrdered()
+	}
+	// These are used only if RepositoryCompactInterval is set. The ticker is started when the first
+	// Repository is registered, since the field may not have been set yet when the Server was created.
+	var compactTicker *time.Ticker
+	var compactCh <-chan time.Time
+	var compactDone chan struct{} // non-nil while a compaction is in progress
+	compactRepositories := func() {
+		if compactDone != nil {
+			return // the previous compaction has not finished yet
+		}
+		var compactables []Compactable
+		seen := make(map[Repository]struct{}) // the same Repository may be registered for several channels
+		for _, repo := range repos {
+			c, ok := repo.(Compactable)
+			if !ok {
+				continue
+			}
+			if reflect.TypeOf(repo).Comparable() {
+				if _, ok := seen[repo]; ok {
+					continue
+				}
+				seen[repo] = struct{}{}
+			}
+			compactables = append(compactables, c)
+		}
+		if len(compactables) == 0 {
+			return
+		}
+		done := make(chan struct{})
+		compactDone = done
+		go func() {
+			defer close(done)
+			for _, c := range compactables {
+				c.Compact()
+			}
+		}()
+	}
 	for {
 		select {
 		case reg := <-srv.registrations:
-			repos[reg.channel] = reg.repository
+			if reg.previousCh != nil {
+				reg.previousCh <- repos[reg.channel]
+			}
+			if reg.repository == nil {
+				delete(repos, reg.channel)
+			} else {
+				repos[reg.channel] = reg.repository
+				if reg.lastAssignedID > lastAssignedIDs[reg.channel] {
+					lastAssignedIDs[reg.channel] = reg.lastAssignedID
+				}
+				if compactTicker == nil && srv.RepositoryCompactInterval > 0 {
+					compactTicker = time.NewTicker(srv.RepositoryCompactInterval)
+					defer compactTicker.Stop()
+					compactCh = compactTicker.C
+				}
+			}
+		case nextRepoTaskCh <- nextRepoTask:
+			repoTasks[0] = nil
+			repoTasks = repoTasks[1:]
+			if len(repoTasks) == 0 {
+				nextRepoTaskCh, nextRepoTask = nil, nil
+			} else {
+				nextRepoTask = repoTasks[0]
+			}
+		case <-compactCh:
+			compactRepositories()
+		case <-compactDone:
+			compactDone = nil
 		case unreg := <-srv.unregistrations:
 			delete(repos, unreg.channel)
 			previousSubs := subs[unreg.channel]
 			delete(subs, unreg.channel)
-			if unreg.forceDisconnect {
-				for s := range previousSubs {
+			for s := range previousSubs {
+				if unreg.forceDisconnect {
 					s.close()
 				}
+				if srv.MaxTotalBufferedBytes > 0 {
+					srv.releaseBufferedBytes(s)
+				}
+				publishPresence(s, false)
+			}
+		case channel := <-srv.disconnects:
+			for s := range subs[channel] {
+				s.close()
+				removeSub(s)
+			}
+		case preg := <-srv.presenceRegs:
+			if preg.presenceChannel == "" {
+				delete(presenceChannels, preg.channel)
+			} else {
+				presenceChannels[preg.channel] = preg.presenceChannel
 			}
 		case sub := <-srv.unsubs:
-			delete(subs[sub.channel], sub)
+			removeSub(sub)
+		case fn := <-srv.queries:
+			fn(subs)
 		case pub := <-srv.pub:
-			for _, c := range pub.channels {
-				for s := range subs[c] {
-					trySend(s, pub.eventOrComment)
+			if !pub.ordered {
+				publish(pub)
+				break
+			}
+			if pub.seq < nextSeq {
+				if srv.Logger != nil {
+					srv.Logger.Printf("Discarding event with sequence number %d, which is out of order", pub.seq)
 				}
+				break
 			}
-			if pub.ackCh != nil {
-				select {
-				// It shouldn't be possible for this channel to block since it is created for a single use, but
-				// we'll do a non-blocking push just to be safe
-				case pub.ackCh <- struct{}{}:
-				default:
+			pendingOrdered[pub.seq] = pub
+			if pub.seq != nextSeq && len(pendingOrdered) > maxPendingOrdered {
+				if srv.Logger != nil {
+					srv.Logger.Printf("Skipping missing sequence number %d, since more than %d later events are waiting for it",
+						nextSeq, maxPendingOrdered)
 				}
+				skipMissingOrdered()
+			} else if pub.seq == nextSeq || orderedTimer == nil {
+				publishPendingOrdered()
 			}
+		case <-orderedTimeoutCh:
+			orderedTimer, orderedTimeoutCh = nil, nil
+			skipMissingOrdered()
 		case sub := <-srv.subs:
 			if _, ok := subs[sub.channel]; !ok {
 				subs[sub.channel] = make(map[*subscription]struct{})
 			}
 			subs[sub.channel][sub] = struct{}{}
-			if srv.ReplayAll || len(sub.lastEventID) > 0 {
+			nextConnectionID++
+			sub.connectionID = strconv.Itoa(nextConnectionID)
+			publishPresence(sub, true)
+			if srv.ReplayAll || sub.replayAll || len(sub.lastEventID) > 0 {
 				repo, ok := repos[sub.channel]
-				if ok {
+				if _, hasAdd := repo.(repositoryWithAdd); ok && hasAdd && srv.AutoAssignIDs {
+					// The Repository may not have all of the published events yet, so the replay has to wait
+					// until the tasks that add them are done; until then, the handler waits for the batch.
+					batchCh := make(chan Event)
+					if !sub.send(eventBatch{events: batchCh}) {
+						removeSub(sub)
+					} else {
+						channel, lastEventID := sub.channel, sub.lastEventID
+						enqueueRepositoryTask(func() {
+							go forwardReplay(repo.Replay(channel, lastEventID), batchCh)
+						})
+					}
+				} else if ok {
 					batchCh := repo.Replay(sub.channel, sub.lastEventID)
 					if batchCh != nil {
 						trySend(sub, eventBatch{events: batchCh})
@@ -304,6 +1417,17 @@ func (srv *Server) run() {
 				}
 			}
 		case <-srv.quit:
+			if orderedTimer != nil {
+				orderedTimer.Stop()
+			}
+			if repoTaskCh != nil {
+				go func(tasks []func(), ch chan<- func()) {
+					for _, task := range tasks {
+						ch <- task
+					}
+					close(ch)
+				}(repoTasks, repoTaskCh)
+			}
 			for _, sub := range subs {
 				for s := range sub {
 					s.close()
@@ -314,10 +1438,148 @@ func (srv *Server) run() {
 	}
 }
 
-func (srv *Server) isServerClosed() bool {
+// Copies the events from a Repository's Replay channel, which may be nil, to a batch channel that was
+// given to a handler before Replay was called, and then closes the batch channel.
+func forwardReplay(events <-chan Event, batchCh chan<- Event) {
+	defer close(batchCh)
+	if events == nil {
+		return
+	}
+	for e := range events {
+		batchCh <- e
+	}
+}
+
+// Adjusts the number of bytes that are waiting to be sent to a subscriber. Returns false if the
+// subscriber has been evicted.
+func (srv *Server) updateBufferedBytes(sub *subscription, delta int64) bool {
+	srv.bufferLock.Lock()
+	defer srv.bufferLock.Unlock()
+	if sub.evicted {
+		return false
+	}
+	if sub.removed {
+		return true // releaseBufferedBytes has already subtracted everything that was waiting
+	}
+	sub.bufferedBytes += delta
+	srv.bufferedTotal += delta
+	return true
+}
+
+// Subtracts whatever is still waiting to be sent to a subscriber from the total, when the server removes
+// the subscription. The handler may have exited without reading those items, so otherwise they would
+// count toward MaxTotalBufferedBytes forever.
+//
+// This should be called only from the Server.run() goroutine.
+func (srv *Server) releaseBufferedBytes(sub *subscription) {
+	srv.bufferLock.Lock()
+	defer srv.bufferLock.Unlock()
+	srv.bufferedTotal -= sub.bufferedBytes
+	sub.bufferedBytes = 0
+	sub.removed = true
+}
+
+func (srv *Server) wasEvicted(sub *subscription) bool {
+	srv.bufferLock.Lock()
+	defer srv.bufferLock.Unlock()
+	return sub.evicted
+}
+
+// Disconnects the subscribers that have the most data waiting to be sent, until the total is no greater
+// than MaxTotalBufferedBytes. Returns the subscriptions that were disconnected; the caller is responsible
+// for removing them.
+//
+// This should be called only from the Server.run() goroutine.
+func (srv *Server) evictSubscribersOverBufferLimit(subs map[string]map[*subscription]struct{}) []*subscription {
+	srv.bufferLock.Lock()
+	if srv.bufferedTotal <= srv.MaxTotalBufferedBytes {
+		srv.bufferLock.Unlock()
+		return nil
+	}
+	var all []*subscription
+	for _, channelSubs := range subs {
+		for s := range channelSubs {
+			all = append(all, s)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].bufferedBytes > all[j].bufferedBytes })
+	var evicted []*subscription
+	for _, s := range all {
+		if srv.bufferedTotal <= srv.MaxTotalBufferedBytes {
+			break
+		}
+		srv.bufferedTotal -= s.bufferedBytes
+		s.bufferedBytes = 0
+		s.evicted = true
+		evicted = append(evicted, s)
+	}
+	srv.bufferLock.Unlock()
+	for _, s := range evicted {
+		if srv.Logger != nil {
+			srv.Logger.Printf("Disconnecting a subscriber to channel %s to stay within MaxTotalBufferedBytes", s.channel)
+		}
+		s.close()
+	}
+	return evicted
+}
+
+// Returns an approximate number of bytes used by an event or comment.
+func estimatedSize(ec eventOrComment) int64 {
+	switch item := ec.(type) {
+	case Event:
+		return int64(len(item.Id()) + len(item.Event()) + len(item.Data()))
+	case comment:
+		return int64(len(item.value))
+	default:
+		return 0
+	}
+}
+
+// Increments the number of active connections for a client IP, unless that would exceed
+// MaxConnectionsPerIP. Returns false if the connection should be rejected.
+func (srv *Server) addConnectionForIP(ip string) bool {
+	srv.connsPerIPLock.Lock()
+	defer srv.connsPerIPLock.Unlock()
+	if srv.connsPerIP[ip] >= srv.MaxConnectionsPerIP {
+		return false
+	}
+	if srv.connsPerIP == nil {
+		srv.connsPerIP = make(map[string]int)
+	}
+	srv.connsPerIP[ip]++
+	return true
+}
+
+func (srv *Server) removeConnectionForIP(ip string) {
+	srv.connsPerIPLock.Lock()
+	defer srv.connsPerIPLock.Unlock()
+	if srv.connsPerIP[ip] <= 1 {
+		delete(srv.connsPerIP, ip)
+	} else {
+		srv.connsPerIP[ip]--
+	}
+}
+
+// Returns the IP address part of the request's RemoteAddr.
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// Returns false if the server is closed; otherwise, adds the current handler to activeHandlers. This is
+// done while holding the lock so that CloseGracefully can safely wait for activeHandlers after the server
+// has been marked as closed.
+func (srv *Server) addActiveHandler() bool {
 	srv.isClosedMutex.RLock()
 	defer srv.isClosedMutex.RUnlock()
-	return srv.isClosed
+	if srv.isClosed {
+		return false
+	}
+	srv.activeHandlers.Add(1)
+	return true
 }
 
 func (srv *Server) markServerClosed() {
@@ -326,6 +1588,113 @@ func (srv *Server) markServerClosed() {
 	srv.isClosed = true
 }
 
+// Returns the priority of an event that implements EventWithPriority, or zero for anything else.
+func priorityOf(ec eventOrComment) int {
+	if e, ok := ec.(EventWithPriority); ok {
+		return e.Priority()
+	}
+	return 0
+}
+
+// Returns true if the handler must not reorder other items across this one: a batch of replayed events,
+// or an event with an ID, since the client tracks its position in the stream by the last ID it received.
+func isReorderBarrier(ec eventOrComment) bool {
+	switch e := ec.(type) {
+	case eventBatch:
+		return true
+	case Event:
+		return e.Id() != ""
+	}
+	return false
+}
+
+// Returns true if ch has room for another item for this subscription, counting the items that the handler
+// has already taken from ch but not yet handled.
+func (s *subscription) hasRoom(ch chan<- eventOrComment) bool {
+	held := int(atomic.LoadInt32(&s.held))
+	return held == 0 || held+len(ch) < cap(ch)
+}
+
+// Forwards items from the channel that the server writes to (inCh) to the channel that the handler reads
+// from (outCh), when SendGracePeriod is set. If the handler does not take an item within SendGracePeriod,
+// the subscriber is disconnected: outCh is closed, so the handler will exit after writing what it already
+// has, and the server is told to remove the subscription.
+//
+// When the server closes inCh, the remaining items are forwarded and then outCh is closed.
+func (srv *Server) forwardWithGracePeriod(
+	sub *subscription,
+	inCh <-chan eventOrComment,
+	outCh chan<- eventOrComment,
+	handlerDone <-chan struct{},
+) {
+	outClosed := false
+	defer func() {
+		if !outClosed {
+			close(outCh)
+		}
+	}()
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	for {
+		var item eventOrComment
+		var ok bool
+		select {
+		case item, ok = <-inCh:
+			if !ok {
+				return
+			}
+		case <-handlerDone:
+			return
+		}
+		if sub.hasRoom(outCh) {
+			select {
+			case outCh <- item:
+				continue
+			default:
+			}
+		}
+		if timer == nil {
+			timer = time.NewTimer(srv.SendGracePeriod)
+		} else {
+			timer.Reset(srv.SendGracePeriod)
+		}
+	Wait:
+		for {
+			var sendCh chan<- eventOrComment
+			if sub.hasRoom(outCh) { // if the handler's backlog is full, wait until it handles something
+				sendCh = outCh
+			}
+			select {
+			case sendCh <- item:
+				if !timer.Stop() {
+					<-timer.C
+				}
+				break Wait
+			case <-sub.handled:
+			case <-timer.C:
+				if srv.Logger != nil {
+					srv.Logger.Printf("Disconnecting a subscriber to channel %s after SendGracePeriod elapsed", sub.channel)
+				}
+				close(outCh) // closing this first lets the handler exit even if the server is no longer running
+				outClosed = true
+				// The handler sees the closed channel as the server ending the subscription, so it will not
+				// unsubscribe by itself; this must be done even if the handler has already exited.
+				select {
+				case srv.unsubs <- sub:
+				case <-srv.runDone:
+				}
+				return
+			case <-handlerDone:
+				return
+			}
+		}
+	}
+}
+
 // Attempts to send an event or comment to the subscription's channel.
 //
 // We do not want to block the main Server goroutine, so this is a non-blocking send. If it fails,
@@ -338,6 +1707,10 @@ func (s *subscription) send(e eventOrComment) bool {
 	if s.out == nil {
 		return true
 	}
+	if s.handled == nil && !s.hasRoom(s.out) { // the handler's backlog counts toward BufferSize
+		s.close()
+		return false
+	}
 	select {
 	case s.out <- e:
 		return true
@@ -1,10 +1,20 @@
 package eventsource
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -170,6 +180,43 @@ func TestServerHandlerCanReceiveEventsFromRepository(t *testing.T) {
 		assert.Equal(t, "id: replayed-from-some-id\ndata: example\n\n", string(body))
 	})
 
+	t.Run("all events are replayed if client requests it and AllowClientReplayRequest is true", func(t *testing.T) {
+		server := NewServer()
+		server.AllowClientReplayRequest = true
+		server.Register(channel, repo)
+
+		httpServer := httptest.NewServer(server.Handler(channel))
+		defer httpServer.Close()
+
+		resp, err := http.Get(httpServer.URL + "?replay=all")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		server.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "id: replayed-from-start\ndata: example\n\n", string(body))
+	})
+
+	t.Run("client request for replay is ignored if AllowClientReplayRequest is false", func(t *testing.T) {
+		server := NewServer()
+		server.Register(channel, repo)
+
+		httpServer := httptest.NewServer(server.Handler(channel))
+		defer httpServer.Close()
+
+		resp, err := http.Get(httpServer.URL + "?replay=all")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		server.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Len(t, body, 0)
+	})
+
 	t.Run("repository is no longer used after being unregistered", func(t *testing.T) {
 		server := NewServer()
 		server.ReplayAll = true
@@ -227,6 +274,41 @@ func TestServerCanDisconnectClientsWhenUnregisteringRepository(t *testing.T) {
 	assert.Equal(t, expected, string(body2))
 }
 
+func TestServerCanDisconnectClientsWithoutUnregisteringRepository(t *testing.T) {
+	channel := "test"
+	event1, event2 := &publication{id: "1", data: "a"}, &publication{id: "2", data: "b"}
+	repo := NewSliceRepositoryFromEvents(channel, []Event{event1})
+	server := NewServer()
+	server.Register(channel, repo)
+
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+
+	resp1, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp1.Body.Close()
+
+	repo.Add(channel, event2)
+	<-server.PublishWithAcknowledgment([]string{channel}, event2)
+	server.DisconnectAll(channel)
+	assert.Equal(t, 0, server.SubscriberCount(channel))
+
+	body1, err := ioutil.ReadAll(resp1.Body) // the server has ended the response
+	require.NoError(t, err)
+	assert.Equal(t, "id: 2\ndata: b\n\n", string(body1))
+
+	req, _ := http.NewRequest("GET", httpServer.URL, nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resp2, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp2.Body.Close()
+
+	server.Close()
+	body2, err := ioutil.ReadAll(resp2.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "id: 1\ndata: a\n\nid: 2\ndata: b\n\n", string(body2)) // the Repository is still used
+}
+
 func TestServerHandlerHasNoMaxConnectionTimeByDefault(t *testing.T) {
 	server := NewServer()
 	defer server.Close()
@@ -314,3 +396,1391 @@ func TestServerHandlerExitsIfClientClosesConnection(t *testing.T) {
 		require.Fail(t, "timed out waiting for handler to end")
 	}
 }
+
+func TestServerPublishOrderedDeliversEventsInSequenceOrder(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	server.PublishOrdered(3, []string{channel}, &publication{data: "my-event3"})
+	server.PublishOrdered(1, []string{channel}, &publication{data: "my-event1"})
+	server.PublishOrdered(2, []string{channel}, &publication{data: "my-event2"})
+	server.PublishOrdered(1, []string{channel}, &publication{data: "my-event1-again"}) // already passed, so it's discarded
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: "my-event4"})
+	server.Close()
+
+	expected := "data: my-event1\n\ndata: my-event2\n\ndata: my-event3\n\ndata: my-event4\n\n"
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, expected, string(body))
+}
+
+func TestServerPublishOrderedSkipsMissingEventAfterTimeout(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	server.OrderedPublishTimeout = time.Millisecond * 50
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	server.PublishOrdered(3, []string{channel}, &publication{data: "my-event3"})
+	server.PublishOrdered(2, []string{channel}, &publication{data: "my-event2"})
+	time.Sleep(time.Millisecond * 200)
+	server.PublishOrdered(1, []string{channel}, &publication{data: "my-event1"}) // too late, so it's discarded
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: "my-event4"})
+	server.Close()
+
+	expected := "data: my-event2\n\ndata: my-event3\n\ndata: my-event4\n\n"
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, expected, string(body))
+}
+
+func TestServerPublishOrderedSkipsMissingEventWhenTooManyEventsAreWaiting(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	server.BufferSize = maxPendingOrdered + 10
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var expected bytes.Buffer
+	for seq := uint64(2); seq <= maxPendingOrdered+2; seq++ {
+		server.PublishOrdered(seq, []string{channel}, &publication{data: fmt.Sprint(seq)})
+		fmt.Fprintf(&expected, "data: %d\n\n", seq)
+	}
+	server.PublishOrdered(1, []string{channel}, &publication{data: "1"}) // too late, so it's discarded
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: "end"})
+	server.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, expected.String()+"data: end\n\n", string(body))
+}
+
+func TestServerHandlerAddsExtraResponseHeaders(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	server.AllowCORS = true
+	server.Gzip = true
+	server.ExtraResponseHeaders = http.Header{
+		"X-Content-Type-Options":  []string{"nosniff"},
+		"Content-Security-Policy": []string{"default-src 'none'"},
+		"cache-control":           []string{"no-cache"},
+		"Content-Type":            []string{"text/html"},
+		"Content-Encoding":        []string{"identity"},
+	}
+	httpServer := httptest.NewServer(server.Handler("test"))
+	defer httpServer.Close()
+
+	req, _ := http.NewRequest("GET", httpServer.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, "nosniff", resp.Header.Get("X-Content-Type-Options"))
+	assert.Equal(t, "default-src 'none'", resp.Header.Get("Content-Security-Policy"))
+	assert.Equal(t, "no-cache", resp.Header.Get("Cache-Control"))                        // extra header overrides default
+	assert.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"))                 // default is retained
+	assert.Equal(t, "text/event-stream; charset=utf-8", resp.Header.Get("Content-Type")) // cannot be overridden
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))                         // cannot be overridden
+}
+
+type slowServerRepository struct {
+	events []Event
+	delay  time.Duration
+}
+
+func (r *slowServerRepository) Replay(channel, id string) chan Event {
+	out := make(chan Event)
+	go func() {
+		defer close(out)
+		for _, e := range r.events {
+			time.Sleep(r.delay)
+			out <- e
+		}
+	}()
+	return out
+}
+
+func TestServerHandlerCanLimitReplayDuration(t *testing.T) {
+	channel := "test"
+	repo := &slowServerRepository{
+		events: []Event{&publication{id: "1", data: "replayed1"}, &publication{id: "2", data: "replayed2"}},
+		delay:  time.Millisecond * 100,
+	}
+	server := NewServer()
+	server.ReplayAll = true
+	server.MaxReplayDuration = time.Millisecond * 150
+	server.ReplayTimeoutComment = "replay-truncated"
+	server.Register(channel, repo)
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	time.Sleep(time.Millisecond * 300)
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: "live"})
+	server.Close()
+
+	expected := "id: 1\ndata: replayed1\n\n:replay-truncated\ndata: live\n\n"
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, expected, string(body))
+}
+
+func TestServerHandlerCanCoalesceEventsWithSameID(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	server.CoalesceWindow = time.Millisecond * 100
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	server.Publish([]string{channel}, &publication{id: "a", data: "a1"})
+	server.Publish([]string{channel}, &publication{id: "b", data: "b1"})
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{id: "a", data: "a2"})
+	time.Sleep(time.Millisecond * 200)
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{id: "a", data: "a3"})
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: "no-id"})
+	server.Close()
+
+	// a1 is replaced by a2; a3 is written as soon as the next event without an ID arrives
+	expected := "id: b\ndata: b1\n\nid: a\ndata: a2\n\nid: a\ndata: a3\n\ndata: no-id\n\n"
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, expected, string(body))
+}
+
+type failingResponseWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w failingResponseWriter) Write([]byte) (int, error) {
+	return 0, errors.New("sorry")
+}
+
+func (w failingResponseWriter) WriteString(string) (int, error) {
+	return 0, errors.New("sorry")
+}
+
+func TestServerHandlerCallsOnEncodeError(t *testing.T) {
+	type encodeError struct {
+		channel string
+		meta    interface{}
+		err     error
+	}
+	channel := "test"
+	server := NewServer()
+	defer server.Close()
+	errorsCh := make(chan encodeError, 1)
+	server.OnEncodeError = func(channel string, meta interface{}, err error) {
+		errorsCh <- encodeError{channel, meta, err}
+	}
+
+	handlerDone := make(chan struct{})
+	go func() {
+		defer close(handlerDone)
+		w := failingResponseWriter{httptest.NewRecorder()}
+		server.Handler(channel)(w, httptest.NewRequest("GET", "/", nil))
+	}()
+
+	event := &publication{data: "my-event"}
+	for {
+		<-server.PublishWithAcknowledgment([]string{channel}, event)
+		select {
+		case e := <-errorsCh:
+			assert.Equal(t, channel, e.channel)
+			assert.Equal(t, event, e.meta)
+			assert.EqualError(t, e.err, "eventsource encode: sorry")
+			<-handlerDone
+			return
+		case <-time.After(time.Millisecond * 10): // handler might not have subscribed yet
+		}
+	}
+}
+
+type testPriorityEvent struct {
+	data     string
+	priority int
+}
+
+func (e *testPriorityEvent) Id() string    { return "" }
+func (e *testPriorityEvent) Event() string { return "" }
+func (e *testPriorityEvent) Data() string  { return e.data }
+func (e *testPriorityEvent) Priority() int { return e.priority }
+
+// A ResponseWriter that blocks all writes until released, so that we can simulate a slow client.
+type blockingResponseWriter struct {
+	*httptest.ResponseRecorder
+	startedCh  chan struct{}
+	startOnce  sync.Once
+	releaseCh  chan struct{}
+	lock       sync.Mutex
+	bodyBuffer bytes.Buffer
+}
+
+func newBlockingResponseWriter() *blockingResponseWriter {
+	return &blockingResponseWriter{
+		ResponseRecorder: httptest.NewRecorder(),
+		startedCh:        make(chan struct{}),
+		releaseCh:        make(chan struct{}),
+	}
+}
+
+func (w *blockingResponseWriter) Write(data []byte) (int, error) {
+	w.startOnce.Do(func() { close(w.startedCh) })
+	<-w.releaseCh
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.bodyBuffer.Write(data)
+}
+
+func (w *blockingResponseWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *blockingResponseWriter) body() string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.bodyBuffer.String()
+}
+
+func TestServerHandlerSendsHigherPriorityEventsFirstWhenClientIsBehind(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+
+	w := newBlockingResponseWriter()
+	handlerDone := make(chan struct{})
+	go func() {
+		defer close(handlerDone)
+		server.Handler(channel)(w, httptest.NewRequest("GET", "/", nil))
+	}()
+
+	// Publish the first event until the handler has received it and is blocked trying to write it
+	for {
+		<-server.PublishWithAcknowledgment([]string{channel}, &testPriorityEvent{data: "first"})
+		select {
+		case <-w.startedCh:
+		case <-time.After(time.Millisecond * 100):
+			continue
+		}
+		break
+	}
+	server.Publish([]string{channel}, &testPriorityEvent{data: "low1"})
+	server.Publish([]string{channel}, &testPriorityEvent{data: "low2", priority: -1})
+	server.Publish([]string{channel}, &testPriorityEvent{data: "high1", priority: 2})
+	server.Publish([]string{channel}, &publication{data: "normal"})
+	<-server.PublishWithAcknowledgment([]string{channel}, &testPriorityEvent{data: "high2", priority: 2})
+	close(w.releaseCh)
+	server.Close()
+	<-handlerDone
+
+	expected := "data: first\n\ndata: high1\n\ndata: high2\n\ndata: low1\n\ndata: normal\n\ndata: low2\n\n"
+	assert.Equal(t, expected, w.body())
+}
+
+// A ResponseWriter that blocks each write or flush until the test lets it proceed, so that we can control
+// exactly how far behind the handler is.
+type steppingResponseWriter struct {
+	*httptest.ResponseRecorder
+	waitingCh  chan struct{} // receives a value each time a write or flush starts waiting
+	stepCh     chan struct{} // send a value to let one write or flush proceed, or close it to let them all proceed
+	lock       sync.Mutex
+	bodyBuffer bytes.Buffer
+}
+
+func newSteppingResponseWriter() *steppingResponseWriter {
+	return &steppingResponseWriter{
+		ResponseRecorder: httptest.NewRecorder(),
+		waitingCh:        make(chan struct{}, 100),
+		stepCh:           make(chan struct{}),
+	}
+}
+
+func (w *steppingResponseWriter) Write(data []byte) (int, error) {
+	w.waitingCh <- struct{}{}
+	<-w.stepCh
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.bodyBuffer.Write(data)
+}
+
+func (w *steppingResponseWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *steppingResponseWriter) Flush() {
+	w.waitingCh <- struct{}{}
+	<-w.stepCh
+}
+
+func (w *steppingResponseWriter) body() string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.bodyBuffer.String()
+}
+
+func TestServerHandlerCountsEventsWaitingToBeReorderedTowardBufferSize(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	server.BufferSize = 2
+
+	w := newSteppingResponseWriter()
+	handlerDone := make(chan struct{})
+	go func() {
+		defer close(handlerDone)
+		server.Handler(channel)(w, httptest.NewRequest("GET", "/", nil))
+	}()
+
+	<-w.waitingCh // the handler has subscribed and is doing its initial flush
+	server.Publish([]string{channel}, &publication{data: "1"})
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: "2"})
+	w.stepCh <- struct{}{}
+	<-w.waitingCh // the handler is writing event 1, and has event 2 in its backlog
+
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: "3"})
+	assert.Equal(t, 1, server.SubscriberCount(channel))
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: "4"})
+	assert.Equal(t, 0, server.SubscriberCount(channel)) // events 2 and 3 were waiting, so the buffer was full
+
+	close(w.stepCh)
+	server.Close()
+	<-handlerDone
+	assert.Equal(t, "data: 1\n\ndata: 2\n\ndata: 3\n\n", w.body())
+}
+
+func TestServerHandlerDoesNotReorderEventsAcrossEventWithID(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+
+	w := newSteppingResponseWriter()
+	handlerDone := make(chan struct{})
+	go func() {
+		defer close(handlerDone)
+		server.Handler(channel)(w, httptest.NewRequest("GET", "/", nil))
+	}()
+
+	<-w.waitingCh // the handler has subscribed and is doing its initial flush
+	server.Publish([]string{channel}, &testPriorityEvent{data: "low"})
+	server.Publish([]string{channel}, &publication{id: "1", data: "a"})
+	server.Publish([]string{channel}, &testPriorityEvent{data: "high1", priority: 2})
+	server.Publish([]string{channel}, &publication{data: "normal"})
+	<-server.PublishWithAcknowledgment([]string{channel}, &testPriorityEvent{data: "high2", priority: 2})
+	close(w.stepCh)
+	server.Close()
+	<-handlerDone
+
+	expected := "data: low\n\nid: 1\ndata: a\n\ndata: high1\n\ndata: high2\n\ndata: normal\n\n"
+	assert.Equal(t, expected, w.body())
+}
+
+func TestServerHandlerDoesNotSendEventsAheadOfReplayedEvents(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	server.ReplayAll = true
+	server.Register(channel, &bufferedServerRepository{events: []Event{&publication{id: "1", data: "a"}}})
+
+	w := newSteppingResponseWriter()
+	handlerDone := make(chan struct{})
+	go func() {
+		defer close(handlerDone)
+		server.Handler(channel)(w, httptest.NewRequest("GET", "/", nil))
+	}()
+
+	<-w.waitingCh // the handler has subscribed, so the replay is queued, and is doing its initial flush
+	<-server.PublishWithAcknowledgment([]string{channel}, &testPriorityEvent{data: "high", priority: 2})
+	close(w.stepCh)
+	server.Close()
+	<-handlerDone
+
+	assert.Equal(t, "id: 1\ndata: a\n\ndata: high\n\n", w.body())
+}
+
+func TestServerHandlerDisconnectsSlowestSubscriberWhenOverMaxTotalBufferedBytes(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	server.MaxTotalBufferedBytes = 50
+	defer server.Close()
+
+	fast := newBlockingResponseWriter()
+	close(fast.releaseCh)
+	fastDone := make(chan struct{})
+	go func() {
+		defer close(fastDone)
+		server.Handler(channel)(fast, httptest.NewRequest("GET", "/", nil))
+	}()
+	// Publish comments until the fast handler has subscribed
+	require.Eventually(t, func() bool {
+		server.PublishComment([]string{channel}, "")
+		return strings.Contains(fast.body(), ":\n")
+	}, time.Second, time.Millisecond*10)
+
+	slow := newBlockingResponseWriter()
+	slowDone := make(chan struct{})
+	go func() {
+		defer close(slowDone)
+		server.Handler(channel)(slow, httptest.NewRequest("GET", "/", nil))
+	}()
+	// Publish comments until the slow handler has subscribed and is blocked trying to write one
+	for {
+		server.PublishComment([]string{channel}, "")
+		select {
+		case <-slow.startedCh:
+		case <-time.After(time.Millisecond * 10):
+			continue
+		}
+		break
+	}
+
+	for i := 1; i <= 10; i++ {
+		data := fmt.Sprintf("event-%04d", i)
+		<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: data})
+		require.Eventually(t, func() bool { return strings.Contains(fast.body(), data) },
+			time.Second, time.Millisecond)
+	}
+
+	select {
+	case <-fastDone:
+		require.Fail(t, "fast subscriber should not have been disconnected")
+	default:
+	}
+
+	close(slow.releaseCh)
+	select {
+	case <-slowDone:
+	case <-time.After(time.Second):
+		require.Fail(t, "timed out waiting for slow subscriber to be disconnected")
+	}
+	assert.NotContains(t, slow.body(), "event-")
+	server.bufferLock.Lock()
+	assert.Equal(t, int64(0), server.bufferedTotal)
+	server.bufferLock.Unlock()
+}
+
+type blockingFailingResponseWriter struct {
+	*blockingResponseWriter
+}
+
+func (w *blockingFailingResponseWriter) Write(data []byte) (int, error) {
+	w.startOnce.Do(func() { close(w.startedCh) })
+	<-w.releaseCh
+	return 0, errors.New("sorry")
+}
+
+func (w *blockingFailingResponseWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func TestServerHandlerDoesNotCountEventsLeftBehindByDisconnectedSubscriberTowardMaxTotalBufferedBytes(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	server.MaxTotalBufferedBytes = 50
+	defer server.Close()
+
+	failing := &blockingFailingResponseWriter{newBlockingResponseWriter()}
+	failingDone := make(chan struct{})
+	go func() {
+		defer close(failingDone)
+		server.Handler(channel)(failing, httptest.NewRequest("GET", "/", nil))
+	}()
+	// Publish comments until the handler has subscribed and is blocked trying to write one
+	for {
+		server.PublishComment([]string{channel}, "")
+		select {
+		case <-failing.startedCh:
+		case <-time.After(time.Millisecond * 10):
+			continue
+		}
+		break
+	}
+	// These stay in the handler's channel, since the handler exits as soon as its write fails
+	for i := 1; i <= 5; i++ {
+		<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: fmt.Sprintf("event-%04d", i)})
+	}
+	close(failing.releaseCh)
+	<-failingDone
+	require.Eventually(t, func() bool {
+		server.bufferLock.Lock()
+		defer server.bufferLock.Unlock()
+		return server.bufferedTotal == 0
+	}, time.Second, time.Millisecond*10)
+
+	later := newBlockingResponseWriter()
+	close(later.releaseCh)
+	laterDone := make(chan struct{})
+	go func() {
+		defer close(laterDone)
+		server.Handler(channel)(later, httptest.NewRequest("GET", "/", nil))
+	}()
+	require.Eventually(t, func() bool {
+		server.PublishComment([]string{channel}, "")
+		return strings.Contains(later.body(), ":\n")
+	}, time.Second, time.Millisecond*10)
+
+	for i := 1; i <= 10; i++ {
+		data := fmt.Sprintf("later-%04d", i)
+		<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: data})
+		require.Eventually(t, func() bool { return strings.Contains(later.body(), data) },
+			time.Second, time.Millisecond)
+	}
+	select {
+	case <-laterDone:
+		require.Fail(t, "later subscriber should not have been disconnected")
+	default:
+	}
+}
+
+func TestServerHandlerCanLimitConnectionsPerIP(t *testing.T) {
+	server := NewServer()
+	server.MaxConnectionsPerIP = 2
+	defer server.Close()
+	httpServer := httptest.NewServer(server.Handler("test"))
+	defer httpServer.Close()
+
+	connect := func(ctx context.Context) *http.Response {
+		req, err := http.NewRequest("GET", httpServer.URL, nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		require.NoError(t, err)
+		return resp
+	}
+	ctx1, canceller1 := context.WithCancel(context.Background())
+	resp1 := connect(ctx1)
+	defer resp1.Body.Close()
+	resp2 := connect(context.Background())
+	defer resp2.Body.Close()
+	assert.Equal(t, http.StatusOK, resp1.StatusCode)
+	assert.Equal(t, http.StatusOK, resp2.StatusCode)
+
+	resp3 := connect(context.Background())
+	resp3.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp3.StatusCode)
+
+	canceller1() // closing a connection makes room for another one
+	require.Eventually(t, func() bool {
+		server.connsPerIPLock.Lock()
+		defer server.connsPerIPLock.Unlock()
+		return server.connsPerIP["127.0.0.1"] == 1
+	}, time.Second, time.Millisecond*10)
+
+	resp4 := connect(context.Background())
+	defer resp4.Body.Close()
+	assert.Equal(t, http.StatusOK, resp4.StatusCode)
+}
+
+func TestServerHandlerCanRejectSubscriptionsWithFilter(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	server.SetSubscriptionFilter(func(channel string, req *http.Request) (bool, int) {
+		if req.Header.Get("Authorization") != "token" {
+			return false, http.StatusUnauthorized
+		}
+		return channel == "known", 0
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/known", server.Handler("known"))
+	mux.Handle("/unknown", server.Handler("unknown"))
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	get := func(path, auth string) *http.Response {
+		req, err := http.NewRequest("GET", httpServer.URL+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", auth)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp1 := get("/known", "wrong")
+	resp1.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp1.StatusCode)
+
+	resp2 := get("/unknown", "token")
+	resp2.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp2.StatusCode)
+	assert.Equal(t, 0, server.SubscriberCount("unknown"))
+
+	resp3 := get("/known", "token")
+	defer resp3.Body.Close()
+	assert.Equal(t, http.StatusOK, resp3.StatusCode)
+	assert.Equal(t, "text/event-stream; charset=utf-8", resp3.Header.Get("Content-Type"))
+}
+
+type bufferedServerRepository struct {
+	events []Event
+}
+
+func (r *bufferedServerRepository) Replay(channel, id string) chan Event {
+	out := make(chan Event, len(r.events))
+	for _, e := range r.events {
+		out <- e
+	}
+	close(out)
+	return out
+}
+
+type flushRecordingResponseWriter struct {
+	*httptest.ResponseRecorder
+	lock    sync.Mutex
+	flushes []string
+}
+
+func (w *flushRecordingResponseWriter) Flush() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.flushes = append(w.flushes, w.ResponseRecorder.Body.String())
+}
+
+func (w *flushRecordingResponseWriter) getFlushes() []string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return append([]string(nil), w.flushes...)
+}
+
+func TestServerHandlerFlushesAtEndOfReplay(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	server.ReplayAll = true
+	server.Register(channel, NewSliceRepositoryFromEvents(channel, []Event{
+		&publication{id: "1", data: "a"},
+		&publication{id: "2", data: "b"},
+		&publication{id: "3", data: "c"},
+	}))
+
+	w := &flushRecordingResponseWriter{ResponseRecorder: httptest.NewRecorder()}
+	handlerDone := make(chan struct{})
+	go func() {
+		defer close(handlerDone)
+		server.Handler(channel)(w, httptest.NewRequest("GET", "/", nil))
+	}()
+
+	replayed := "id: 1\ndata: a\n\nid: 2\ndata: b\n\nid: 3\ndata: c\n\n"
+	require.Eventually(t, func() bool {
+		flushes := w.getFlushes()
+		return len(flushes) > 0 && flushes[len(flushes)-1] == replayed
+	}, time.Second, time.Millisecond*10)
+
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{id: "4", data: "d"})
+	server.Close()
+	<-handlerDone
+
+	flushes := w.getFlushes()
+	for _, body := range flushes {
+		// the replayed events were flushed all at once, not one at a time
+		assert.Contains(t, []string{"", replayed, replayed + "id: 4\ndata: d\n\n"}, body)
+	}
+	assert.Equal(t, replayed+"id: 4\ndata: d\n\n", flushes[len(flushes)-1])
+}
+
+func TestServerHandlerCompressesReplayedEventsTogether(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	server.ReplayAll = true
+	server.Gzip = true
+	server.Register(channel, NewSliceRepositoryFromEvents(channel, []Event{
+		&publication{id: "1", data: "a"},
+		&publication{id: "2", data: "b"},
+		&publication{id: "3", data: "c"},
+	}))
+
+	w := &flushRecordingResponseWriter{ResponseRecorder: httptest.NewRecorder()}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	handlerDone := make(chan struct{})
+	go func() {
+		defer close(handlerDone)
+		server.Handler(channel)(w, req)
+	}()
+
+	require.Eventually(t, func() bool {
+		flushes := w.getFlushes()
+		return len(flushes) > 0 && flushes[len(flushes)-1] != ""
+	}, time.Second, time.Millisecond*10)
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{id: "4", data: "d"})
+	server.Close()
+	<-handlerDone
+
+	body := w.getFlushes()[len(w.getFlushes())-1]
+	// Each flush of the gzip writer ends with an empty block whose last four bytes are 00 00 ff ff. There
+	// should be one for the replayed events, and one for the live event.
+	assert.Equal(t, 2, strings.Count(body, "\x00\x00\xff\xff"))
+	zr, err := gzip.NewReader(strings.NewReader(body))
+	require.NoError(t, err)
+	decompressed, _ := ioutil.ReadAll(zr) // the gzip stream has no trailer, since the handler did not close it
+	assert.Equal(t, "id: 1\ndata: a\n\nid: 2\ndata: b\n\nid: 3\ndata: c\n\nid: 4\ndata: d\n\n", string(decompressed))
+}
+
+func TestServerCloseWithNoticeSendsEventToAllSubscribers(t *testing.T) {
+	server := NewServer()
+	mux := http.NewServeMux()
+	mux.Handle("/a", server.Handler("a"))
+	mux.Handle("/b", server.Handler("b"))
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	respA, err := http.Get(httpServer.URL + "/a")
+	require.NoError(t, err)
+	defer respA.Body.Close()
+	respB, err := http.Get(httpServer.URL + "/b")
+	require.NoError(t, err)
+	defer respB.Body.Close()
+
+	<-server.PublishWithAcknowledgment([]string{"a"}, &publication{data: "first"})
+	server.CloseWithNotice(&publication{event: "server-shutdown"}, time.Second)
+
+	bodyA, err := ioutil.ReadAll(respA.Body)
+	require.NoError(t, err)
+	bodyB, err := ioutil.ReadAll(respB.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "data: first\n\nevent: server-shutdown\n\n", string(bodyA))
+	assert.Equal(t, "event: server-shutdown\n\n", string(bodyB))
+}
+
+func TestServerPublishDeliversEventOnlyOnceToEachSubscriber(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	<-server.PublishWithAcknowledgment([]string{channel, "other", channel}, &publication{data: "once"})
+	server.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "data: once\n\n", string(body))
+}
+
+func TestServerSendGracePeriodLetsSlowSubscriberCatchUp(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	server.BufferSize = 2
+	server.SendGracePeriod = time.Second
+
+	w := newBlockingResponseWriter()
+	handlerDone := make(chan struct{})
+	go func() {
+		defer close(handlerDone)
+		server.Handler(channel)(w, httptest.NewRequest("GET", "/", nil))
+	}()
+
+	// Publish comments until the handler has subscribed and is blocked trying to write one
+	for {
+		server.PublishComment([]string{channel}, "")
+		select {
+		case <-w.startedCh:
+		case <-time.After(time.Millisecond * 100):
+			continue
+		}
+		break
+	}
+
+	// Without SendGracePeriod, the subscriber would be disconnected because it is more than two events behind
+	for i := 1; i <= 3; i++ {
+		<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: fmt.Sprint(i)})
+	}
+	time.Sleep(time.Millisecond * 100)
+	close(w.releaseCh)
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: "4"})
+	require.Eventually(t, func() bool { return strings.Contains(w.body(), "data: 4\n") },
+		time.Second, time.Millisecond*10)
+	server.Close()
+	<-handlerDone
+
+	assert.True(t, strings.HasSuffix(w.body(), "data: 1\n\ndata: 2\n\ndata: 3\n\ndata: 4\n\n"), w.body())
+}
+
+func TestServerSendGracePeriodDisconnectsSubscriberThatDoesNotCatchUp(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	server.BufferSize = 1
+	server.SendGracePeriod = time.Millisecond * 50
+	defer server.Close()
+
+	w := newBlockingResponseWriter()
+	handlerDone := make(chan struct{})
+	go func() {
+		defer close(handlerDone)
+		server.Handler(channel)(w, httptest.NewRequest("GET", "/", nil))
+	}()
+
+	for {
+		server.PublishComment([]string{channel}, "")
+		select {
+		case <-w.startedCh:
+		case <-time.After(time.Millisecond * 100):
+			continue
+		}
+		break
+	}
+	for i := 1; i <= 3; i++ {
+		<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: fmt.Sprint(i)})
+	}
+	time.Sleep(time.Millisecond * 200)
+	close(w.releaseCh)
+
+	select {
+	case <-handlerDone:
+	case <-time.After(time.Second):
+		require.Fail(t, "timed out waiting for handler to exit")
+	}
+	assert.NotContains(t, w.body(), "data: 3\n")
+}
+
+func TestServerSendGracePeriodRemovesSubscriptionOfSubscriberThatDoesNotCatchUp(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	server.BufferSize = 1
+	server.SendGracePeriod = time.Millisecond * 50
+	defer server.Close()
+
+	w := newBlockingResponseWriter()
+	handlerDone := make(chan struct{})
+	go func() {
+		defer close(handlerDone)
+		server.Handler(channel)(w, httptest.NewRequest("GET", "/", nil))
+	}()
+
+	for {
+		server.PublishComment([]string{channel}, "")
+		select {
+		case <-w.startedCh:
+		case <-time.After(time.Millisecond * 100):
+			continue
+		}
+		break
+	}
+	for i := 1; i <= 3; i++ {
+		<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: fmt.Sprint(i)})
+	}
+	// The handler closes the connection without unsubscribing, since it sees the subscription as having been
+	// ended by the server; so the subscription must be removed when the grace period elapses.
+	require.Eventually(t, func() bool { return server.SubscriberCount(channel) == 0 }, time.Second, time.Millisecond*10)
+	close(w.releaseCh)
+	<-handlerDone
+	assert.Equal(t, 0, server.SubscriberCount(channel))
+	assert.Nil(t, server.Channels())
+}
+
+func TestServerPublishesPresenceEvents(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	server.EnablePresence("test", "presence")
+	mux := http.NewServeMux()
+	mux.Handle("/test", server.Handler("test"))
+	mux.Handle("/presence", server.Handler("presence"))
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	stream := mustSubscribe(t, httpServer.URL+"/presence")
+	defer stream.Close()
+
+	resp, err := http.Get(httpServer.URL + "/test")
+	require.NoError(t, err)
+
+	type presenceData struct {
+		Channel      string `json:"channel"`
+		ConnectionID string `json:"connectionId"`
+		RemoteAddr   string `json:"remoteAddr"`
+	}
+	var joined, left presenceData
+	ev := <-stream.Events
+	assert.Equal(t, "join", ev.Event())
+	require.NoError(t, json.Unmarshal([]byte(ev.Data()), &joined))
+	assert.Equal(t, "test", joined.Channel)
+	assert.NotEqual(t, "", joined.ConnectionID)
+	assert.NotEqual(t, "", joined.RemoteAddr)
+
+	resp.Body.Close()
+	ev = <-stream.Events
+	assert.Equal(t, "leave", ev.Event())
+	require.NoError(t, json.Unmarshal([]byte(ev.Data()), &left))
+	assert.Equal(t, joined, left)
+}
+
+func TestServerHandlerSendsKeepAliveCommentWhenIdle(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	server.KeepAlive = time.Millisecond * 50
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	time.Sleep(time.Millisecond * 75)
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: "a"})
+	time.Sleep(time.Millisecond * 75)
+	server.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, ":\ndata: a\n\n:\n", string(body))
+}
+
+func TestServerHandlerCanFlushAtInterval(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	server.FlushInterval = time.Millisecond * 100
+	defer server.Close()
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	start := time.Now()
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: "a"})
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: "b"})
+
+	expected := "data: a\n\ndata: b\n\n"
+	buf := make([]byte, len(expected))
+	_, err = resp.Body.Read(buf[:1])
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(time.Millisecond*75))
+	_, err = io.ReadFull(resp.Body, buf[1:])
+	require.NoError(t, err)
+	assert.Equal(t, expected, string(buf))
+}
+
+func TestServerReportsSubscriberCountsAndChannels(t *testing.T) {
+	server := NewServer()
+	mux := http.NewServeMux()
+	mux.Handle("/a", server.Handler("a"))
+	mux.Handle("/b", server.Handler("b"))
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	assert.Equal(t, 0, server.SubscriberCount("a"))
+	assert.Nil(t, server.Channels())
+
+	var responses []*http.Response
+	for _, path := range []string{"/a", "/a", "/b"} {
+		resp, err := http.Get(httpServer.URL + path)
+		require.NoError(t, err)
+		responses = append(responses, resp)
+	}
+	assert.Equal(t, 2, server.SubscriberCount("a"))
+	assert.Equal(t, 1, server.SubscriberCount("b"))
+	assert.Equal(t, []string{"a", "b"}, server.Channels())
+
+	responses[2].Body.Close()
+	require.Eventually(t, func() bool { return server.SubscriberCount("b") == 0 }, time.Second, time.Millisecond*10)
+	assert.Equal(t, []string{"a"}, server.Channels())
+
+	server.Close()
+	assert.Equal(t, 0, server.SubscriberCount("a"))
+	assert.Nil(t, server.Channels())
+	for _, resp := range responses[:2] {
+		resp.Body.Close()
+	}
+}
+
+func TestServerCanAutoAssignEventIDs(t *testing.T) {
+	server := NewServer()
+	server.AutoAssignIDs = true
+	repo := NewSortedRepository(numericLess)
+	server.Register("a", repo)
+	mux := http.NewServeMux()
+	mux.Handle("/a", server.Handler("a"))
+	mux.Handle("/b", server.Handler("b"))
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	respA, err := http.Get(httpServer.URL + "/a")
+	require.NoError(t, err)
+	defer respA.Body.Close()
+	respB, err := http.Get(httpServer.URL + "/b")
+	require.NoError(t, err)
+	defer respB.Body.Close()
+
+	server.Publish([]string{"a"}, &publication{data: "first"})
+	server.Publish([]string{"a"}, &publication{id: "mine", data: "second"})
+	<-server.PublishWithAcknowledgment([]string{"a", "b"}, &publication{data: "third"})
+	server.Close()
+
+	bodyA, err := ioutil.ReadAll(respA.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "id: 00000000000000000001\ndata: first\n\nid: mine\ndata: second\n\n"+
+		"id: 00000000000000000002\ndata: third\n\n", string(bodyA))
+	bodyB, err := ioutil.ReadAll(respB.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "id: 00000000000000000001\ndata: third\n\n", string(bodyB))
+
+	assert.Equal(t, []string{"00000000000000000001", "00000000000000000002"}, replayedIDs(repo, "a", ""))
+}
+
+func TestServerReplaysAutoAssignedIDsInOrderFromSliceRepository(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	server.AutoAssignIDs = true
+	server.Register(channel, NewSliceRepository())
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+
+	for i := 1; i <= 12; i++ {
+		<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: strconv.Itoa(i)})
+	}
+
+	req, err := http.NewRequest("GET", httpServer.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", "00000000000000000009")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: "13"})
+	server.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	// SliceRepository replays the event with the client's Last-Event-ID as well as the ones after it
+	assert.Equal(t, "id: 00000000000000000009\ndata: 9\n\nid: 00000000000000000010\ndata: 10\n\n"+
+		"id: 00000000000000000011\ndata: 11\n\nid: 00000000000000000012\ndata: 12\n\n"+
+		"id: 00000000000000000013\ndata: 13\n\n", string(body))
+}
+
+func TestServerAutoAssignsIDsAfterThoseAlreadyInRepository(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	server.AutoAssignIDs = true
+	repo := NewSliceRepositoryFromEvents(channel, []Event{
+		&publication{id: "00000000000000000001", data: "a"},
+		&publication{id: "00000000000000000002", data: "b"},
+		&publication{id: "not-a-number", data: "c"},
+	})
+	server.Register(channel, repo)
+
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: "d"})
+	server.Close()
+
+	assert.Equal(t, []string{"00000000000000000001", "00000000000000000002", "00000000000000000003", "not-a-number"},
+		replayedIDs(repo, channel, ""))
+}
+
+func TestServerReportsPublishingToUnknownChannel(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	unknownCh := make(chan string, 10)
+	server.OnUnknownChannel = func(channel string) { unknownCh <- channel }
+	server.Register("registered", &testServerRepository{})
+	httpServer := httptest.NewServer(server.Handler("live"))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	<-server.PublishWithAcknowledgment([]string{"live", "registered", "typo"}, &publication{data: "a"})
+	server.PublishComment([]string{"other"}, "b")
+	<-server.PublishWithAcknowledgment([]string{"live"}, &publication{data: "c"})
+
+	assert.Equal(t, "typo", <-unknownCh)
+	assert.Equal(t, "other", <-unknownCh)
+	assert.Len(t, unknownCh, 0)
+}
+
+type channelServerRepository struct {
+	ch chan Event
+}
+
+func (r *channelServerRepository) Replay(channel, id string) chan Event {
+	return r.ch
+}
+
+type compactableServerRepository struct {
+	testServerRepository
+	lock        sync.Mutex
+	compactions int
+}
+
+func (r *compactableServerRepository) Compact() {
+	r.lock.Lock()
+	r.compactions++
+	r.lock.Unlock()
+}
+
+func TestServerCompactsRepositoriesPeriodically(t *testing.T) {
+	server := NewServer()
+	server.RepositoryCompactInterval = time.Millisecond * 10
+	defer server.Close()
+	repo := &compactableServerRepository{}
+	server.Register("a", repo)
+	server.Register("b", repo)
+	server.Register("c", &testServerRepository{}) // not compactable
+
+	require.Eventually(t, func() bool {
+		repo.lock.Lock()
+		defer repo.lock.Unlock()
+		return repo.compactions >= 3
+	}, time.Second, time.Millisecond*10)
+}
+
+func TestServerCanReplaceRepository(t *testing.T) {
+	channel := "test"
+	oldRepo := &channelServerRepository{ch: make(chan Event)}
+	newRepo := &testServerRepository{}
+	server := NewServer()
+	server.ReplayAll = true
+	defer server.Close()
+	assert.Nil(t, server.ReplaceRepository(channel, oldRepo))
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+
+	readLine := func(r *bufio.Reader) string {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		return line
+	}
+
+	resp1, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp1.Body.Close()
+	body1 := bufio.NewReader(resp1.Body)
+	oldRepo.ch <- &publication{id: "1", data: "old1"} // the handler has started reading the replay
+
+	assert.Equal(t, oldRepo, server.ReplaceRepository(channel, newRepo))
+
+	// the replay that was in progress continues from the old repository; it is flushed when it ends
+	oldRepo.ch <- &publication{id: "2", data: "old2"}
+	close(oldRepo.ch)
+	assert.Equal(t, "id: 1\n", readLine(body1))
+	assert.Equal(t, "data: old1\n", readLine(body1))
+	assert.Equal(t, "\n", readLine(body1))
+	assert.Equal(t, "id: 2\n", readLine(body1))
+	assert.Equal(t, "data: old2\n", readLine(body1))
+	assert.Equal(t, "\n", readLine(body1))
+
+	// a new subscription uses the new repository
+	resp2, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp2.Body.Close()
+	body2 := bufio.NewReader(resp2.Body)
+	assert.Equal(t, "id: replayed-from-start\n", readLine(body2))
+
+	// both connections still receive published events
+	server.Publish([]string{channel}, &publication{data: "live"})
+	assert.Equal(t, "data: live\n", readLine(body1))
+	assert.Equal(t, "data: example\n", readLine(body2))
+	assert.Equal(t, "\n", readLine(body2))
+	assert.Equal(t, "data: live\n", readLine(body2))
+}
+
+func TestServerCanPublishToAllChannels(t *testing.T) {
+	server := NewServer()
+	mux := http.NewServeMux()
+	mux.Handle("/a", server.Handler("a"))
+	mux.Handle("/b", server.Handler("b"))
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	respA, err := http.Get(httpServer.URL + "/a")
+	require.NoError(t, err)
+	defer respA.Body.Close()
+	respB, err := http.Get(httpServer.URL + "/b")
+	require.NoError(t, err)
+	defer respB.Body.Close()
+
+	server.PublishToAll(&publication{event: "restarting"})
+	server.PublishCommentToAll("bye")
+	<-server.PublishWithAcknowledgment([]string{"a"}, &publication{data: "last"})
+	server.Close()
+
+	bodyA, err := ioutil.ReadAll(respA.Body)
+	require.NoError(t, err)
+	bodyB, err := ioutil.ReadAll(respB.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "event: restarting\n\n:bye\ndata: last\n\n", string(bodyA))
+	assert.Equal(t, "event: restarting\n\n:bye\n", string(bodyB))
+}
+
+func TestServerCloseGracefullyWaitsForBufferedEventsToBeWritten(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+
+	w := newBlockingResponseWriter()
+	handlerDone := make(chan struct{})
+	go func() {
+		defer close(handlerDone)
+		server.Handler(channel)(w, httptest.NewRequest("GET", "/", nil))
+	}()
+
+	for {
+		<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: "first"})
+		select {
+		case <-w.startedCh:
+		case <-time.After(time.Millisecond * 100):
+			continue
+		}
+		break
+	}
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: "goodbye"})
+	time.AfterFunc(time.Millisecond*50, func() { close(w.releaseCh) })
+	server.CloseGracefully(time.Second * 5)
+
+	assert.True(t, strings.HasSuffix(w.body(), "data: first\n\ndata: goodbye\n\n"), "body was %q", w.body())
+	<-handlerDone
+}
+
+func TestServerCloseGracefullyStopsWaitingAfterTimeout(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+
+	w := newBlockingResponseWriter()
+	handlerDone := make(chan struct{})
+	go func() {
+		defer close(handlerDone)
+		server.Handler(channel)(w, httptest.NewRequest("GET", "/", nil))
+	}()
+	defer func() {
+		close(w.releaseCh)
+		<-handlerDone
+	}()
+
+	for {
+		<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: "first"})
+		select {
+		case <-w.startedCh:
+		case <-time.After(time.Millisecond * 100):
+			continue
+		}
+		break
+	}
+	timeout := time.Millisecond * 50
+	start := time.Now()
+	server.CloseGracefully(timeout)
+	elapsed := time.Since(start)
+	assert.GreaterOrEqual(t, int64(elapsed), int64(timeout))
+	assert.Less(t, int64(elapsed), int64(time.Second))
+	assert.Equal(t, "", w.body())
+}
+
+func TestServerFiniteHandlerSendsEventsWithContentLength(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	events := []Event{&publication{id: "1", data: "a"}, &publication{id: "2", event: "e", data: "b"}}
+	httpServer := httptest.NewServer(server.FiniteHandler(events))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	expected := "id: 1\ndata: a\n\nid: 2\nevent: e\ndata: b\n\n"
+	assert.Equal(t, "text/event-stream; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Equal(t, int64(len(expected)), resp.ContentLength)
+	assert.Len(t, resp.TransferEncoding, 0)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, expected, string(body))
+}
+
+func TestServerFiniteHandlerCanUseGzip(t *testing.T) {
+	server := NewServer()
+	server.Gzip = true
+	defer server.Close()
+	httpServer := httptest.NewServer(server.FiniteHandler([]Event{&publication{data: "a"}}))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL) // the default transport requests gzip and decompresses it
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.True(t, resp.Uncompressed)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "data: a\n\n", string(body))
+}
+
+func TestServerFiniteHandlerRespondsWithErrorIfEventCannotBeEncoded(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	events := []Event{&publication{data: "a"}, &testEventWithExtraFields{fields: map[string]string{"data": "x"}}}
+	httpServer := httptest.NewServer(server.FiniteHandler(events))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+}
+
+func TestServerSnapshotHandlerSendsSnapshotWithCursorAsID(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	snapshot := func() (Event, string) {
+		return &publication{id: "ignored", event: "snapshot", data: "state"}, "42"
+	}
+	httpServer := httptest.NewServer(server.SnapshotHandler("chan", snapshot))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "id: 42\nevent: snapshot\ndata: state\n\n", string(body))
+}
+
+func TestServerSnapshotHandlerRespondsWith204IfThereIsNoSnapshot(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	snapshot := func() (Event, string) {
+		return nil, ""
+	}
+	httpServer := httptest.NewServer(server.SnapshotHandler("chan", snapshot))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Empty(t, body)
+}
+
+func TestServerSnapshotHandlerRespondsWith503AfterServerIsClosed(t *testing.T) {
+	server := NewServer()
+	server.Close()
+	called := false
+	snapshot := func() (Event, string) {
+		called = true
+		return &publication{data: "state"}, "1"
+	}
+	httpServer := httptest.NewServer(server.SnapshotHandler("chan", snapshot))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.False(t, called)
+}
@@ -0,0 +1,36 @@
+//go:build go1.21
+// +build go1.21
+
+package eventsource
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+// NewSlogLogger returns a Logger that writes to a structured logger from the standard log/slog package,
+// for use with StreamOptionLogger, Stream.SetLogger, or Server.Logger. Informational messages are logged
+// at the Info level, and warnings such as failed connection attempts at the Warn level (see
+// LoggerWithWarnings).
+//
+// This function is only available in Go 1.21 and later.
+func NewSlogLogger(l *slog.Logger) Logger {
+	return slogLogger{logger: l}
+}
+
+func (l slogLogger) Println(args ...interface{}) {
+	l.logger.Info(strings.TrimSuffix(fmt.Sprintln(args...), "\n"))
+}
+
+func (l slogLogger) Printf(format string, args ...interface{}) {
+	l.logger.Info(strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"))
+}
+
+func (l slogLogger) Warnf(format string, args ...interface{}) {
+	l.logger.Warn(strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"))
+}
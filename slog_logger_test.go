@@ -0,0 +1,52 @@
+//go:build go1.21
+// +build go1.21
+
+package eventsource
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/launchdarkly/go-test-helpers/v2/httphelpers"
+)
+
+func TestSlogLoggerMapsMessagesToLevels(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewSlogLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})))
+
+	logger.Println("a", "b")
+	logger.Printf("c %d\n", 1)
+	logger.(LoggerWithWarnings).Warnf("d %d", 2)
+
+	assert.Equal(t, "level=INFO msg=\"a b\"\nlevel=INFO msg=\"c 1\"\nlevel=WARN msg=\"d 2\"\n", buf.String())
+}
+
+func TestStreamLogsConnectionFailureAsWarning(t *testing.T) {
+	streamHandler, streamControl := httphelpers.SSEHandler(nil)
+	defer streamControl.Close()
+	httpServer := httptest.NewServer(httphelpers.SequentialHandler(httphelpers.HandlerWithStatus(503), streamHandler))
+	defer httpServer.Close()
+
+	var buf bytes.Buffer
+	stream, err := SubscribeWithURL(httpServer.URL,
+		StreamOptionInitialRetry(time.Millisecond),
+		StreamOptionCanRetryFirstConnection(time.Second),
+		StreamOptionLogger(NewSlogLogger(slog.New(slog.NewTextHandler(&buf, nil)))))
+	require.NoError(t, err)
+	defer stream.Close()
+
+	assert.Contains(t, buf.String(), "level=WARN msg=\"Connection failed")
+}
@@ -1,11 +1,16 @@
 package eventsource
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 )
@@ -18,7 +23,7 @@ type Stream struct {
 	req         *http.Request
 	lastEventID string
 	readTimeout time.Duration
-	retryDelay  *retryDelayStrategy
+	retryDelay  RetryDelayStrategy
 	// Events emits the events received by the stream
 	Events chan Event
 	// Errors emits any errors encountered while reading events from the stream.
@@ -28,6 +33,10 @@ type Stream struct {
 	// configured the Stream to be able to retry on initialization errors, but you still want to know
 	// about those errors or control how they are handled, use StreamOptionErrorHandler.
 	//
+	// If the server ends the response after a complete event (or before sending anything), the error is
+	// io.EOF. If the response ends in the middle of an event or of a line, or the connection is dropped
+	// without the response being ended properly, the error is io.ErrUnexpectedEOF.
+	//
 	// If an error handler has been specified with StreamOptionErrorHandler, the Errors channel is
 	// not used and will be nil.
 	Errors       chan error
@@ -39,17 +48,81 @@ type Stream struct {
 	Logger      Logger
 	restarter   chan struct{}
 	closer      chan struct{}
+	done        chan struct{}
 	closeOnce   sync.Once
 	mu          sync.RWMutex
 	connections int
+	canRetry    bool
+	keepAlive   time.Duration
+	retryMode   RetryDirectiveMode
+	config      StreamConfig
+	skipLastID  bool // true if we should not send Last-Event-ID; see StreamOptionLastEventIDOnReconnectOnly
+	captured    map[string]string
+	controls    map[string]ControlAction
+	gapObserver func(time.Duration)
+	dropBadJSON bool
+	onBadJSON   func(Event)
+	delayFunc   func(time.Duration, int) time.Duration
+	errorEvent  string
+	errThrottle time.Duration
+	keepFields  bool
+	onRetry     func(time.Duration, time.Duration)
+	progress    time.Duration
+	onProgress  func(string, int64)
+	eventCount  int64
+	states      *stateNotifier
+	preserve    bool
+	maxRetries  int
+	minRetry    time.Duration
+	neverSendID bool
+	checkType   bool
+	bufferLimit int
+	onBuffering func()
+	recordTime  bool
+	timings     StreamTimings // guarded by mu
+	dataTimeout time.Duration
+	sentinel    func(string) bool
+	rawBytes    bool
+	typeChans   map[string]chan Event // guarded by mu
+	chansClosed bool                  // guarded by mu
+	dropOnFull  bool
+	dropped     int // guarded by mu
+	breaker     circuitBreaker
+	queryFunc   func(url.Values, int) url.Values
+	onReconnect func(int, string)
+	manualAck   bool
+	headerFunc  func() http.Header
+	unacked     []*ackableEvent // guarded by mu
+	onBatch     func([]Event)
+	batch       []Event // events waiting to be passed to onBatch; used only by the stream's goroutine
 }
 
 var (
 	// ErrReadTimeout is the error that will be emitted if a stream was closed due to not
 	// receiving any data within the configured read timeout interval.
 	ErrReadTimeout = errors.New("Read timeout on stream")
+
+	// ErrInitialDataTimeout is the error that will be emitted if a stream was closed due to not receiving
+	// any data at all within the time set by StreamOptionInitialDataTimeout after connecting.
+	ErrInitialDataTimeout = errors.New("No data received on stream after connecting")
+
+	// ErrUnexpectedContent is the error that will be emitted, in a DecodeError, if a stream was closed
+	// because a line of the response was rejected by the function set with StreamOptionContentSentinel.
+	ErrUnexpectedContent = errors.New("Unexpected content in stream")
+
+	// ErrMaxRetriesExceeded is the error that will be emitted, just before the stream is closed, if the
+	// limit set by StreamOptionMaxReconnectAttempts was reached.
+	ErrMaxRetriesExceeded = errors.New("Maximum number of reconnection attempts exceeded")
 )
 
+// ErrTooManyRedirects is the error that a stream reports, wrapped in a *url.Error, if a connection attempt
+// was redirected more than 10 times, which usually means that the server is misconfigured and is
+// redirecting in a loop. It can be detected with errors.Is, or by checking the Err field of the *url.Error.
+// This only applies if the HTTP client does not have its own CheckRedirect function.
+var ErrTooManyRedirects = errors.New("too many redirects")
+
+const maxRedirects = 10 // the same as the default for http.Client
+
 // SubscriptionError is an error object returned from a stream when there is an HTTP error.
 type SubscriptionError struct {
 	Code    int
@@ -64,6 +137,56 @@ func (e SubscriptionError) Error() string {
 	return s
 }
 
+// ContentTypeError is the error that a stream reports if StreamOptionExpectContentType was used and the
+// server's response did not have the Content-Type "text/event-stream".
+type ContentTypeError struct {
+	// ContentType is the value of the Content-Type header in the response, or "" if there was none.
+	ContentType string
+}
+
+func (e ContentTypeError) Error() string {
+	if e.ContentType == "" {
+		return "response had no content type; expected text/event-stream"
+	}
+	return fmt.Sprintf("unexpected content type %q; expected text/event-stream", e.ContentType)
+}
+
+// InBandError is the error that a stream reports if the server sends an error event, as configured with
+// StreamOptionInBandErrorEvent.
+type InBandError struct {
+	// Event is the name of the event.
+	Event string
+	// Data is the data of the event, which presumably describes the error.
+	Data string
+}
+
+func (e InBandError) Error() string {
+	s := "server sent error event " + e.Event
+	if e.Data != "" {
+		s = s + ": " + e.Data
+	}
+	return s
+}
+
+// RepeatedError is an error that a stream reports if StreamOptionErrorThrottle is used, to indicate that the
+// same error occurred more times than were reported.
+type RepeatedError struct {
+	// Err is the error that was repeated.
+	Err error
+	// Suppressed is the number of times that the error occurred without being reported, since the last
+	// time it was reported.
+	Suppressed int
+}
+
+func (e RepeatedError) Error() string {
+	return fmt.Sprintf("%s (repeated %d more times)", e.Err, e.Suppressed)
+}
+
+// Unwrap returns the underlying error.
+func (e RepeatedError) Unwrap() error {
+	return e.Err
+}
+
 // Subscribe to the Events emitted from the specified url.
 // If lastEventId is non-empty it will be sent to the server in case it can replay missed events.
 // Deprecated: use SubscribeWithURL instead.
@@ -73,11 +196,30 @@ func Subscribe(url, lastEventID string) (*Stream, error) {
 
 // SubscribeWithURL subscribes to the Events emitted from the specified URL. The stream can
 // be configured by providing any number of StreamOption values.
+//
+// The request uses the GET method and has no body, unless StreamOptionMethod or StreamOptionBody
+// is specified.
 func SubscribeWithURL(url string, options ...StreamOption) (*Stream, error) {
-	req, err := http.NewRequest("GET", url, nil)
+	var requestOptions streamOptions
+	for _, o := range options {
+		if err := o.apply(&requestOptions); err != nil {
+			return nil, err
+		}
+	}
+	method := requestOptions.method
+	if method == "" {
+		method = "GET"
+	}
+	req, err := http.NewRequest(method, url, nil)
 	if err != nil {
 		return nil, err
 	}
+	if body := requestOptions.body; body != nil {
+		req.Body = body()
+		req.GetBody = func() (io.ReadCloser, error) {
+			return body(), nil
+		}
+	}
 	return SubscribeWithRequestAndOptions(req, options...)
 }
 
@@ -102,77 +244,124 @@ func SubscribeWith(lastEventID string, client *http.Client, request *http.Reques
 // StreamOption values to set other properties of the stream, such as timeouts or a specific
 // HTTP client to use.
 func SubscribeWithRequestAndOptions(request *http.Request, options ...StreamOption) (*Stream, error) {
-	defaultClient := *http.DefaultClient
-
-	configuredOptions := streamOptions{
-		httpClient:         &defaultClient,
-		initialRetry:       DefaultInitialRetry,
-		retryResetInterval: DefaultRetryResetInterval,
-	}
-
-	for _, o := range options {
-		if err := o.apply(&configuredOptions); err != nil {
-			return nil, err
-		}
+	configuredOptions, err := applyStreamOptions(options)
+	if err != nil {
+		return nil, err
 	}
 
 	stream := newStream(request, configuredOptions)
 
 	var initialRetryTimeoutCh <-chan time.Time
+	var deadline time.Time
 	var lastError error
+	attempt := 0
 	if configuredOptions.initialRetryTimeout > 0 {
 		initialRetryTimeoutCh = time.After(configuredOptions.initialRetryTimeout)
+		deadline = time.Now().Add(configuredOptions.initialRetryTimeout)
+	}
+	timedOut := func() (*Stream, error) {
+		if lastError == nil {
+			lastError = errors.New("timeout elapsed while waiting to connect")
+		}
+		stream.states.notify(StateClosed)
+		return nil, lastError
 	}
 	for {
-		r, err := stream.connect()
+		r, err := stream.connectBefore(deadline, attempt)
 		if err == nil {
 			go stream.stream(r)
 			return stream, nil
 		}
+		if err == errConnectDeadline {
+			return timedOut()
+		}
 		lastError = err
-		if configuredOptions.initialRetryTimeout == 0 {
+		if configuredOptions.initialRetryTimeout == 0 || !stream.canRetry {
+			stream.states.notify(StateClosed)
 			return nil, err
 		}
 		if configuredOptions.errorHandler != nil {
 			result := configuredOptions.errorHandler(err)
 			if result.CloseNow {
+				stream.states.notify(StateClosed)
 				return nil, err
 			}
 		}
 		// We never push errors to the Errors channel during initialization-- the caller would have no way to
 		// consume the channel, since we haven't returned a Stream instance.
-		delay := stream.retryDelay.NextRetryDelay(time.Now())
+		attempt++
+		delay := stream.nextRetryDelay(attempt)
 		if configuredOptions.logger != nil {
-			configuredOptions.logger.Printf("Connection failed (%s), retrying in %0.4f secs\n", err, delay.Seconds())
+			logWarning(configuredOptions.logger, "Connection failed (%s), retrying in %0.4f secs\n", err, delay.Seconds())
 		}
+		stream.states.notify(StateWaitingToReconnect)
 		nextRetryCh := time.After(delay)
 		select {
 		case <-initialRetryTimeoutCh:
-			if lastError == nil {
-				lastError = errors.New("timeout elapsed while waiting to connect")
-			}
-			return nil, lastError
+			return timedOut()
 		case <-nextRetryCh:
 			continue
 		}
 	}
 }
 
-func newStream(request *http.Request, configuredOptions streamOptions) *Stream {
-	var backoff backoffStrategy
-	var jitter jitterStrategy
-	if configuredOptions.backoffMaxDelay > 0 {
-		backoff = newDefaultBackoff(configuredOptions.backoffMaxDelay)
+// SubscribeWithReader creates a Stream that reads events from an existing connection or other source of
+// SSE data, such as a Unix socket or a test fixture, instead of making an HTTP request. It has the same
+// Events and Errors channels as any other Stream, and the options that are not related to HTTP requests
+// or to reconnecting work in the same way.
+//
+// Since there is nothing to reconnect to, the stream is closed when the reader reaches the end of its data
+// or returns an error (which is reported like any other stream error, so io.EOF is reported if the data
+// ended normally), and Restart or a control event that would restart the stream closes it instead. The
+// stream takes ownership of rc and closes it when the stream is closed. An error is returned only if one
+// of the options is invalid.
+func SubscribeWithReader(rc io.ReadCloser, options ...StreamOption) (*Stream, error) {
+	configuredOptions, err := applyStreamOptions(options)
+	if err != nil {
+		return nil, err
 	}
-	if configuredOptions.jitterRatio > 0 {
-		jitter = newDefaultJitter(configuredOptions.jitterRatio, 0)
+	stream := newStream(nil, configuredOptions)
+	stream.states.notify(StateOpen)
+	go stream.stream(rc)
+	return stream, nil
+}
+
+func applyStreamOptions(options []StreamOption) (streamOptions, error) {
+	defaultClient := *http.DefaultClient
+
+	configuredOptions := streamOptions{
+		httpClient:         &defaultClient,
+		initialRetry:       DefaultInitialRetry,
+		retryResetInterval: DefaultRetryResetInterval,
+	}
+
+	for _, o := range options {
+		if err := o.apply(&configuredOptions); err != nil {
+			return streamOptions{}, err
+		}
+	}
+	return configuredOptions, nil
+}
+
+// The request is nil if the stream was created with SubscribeWithReader.
+func newStream(request *http.Request, configuredOptions streamOptions) *Stream {
+	retryDelay := configuredOptions.retryStrategy
+	if retryDelay == nil {
+		var backoff backoffStrategy
+		var jitter jitterStrategy
+		if configuredOptions.backoffMaxDelay > 0 {
+			backoff = newDefaultBackoff(configuredOptions.backoffMaxDelay)
+		}
+		if configuredOptions.jitterRatio > 0 {
+			jitter = newDefaultJitter(configuredOptions.jitterRatio, 0)
+		}
+		retryDelay = newRetryDelayStrategy(
+			configuredOptions.initialRetry,
+			configuredOptions.retryResetInterval,
+			backoff,
+			jitter,
+		)
 	}
-	retryDelay := newRetryDelayStrategy(
-		configuredOptions.initialRetry,
-		configuredOptions.retryResetInterval,
-		backoff,
-		jitter,
-	)
 
 	stream := &Stream{
 		c:            configuredOptions.httpClient,
@@ -180,11 +369,54 @@ func newStream(request *http.Request, configuredOptions streamOptions) *Stream {
 		readTimeout:  configuredOptions.readTimeout,
 		req:          request,
 		retryDelay:   retryDelay,
-		Events:       make(chan Event),
+		Events:       make(chan Event, configuredOptions.eventBuffer),
 		errorHandler: configuredOptions.errorHandler,
 		Logger:       configuredOptions.logger,
 		restarter:    make(chan struct{}, 1),
 		closer:       make(chan struct{}),
+		done:         make(chan struct{}),
+		canRetry:     request != nil && (!configuredOptions.retryOnlyIdempotent || isIdempotentRequest(request)),
+		keepAlive:    configuredOptions.requestKeepAlive,
+		retryMode:    configuredOptions.retryDirectiveMode,
+		config:       configuredOptions.toConfig(),
+		skipLastID:   configuredOptions.lastIDOnReconnect,
+		controls:     configuredOptions.controlEvents,
+		gapObserver:  configuredOptions.gapObserver,
+		dropBadJSON:  configuredOptions.dropInvalidJSON,
+		onBadJSON:    configuredOptions.onDroppedJSON,
+		delayFunc:    configuredOptions.reconnectDelayFunc,
+		errorEvent:   configuredOptions.inBandErrorEvent,
+		errThrottle:  configuredOptions.errorThrottle,
+		keepFields:   configuredOptions.preserveFields,
+		onRetry:      configuredOptions.retryHandler,
+		progress:     configuredOptions.progressInterval,
+		onProgress:   configuredOptions.progressHandler,
+		states:       newStateNotifier(configuredOptions.stateListener),
+		preserve:     configuredOptions.preserveOnRestart,
+		maxRetries:   configuredOptions.maxReconnects,
+		minRetry:     configuredOptions.minServerRetry,
+		neverSendID:  configuredOptions.neverSendLastID,
+		checkType:    configuredOptions.expectContentType,
+		bufferLimit:  configuredOptions.bufferingThreshold,
+		onBuffering:  configuredOptions.onBuffering,
+		recordTime:   configuredOptions.recordTimings,
+		dataTimeout:  configuredOptions.initialDataTimeout,
+		sentinel:     configuredOptions.contentSentinel,
+		rawBytes:     configuredOptions.rawBytes,
+		dropOnFull:   configuredOptions.dropOnFull,
+		breaker:      configuredOptions.circuitBreaker,
+		queryFunc:    configuredOptions.queryParamsFunc,
+		onReconnect:  configuredOptions.reconnectHandler,
+		manualAck:    configuredOptions.manualAck,
+		headerFunc:   configuredOptions.requestHeadersFunc,
+		onBatch:      configuredOptions.batchHandler,
+	}
+
+	if len(configuredOptions.captureHeaders) > 0 {
+		stream.captured = make(map[string]string, len(configuredOptions.captureHeaders))
+		for _, name := range configuredOptions.captureHeaders {
+			stream.captured[name] = ""
+		}
 	}
 
 	if configuredOptions.errorHandler == nil {
@@ -192,6 +424,23 @@ func newStream(request *http.Request, configuredOptions streamOptions) *Stream {
 		stream.Errors = make(chan error)
 	}
 
+	if stream.c.CheckRedirect == nil || configuredOptions.noRedirects {
+		client := *stream.c
+		if configuredOptions.noRedirects {
+			client.CheckRedirect = func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			}
+		} else {
+			client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+				if len(via) >= maxRedirects {
+					return ErrTooManyRedirects
+				}
+				return nil
+			}
+		}
+		stream.c = &client
+	}
+
 	// override checkRedirect to include headers before go1.8
 	// we'd prefer to skip this because it is not thread-safe and breaks golang race condition checking
 	setCheckRedirect(stream.c)
@@ -206,6 +455,8 @@ func newStream(request *http.Request, configuredOptions streamOptions) *Stream {
 // This method is safe for concurrent access. Its behavior is asynchronous: Restart returns immediately
 // and the connection is restarted as soon as possible from another goroutine after that. It is possible
 // for additional events from the original connection to be delivered during that interval.ssible.
+// Events that have been read from the connection but not yet delivered are discarded, unless
+// StreamOptionPreserveOnRestart was used.
 //
 // If the stream has already been closed with Close, Restart has no effect.
 func (stream *Stream) Restart() {
@@ -226,15 +477,81 @@ func (stream *Stream) Close() {
 	})
 }
 
-func (stream *Stream) connect() (io.ReadCloser, error) {
+// Done returns a channel that is closed when the stream has completely shut down, after the Events and
+// Errors channels have been closed. This can be used in a select statement to detect that the stream has
+// ended, without consuming the Events channel.
+func (stream *Stream) Done() <-chan struct{} {
+	return stream.done
+}
+
+// Returned by connectBefore if the deadline passed before the connection attempt finished.
+var errConnectDeadline = errors.New("connection attempt did not finish before the deadline")
+
+// Like connect, but if deadline is not zero, the attempt is cancelled if it has not finished by then. This
+// is used for the first connection when StreamOptionCanRetryFirstConnection has a timeout, since otherwise
+// a request that hangs could make SubscribeWithRequestAndOptions wait much longer than that. Only the
+// attempt is limited by the deadline; if it succeeds, the response can be read for as long as needed.
+func (stream *Stream) connectBefore(deadline time.Time, attempt int) (io.ReadCloser, error) {
+	if deadline.IsZero() {
+		return stream.connect(stream.req.Context(), attempt)
+	}
+	ctx, cancel := context.WithCancel(stream.req.Context())
+	timer := time.AfterFunc(time.Until(deadline), cancel)
+	r, err := stream.connect(ctx, attempt)
+	if !timer.Stop() { // the attempt was cancelled, or it finished just as the deadline passed
+		if r != nil {
+			_ = r.Close()
+		}
+		return nil, errConnectDeadline
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return cancelOnCloseBody{ReadCloser: r, cancel: cancel}, nil
+}
+
+// Releases the context of the request that a response body belongs to, when the body is closed.
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelOnCloseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// The ctx parameter is the context for the request. The attempt parameter is zero for the first
+// connection, or the number of consecutive attempts that have been made since the last successful
+// connection, including this one.
+func (stream *Stream) connect(ctx context.Context, attempt int) (io.ReadCloser, error) {
 	var err error
 	var resp *http.Response
 	stream.req.Header.Set("Cache-Control", "no-cache")
 	stream.req.Header.Set("Accept", "text/event-stream")
-	if len(stream.lastEventID) > 0 {
-		stream.req.Header.Set("Last-Event-ID", stream.lastEventID)
+	if stream.neverSendID {
+		stream.req.Header.Del("Last-Event-ID")
+	} else if lastEventID := stream.LastEventID(); len(lastEventID) > 0 && !stream.skipLastID {
+		stream.req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	req := *stream.req.WithContext(ctx)
+	if stream.headerFunc != nil {
+		req.Header = make(http.Header, len(stream.req.Header)) // http.Header.Clone requires Go 1.13
+		for name, values := range stream.req.Header {
+			req.Header[name] = append([]string(nil), values...)
+		}
+		for name, values := range stream.headerFunc() {
+			req.Header[http.CanonicalHeaderKey(name)] = values
+		}
 	}
-	req := *stream.req
+	if stream.queryFunc != nil {
+		u := *req.URL
+		u.RawQuery = stream.queryFunc(u.Query(), attempt).Encode()
+		req.URL = &u
+	}
+	stream.states.notify(StateConnecting)
 
 	// All but the initial connection will need to regenerate the body
 	if stream.connections > 0 && req.GetBody != nil {
@@ -243,11 +560,20 @@ func (stream *Stream) connect() (io.ReadCloser, error) {
 		}
 	}
 
+	stopKeepAlive := func() {}
+	if stream.keepAlive > 0 && req.Body != nil && req.Body != http.NoBody {
+		req.Body, stopKeepAlive = newRequestKeepAliveBody(req.Body, stream.keepAlive)
+		req.ContentLength = -1
+		req.GetBody = nil
+	}
+
 	if resp, err = stream.c.Do(&req); err != nil {
+		stopKeepAlive()
 		return nil, err
 	}
 	stream.connections++
 	if resp.StatusCode != 200 {
+		stopKeepAlive()
 		message, _ := ioutil.ReadAll(resp.Body)
 		_ = resp.Body.Close()
 		err = SubscriptionError{
@@ -256,23 +582,101 @@ func (stream *Stream) connect() (io.ReadCloser, error) {
 		}
 		return nil, err
 	}
-	return resp.Body, nil
+	if stream.checkType {
+		contentType := resp.Header.Get("Content-Type")
+		if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != "text/event-stream" {
+			stopKeepAlive()
+			_ = resp.Body.Close()
+			return nil, ContentTypeError{ContentType: contentType}
+		}
+	}
+	stream.skipLastID = false // only applies to the first successful connection
+	if stream.manualAck {
+		// The server will send everything after the last acknowledged event again, so acknowledging an
+		// event from an earlier connection should no longer have any effect.
+		stream.mu.Lock()
+		stream.unacked = nil
+		stream.mu.Unlock()
+	}
+	stream.captureHeaders(resp.Header)
+	stream.states.notify(StateOpen)
+	body := resp.Body
+	if stream.dataTimeout > 0 {
+		body = newInitialDataTimeoutBody(body, stream.dataTimeout)
+	}
+	if strings.EqualFold(strings.TrimSpace(resp.Header.Get("Content-Encoding")), "gzip") {
+		body = &gzipResponseBody{ReadCloser: body}
+	}
+	if stream.keepAlive > 0 {
+		return keepAliveResponseBody{ReadCloser: body, stopKeepAlive: stopKeepAlive}, nil
+	}
+	return body, nil
 }
 
 func (stream *Stream) stream(r io.ReadCloser) {
 	retryChan := make(chan struct{}, 1)
+	attempt := 0 // number of consecutive reconnection attempts since the last successful connection
+	// True if the connection ended or failed since the last successful connection, rather than being
+	// restarted deliberately; the reconnect handler is only called in that case.
+	reconnectingAfterFailure := false
+
+	// These are used only if StreamOptionCircuitBreaker was specified.
+	var recentAttempts []time.Time
+	circuitHalfOpen := false // true if the next attempt is the trial after a cooldown
+
+	// Returns the cooldown period if the circuit breaker has opened, or zero.
+	circuitBreakerDelay := func() time.Duration {
+		if stream.breaker.maxAttempts <= 0 {
+			return 0
+		}
+		if circuitHalfOpen { // the trial attempt has failed
+			return stream.breaker.cooldown
+		}
+		now := time.Now()
+		for len(recentAttempts) > 0 && now.Sub(recentAttempts[0]) >= stream.breaker.window {
+			recentAttempts = recentAttempts[1:]
+		}
+		recentAttempts = append(recentAttempts, now)
+		if len(recentAttempts) <= stream.breaker.maxAttempts {
+			return 0
+		}
+		recentAttempts = nil
+		circuitHalfOpen = true
+		return stream.breaker.cooldown
+	}
 
 	scheduleRetry := func() {
 		logger := stream.getLogger()
-		delay := stream.retryDelay.NextRetryDelay(time.Now())
+		attempt++
+		delay := stream.nextRetryDelay(attempt)
+		if cooldown := circuitBreakerDelay(); cooldown > delay {
+			delay = cooldown
+			if logger != nil {
+				logWarning(logger, "Too many reconnection attempts; waiting %0.4f secs", cooldown.Seconds())
+			}
+		}
 		if logger != nil {
 			logger.Printf("Reconnecting in %0.4f secs", delay.Seconds())
 		}
+		stream.states.notify(StateWaitingToReconnect)
 		time.AfterFunc(delay, func() {
 			retryChan <- struct{}{}
 		})
 	}
 
+	// These are used only if StreamOptionErrorThrottle was specified.
+	var lastErrorMessage string
+	var lastErrorTime time.Time
+	suppressedErrors := 0
+
+	// This is used only if StreamOptionProgressInterval was specified; a nil channel is never ready.
+	var progressCh <-chan time.Time
+	if stream.onProgress != nil {
+		progressTicker := time.NewTicker(stream.progress)
+		defer progressTicker.Stop()
+		progressCh = progressTicker.C
+	}
+
 	reportErrorAndMaybeContinue := func(err error) bool {
 		if stream.errorHandler != nil {
 			result := stream.errorHandler(err)
@@ -281,94 +685,559 @@ func (stream *Stream) stream(r io.ReadCloser) {
 				return false
 			}
 		} else if stream.Errors != nil {
+			if stream.errThrottle > 0 {
+				now := time.Now()
+				message := err.Error()
+				if message == lastErrorMessage {
+					if now.Sub(lastErrorTime) < stream.errThrottle {
+						suppressedErrors++
+						return true
+					}
+					if suppressedErrors > 0 {
+						err = RepeatedError{Err: err, Suppressed: suppressedErrors}
+					}
+				}
+				lastErrorMessage, lastErrorTime, suppressedErrors = message, now, 0
+			}
 			stream.Errors <- err
 		}
 		return true
 	}
 
+	// These are used only if StreamOptionMaxReconnectAttempts was specified.
+	failures := 0
+	connectedTime := time.Now()
+
+	// Counts a failed connection attempt, or a connection that has ended; the latter is not a failure if it
+	// stayed open for at least the retry reset interval. Returns false if the stream should stop because
+	// there have been too many failures in a row.
+	countFailure := func(wasConnected bool) bool {
+		if stream.maxRetries <= 0 {
+			return true
+		}
+		if wasConnected && time.Since(connectedTime) >= stream.config.RetryResetInterval {
+			failures = 0
+			return true
+		}
+		failures++
+		if failures < stream.maxRetries {
+			return true
+		}
+		reportErrorAndMaybeContinue(ErrMaxRetriesExceeded)
+		stream.Close()
+		return false
+	}
+
 NewStream:
 	for {
 		events := make(chan Event)
 		errs := make(chan error)
 
 		if r != nil {
-			dec := NewDecoderWithOptions(r, DecoderOptionReadTimeout(stream.readTimeout))
+			decoderOptions := []DecoderOption{DecoderOptionReadTimeout(stream.readTimeout)}
+			if stream.gapObserver != nil {
+				decoderOptions = append(decoderOptions, DecoderOptionInterEventGapObserver(stream.gapObserver))
+			}
+			if stream.keepFields {
+				decoderOptions = append(decoderOptions, DecoderOptionPreserveFields(true))
+			}
+			if stream.sentinel != nil {
+				decoderOptions = append(decoderOptions, contentSentinelDecoderOption(stream.sentinel))
+			}
+			if stream.rawBytes {
+				decoderOptions = append(decoderOptions, DecoderOptionRawBytes(true))
+			}
+			var body io.Reader = r
+			if stream.onBuffering != nil {
+				body = newBufferingDetector(r, stream.bufferLimit, stream.onBuffering)
+			}
+			dec := NewDecoderWithOptions(body, decoderOptions...)
 			go func() {
 				for {
+					var decodeStart time.Time
+					if stream.recordTime {
+						decodeStart = time.Now()
+					}
 					ev, err := dec.Decode()
 
+					if err == io.EOF && !dec.EndedCleanly() {
+						// the response was cut off in the middle of a line, or the connection was dropped
+						err = io.ErrUnexpectedEOF
+					}
 					if err != nil {
 						errs <- err
 						close(errs)
 						close(events)
 						return
 					}
-					events <- ev
+					if stream.recordTime {
+						sendStart := time.Now()
+						events <- ev
+						stream.addTimings(sendStart.Sub(decodeStart), time.Since(sendStart))
+					} else {
+						events <- ev
+					}
+					if stream.onBatch != nil && !dec.hasBufferedData() {
+						events <- nil // marks the end of the events that were read together; see deliverBatch
+					}
 				}
 			}()
 		}
 
 		discardCurrentStream := func() {
+			stream.deliverBatch()
 			if r != nil {
 				_ = r.Close()
 				r = nil
-				// allow the decoding goroutine to terminate
-				for range errs {
+				// allow the decoding goroutine to terminate; it may be blocked sending either an event or an error
+				for remainingEvents, remainingErrs := events, errs; remainingEvents != nil || remainingErrs != nil; {
+					select {
+					case _, ok := <-remainingEvents:
+						if !ok {
+							remainingEvents = nil
+						}
+					case _, ok := <-remainingErrs:
+						if !ok {
+							remainingErrs = nil
+						}
+					}
 				}
-				for range events {
+			}
+		}
+
+		// Closes the current connection like discardCurrentStream, but delivers any events that were already
+		// decoded from it, if StreamOptionPreserveOnRestart was used.
+		preserveCurrentStream := func() {
+			if r == nil {
+				return
+			}
+			_ = r.Close()
+			r = nil
+			for remainingEvents, remainingErrs := events, errs; remainingEvents != nil || remainingErrs != nil; {
+				select {
+				case ev, ok := <-remainingEvents:
+					if !ok {
+						remainingEvents = nil
+						continue
+					}
+					if ev == nil { // see deliverBatch
+						continue
+					}
+					pub := ev.(*publication)
+					if len(pub.Id()) > 0 && !stream.manualAck {
+						stream.setLastEventID(pub.Id())
+					}
+					if _, isControl := stream.controls[pub.Event()]; isControl {
+						continue
+					}
+					if stream.dropBadJSON && !json.Valid([]byte(pub.Data())) {
+						if stream.onBadJSON != nil {
+							stream.onBadJSON(ev)
+						}
+						continue
+					}
+					stream.eventCount++
+					stream.deliver(ev)
+				case _, ok := <-remainingErrs:
+					if !ok {
+						remainingErrs = nil
+					}
 				}
 			}
+			stream.deliverBatch()
 		}
 
+		// Reports an error that has ended the current connection, and schedules a retry if appropriate.
+		// Returns false if the stream should stop.
+		failConnection := func(err error) bool {
+			stream.deliverBatch() // events that were received before the error
+			continuing := reportErrorAndMaybeContinue(err)
+			discardCurrentStream()
+			if !continuing {
+				return false
+			}
+			if !stream.canRetry {
+				stream.Close()
+				return false
+			}
+			if !countFailure(true) {
+				return false
+			}
+			reconnectingAfterFailure = true
+			scheduleRetry()
+			return true
+		}
+
+		firstEvent := true
 		for {
 			select {
 			case <-stream.restarter:
-				discardCurrentStream()
+				if stream.req == nil { // created with SubscribeWithReader, so there is nothing to reconnect to
+					stream.Close()
+					discardCurrentStream()
+					break NewStream
+				}
+				if stream.preserve {
+					preserveCurrentStream()
+				} else {
+					discardCurrentStream()
+				}
 				scheduleRetry()
 				continue NewStream
 			case err := <-errs:
-				if !reportErrorAndMaybeContinue(err) {
+				if !failConnection(err) {
 					break NewStream
 				}
-				discardCurrentStream()
-				scheduleRetry()
 				continue NewStream
 			case ev := <-events:
+				if ev == nil { // see deliverBatch
+					stream.deliverBatch()
+					continue
+				}
 				pub := ev.(*publication)
+				if firstEvent && stream.errorEvent != "" && pub.Event() == stream.errorEvent {
+					if !failConnection(InBandError{Event: pub.Event(), Data: pub.Data()}) {
+						break NewStream
+					}
+					continue NewStream
+				}
+				firstEvent = false
 				if pub.Retry() > 0 {
-					stream.retryDelay.SetBaseDelay(time.Duration(pub.Retry()) * time.Millisecond)
+					stream.applyRetryDirective(time.Duration(pub.Retry()) * time.Millisecond)
+				}
+				if len(pub.Id()) > 0 && !stream.manualAck {
+					stream.setLastEventID(pub.Id())
 				}
-				if len(pub.Id()) > 0 {
-					stream.lastEventID = pub.Id()
+				if r, ok := stream.retryDelay.(RetryDelayStrategyWithGoodSince); ok {
+					r.SetGoodSince(time.Now())
 				}
-				stream.retryDelay.SetGoodSince(time.Now())
-				stream.Events <- ev
+				if action, ok := stream.controls[pub.Event()]; ok {
+					switch action {
+					case ControlActionRestart, ControlActionResetIDAndRestart:
+						if stream.req == nil { // see above
+							stream.Close()
+							discardCurrentStream()
+							break NewStream
+						}
+						if action == ControlActionResetIDAndRestart {
+							stream.setLastEventID("")
+							stream.req.Header.Del("Last-Event-ID")
+						}
+						discardCurrentStream()
+						scheduleRetry()
+						continue NewStream
+					case ControlActionClose:
+						stream.Close()
+						discardCurrentStream()
+						break NewStream
+					}
+				}
+				if stream.dropBadJSON && !json.Valid([]byte(pub.Data())) {
+					if stream.onBadJSON != nil {
+						stream.onBadJSON(ev)
+					}
+					continue
+				}
+				stream.eventCount++
+				stream.deliver(ev)
+			case <-progressCh:
+				stream.onProgress(stream.LastEventID(), stream.eventCount)
 			case <-stream.closer:
 				discardCurrentStream()
 				break NewStream
 			case <-retryChan:
 				var err error
-				r, err = stream.connect()
+				r, err = stream.connect(stream.req.Context(), attempt)
 				if err != nil {
 					r = nil
-					if !reportErrorAndMaybeContinue(err) {
+					if !reportErrorAndMaybeContinue(err) || !countFailure(false) {
+						break NewStream
+					}
+					if !stream.canRetry { // see failConnection
+						stream.Close()
 						break NewStream
 					}
+					reconnectingAfterFailure = true
 					scheduleRetry()
+				} else {
+					if stream.onReconnect != nil && reconnectingAfterFailure {
+						stream.onReconnect(attempt, stream.LastEventID())
+					}
+					reconnectingAfterFailure = false
+					attempt = 0
+					connectedTime = time.Now()
+					circuitHalfOpen = false
 				}
 				continue NewStream
 			}
 		}
 	}
 
+	stream.states.notify(StateClosed)
 	if stream.Errors != nil {
 		close(stream.Errors)
 	}
 	close(stream.Events)
+	stream.mu.Lock()
+	for _, ch := range stream.typeChans {
+		close(ch)
+	}
+	stream.chansClosed = true
+	stream.mu.Unlock()
+	close(stream.done)
+}
+
+// Returns true if the request can safely be sent again, using the same rules as Go's HTTP client.
+func isIdempotentRequest(req *http.Request) bool {
+	switch req.Method {
+	case "", "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	if _, ok := req.Header["Idempotency-Key"]; ok {
+		return true
+	}
+	if _, ok := req.Header["X-Idempotency-Key"]; ok {
+		return true
+	}
+	return false
+}
+
+// Computes the delay before the next reconnection attempt, applying StreamOptionReconnectDelayFunc if
+// it was specified.
+func (stream *Stream) nextRetryDelay(attempt int) time.Duration {
+	delay := stream.retryDelay.NextRetryDelay(time.Now())
+	if stream.delayFunc != nil {
+		delay = stream.delayFunc(delay, attempt)
+	}
+	return delay
+}
+
+func (stream *Stream) applyRetryDirective(retry time.Duration) {
+	if stream.onRetry != nil {
+		stream.onRetry(retry, stream.config.InitialRetry)
+	}
+	if retry < stream.minRetry {
+		retry = stream.minRetry
+	}
+	switch stream.retryMode {
+	case RetryDirectiveSetFloor:
+		if r, ok := stream.retryDelay.(RetryDelayStrategyWithMinDelay); ok {
+			r.SetMinDelay(retry)
+		}
+	default:
+		if r, ok := stream.retryDelay.(RetryDelayStrategyWithBaseDelay); ok {
+			r.SetBaseDelay(retry)
+		}
+	}
 }
 
 func (stream *Stream) getRetryDelayStrategy() *retryDelayStrategy { // nolint:megacheck // unused except by tests
-	return stream.retryDelay
+	r, _ := stream.retryDelay.(*retryDelayStrategy)
+	return r
+}
+
+// Config returns a snapshot of the options that the stream was created with. This is intended for
+// diagnostic purposes, such as confirming how a stream has been configured in a running system.
+func (stream *Stream) Config() StreamConfig {
+	return stream.config
+}
+
+// EventsForType returns a channel that receives all of the events whose Event() value is name, instead
+// of the Events channel; events of other types still go to Events. Calling it again with the same name
+// returns the same channel. This is a convenient way to handle different kinds of events separately.
+//
+// As with the Events channel, the application must keep reading from the returned channel, since the
+// stream cannot deliver any more events of any type while it is waiting. Only events that are received
+// after EventsForType has been called go to the channel. The channel is closed when the stream has
+// shut down, after the Events channel; if that has already happened, it is returned already closed.
+// This method is safe for concurrent access.
+func (stream *Stream) EventsForType(name string) <-chan Event {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	if ch, ok := stream.typeChans[name]; ok {
+		return ch
+	}
+	ch := make(chan Event, cap(stream.Events))
+	if stream.chansClosed {
+		close(ch)
+	}
+	if stream.typeChans == nil {
+		stream.typeChans = make(map[string]chan Event)
+	}
+	stream.typeChans[name] = ch
+	return ch
+}
+
+// Returns the channel that an event should be delivered to: either one that was created by EventsForType,
+// or the Events channel.
+func (stream *Stream) eventsChannelFor(ev Event) chan Event {
+	stream.mu.RLock()
+	defer stream.mu.RUnlock()
+	if ch, ok := stream.typeChans[ev.Event()]; ok {
+		return ch
+	}
+	return stream.Events
+}
+
+// Sends an event to the channel it should be delivered to. If StreamOptionDropOnFull was used and the
+// channel's buffer is full, the oldest event in the buffer is discarded to make room for it; if the
+// channel is unbuffered and the application is not waiting to receive, the new event is discarded.
+func (stream *Stream) deliver(ev Event) {
+	if stream.manualAck {
+		ev = stream.trackForAck(ev.(*publication))
+	}
+	if stream.onBatch != nil {
+		stream.batch = append(stream.batch, ev)
+		return
+	}
+	ch := stream.eventsChannelFor(ev)
+	if !stream.dropOnFull {
+		ch <- ev
+		return
+	}
+	for {
+		select {
+		case ch <- ev:
+			return
+		default:
+		}
+		if cap(ch) == 0 {
+			stream.countDropped()
+			return
+		}
+		select {
+		case <-ch:
+			stream.countDropped()
+		default: // the application has just taken an event, so there is room now
+		}
+	}
+}
+
+// Passes the events that have accumulated since the last call to the function that was specified with
+// StreamOptionBatchEvents, if any. The decoding goroutine sends a nil Event after each event that was the
+// last one in the data it had read so far, so that the events from a single read are delivered together;
+// the batch is also delivered before an error is reported or the connection is closed.
+func (stream *Stream) deliverBatch() {
+	if len(stream.batch) == 0 {
+		return
+	}
+	batch := stream.batch
+	stream.batch = nil
+	stream.onBatch(batch)
+}
+
+func (stream *Stream) countDropped() {
+	stream.mu.Lock()
+	stream.dropped++
+	stream.mu.Unlock()
+}
+
+// DroppedEventCount returns the number of events that the stream has discarded because the application
+// was not reading them fast enough, if StreamOptionDropOnFull was used. This method is safe for concurrent
+// access.
+func (stream *Stream) DroppedEventCount() int {
+	stream.mu.RLock()
+	defer stream.mu.RUnlock()
+	return stream.dropped
+}
+
+// StreamTimings describes how much time a stream has spent on each event, as returned by Stream.Timings.
+// The durations are cumulative for all events that the stream has delivered, across all connections.
+type StreamTimings struct {
+	// Decode is the total time spent reading and parsing events. This includes the time spent waiting
+	// for data from the server, so it is large if the stream is mostly idle or the server is slow.
+	Decode time.Duration
+	// Send is the total time spent waiting to deliver events to the application, which is the time that
+	// the stream was blocked because the application had not yet read the previous event from the
+	// Events channel. If this is large, the application is not keeping up with the stream.
+	Send time.Duration
+}
+
+// Timings returns a snapshot of the stream's cumulative timings. The stream only records them if it was
+// created with StreamOptionRecordTimings; otherwise, all of the values are zero. This method is safe for
+// concurrent access.
+func (stream *Stream) Timings() StreamTimings {
+	stream.mu.RLock()
+	defer stream.mu.RUnlock()
+	return stream.timings
+}
+
+func (stream *Stream) addTimings(decode, send time.Duration) {
+	stream.mu.Lock()
+	stream.timings.Decode += decode
+	stream.timings.Send += send
+	stream.mu.Unlock()
+}
+
+// LastEventID returns the ID of the most recent event that had an ID, or the ID that was specified with
+// StreamOptionLastEventID if no such event has been received yet. This is the value that the stream
+// sends in the Last-Event-ID header when it reconnects, unless StreamOptionNeverSendLastEventID was
+// used. This method is safe for concurrent access.
+//
+// An application that saves its progress, so that it can resume with StreamOptionLastEventID after a
+// restart, should be aware that the ID is updated as soon as the stream has read the event, which may be
+// before the application has received it from the Events channel. If it matters that every event is
+// processed, save the ID of each event after processing it instead, or use StreamOptionManualAck.
+func (stream *Stream) LastEventID() string {
+	stream.mu.RLock()
+	defer stream.mu.RUnlock()
+	return stream.lastEventID
+}
+
+// An event delivered by a stream that was created with StreamOptionManualAck.
+type ackableEvent struct {
+	*publication
+	stream *Stream
+	acked  bool // guarded by stream.mu
+}
+
+// Ack implements EventWithAck.
+func (e *ackableEvent) Ack() {
+	stream := e.stream
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	e.acked = true
+	for len(stream.unacked) > 0 && stream.unacked[0].acked {
+		if id := stream.unacked[0].Id(); id != "" {
+			stream.lastEventID = id
+		}
+		stream.unacked[0] = nil
+		stream.unacked = stream.unacked[1:]
+	}
+}
+
+func (stream *Stream) trackForAck(pub *publication) *ackableEvent {
+	e := &ackableEvent{publication: pub, stream: stream}
+	stream.mu.Lock()
+	stream.unacked = append(stream.unacked, e)
+	stream.mu.Unlock()
+	return e
+}
+
+func (stream *Stream) setLastEventID(id string) {
+	stream.mu.Lock()
+	stream.lastEventID = id
+	stream.mu.Unlock()
+}
+
+// CapturedHeader returns the value of a response header from the most recent successful connection. The
+// header must have been specified with StreamOptionCaptureHeaders; otherwise, or if the response did not
+// have that header, it returns an empty string. This method is safe for concurrent access.
+func (stream *Stream) CapturedHeader(name string) string {
+	stream.mu.RLock()
+	defer stream.mu.RUnlock()
+	return stream.captured[http.CanonicalHeaderKey(name)]
+}
+
+func (stream *Stream) captureHeaders(header http.Header) {
+	if stream.captured == nil {
+		return
+	}
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	for name := range stream.captured {
+		stream.captured[name] = header.Get(name)
+	}
 }
 
 // SetLogger sets the Logger field in a thread-safe manner.
@@ -2,6 +2,7 @@ package eventsource
 
 import (
 	"io"
+	"net/http"
 	"net/http/httptest"
 	"testing"
 	"time"
@@ -107,3 +108,132 @@ func TestStreamErrorHandlerCanPreventRetryOnExistingConnection(t *testing.T) {
 		t.Error("Timed out waiting for error event")
 	}
 }
+
+func TestStreamReportsInBandErrorEventAndReconnects(t *testing.T) {
+	streamHandler1, streamControl1 := httphelpers.SSEHandler(&httphelpers.SSEEvent{Event: "error", Data: "unauthorized"})
+	defer streamControl1.Close()
+	streamHandler2, streamControl2 := httphelpers.SSEHandler(&httphelpers.SSEEvent{ID: "1", Data: "a"})
+	defer streamControl2.Close()
+	httpServer := httptest.NewServer(httphelpers.SequentialHandler(streamHandler1, streamHandler2))
+	defer httpServer.Close()
+
+	stream := mustSubscribe(t, httpServer.URL,
+		StreamOptionInBandErrorEvent("error"),
+		StreamOptionInitialRetry(time.Millisecond))
+	defer stream.Close()
+
+	select {
+	case err := <-stream.Errors:
+		assert.Equal(t, InBandError{Event: "error", Data: "unauthorized"}, err)
+	case <-time.After(timeToWaitForEvent):
+		t.Fatal("Timed out waiting for error")
+	}
+
+	event := <-stream.Events
+	assert.Equal(t, "a", event.Data())
+
+	// an event with the same name is not treated as an error if it is not the first event
+	streamControl2.Enqueue(httphelpers.SSEEvent{Event: "error", Data: "b"})
+	event = <-stream.Events
+	assert.Equal(t, "b", event.Data())
+}
+
+func TestStreamErrorHandlerCanCloseStreamAfterInBandErrorEvent(t *testing.T) {
+	streamHandler, streamControl := httphelpers.SSEHandler(&httphelpers.SSEEvent{Event: "error", Data: "unauthorized"})
+	defer streamControl.Close()
+	httpServer := httptest.NewServer(streamHandler)
+	defer httpServer.Close()
+
+	stream := mustSubscribe(t, httpServer.URL,
+		StreamOptionInBandErrorEvent("error"),
+		StreamOptionErrorHandler(func(err error) StreamErrorHandlerResult {
+			_, isInBand := err.(InBandError)
+			return StreamErrorHandlerResult{CloseNow: isInBand}
+		}))
+
+	select {
+	case _, ok := <-stream.Events:
+		assert.False(t, ok, "Expected stream.Events channel to be closed")
+	case <-time.After(timeToWaitForEvent):
+		t.Error("Timed out waiting for stream.Events channel to close")
+	}
+}
+
+func TestStreamCanThrottleRepeatedErrors(t *testing.T) {
+	streamHandler, streamControl := httphelpers.SSEHandler(nil)
+	defer streamControl.Close()
+	httpServer := httptest.NewServer(httphelpers.SequentialHandler(streamHandler, httphelpers.HandlerWithStatus(503)))
+	defer httpServer.Close()
+
+	stream := mustSubscribe(t, httpServer.URL,
+		StreamOptionInitialRetry(time.Millisecond*5),
+		StreamOptionErrorThrottle(time.Millisecond*100))
+	defer stream.Close()
+
+	streamControl.EndAll()
+
+	var errs []error
+	deadline := time.After(time.Millisecond * 250)
+ReadLoop:
+	for {
+		select {
+		case err := <-stream.Errors:
+			errs = append(errs, err)
+		case <-deadline:
+			break ReadLoop
+		}
+	}
+
+	// There would be dozens of errors without throttling; we expect the EOF, then the first 503, and then
+	// one or two repeats of the 503.
+	if assert.GreaterOrEqual(t, len(errs), 3) && assert.LessOrEqual(t, len(errs), 4) {
+		assert.Equal(t, io.EOF, errs[0])
+		assert.Equal(t, SubscriptionError{Code: 503}, errs[1])
+		if assert.IsType(t, RepeatedError{}, errs[2]) {
+			repeated := errs[2].(RepeatedError)
+			assert.Equal(t, SubscriptionError{Code: 503}, repeated.Err)
+			assert.Greater(t, repeated.Suppressed, 0)
+		}
+	}
+}
+
+func TestStreamReportsCleanEndAndTruncationAsDifferentErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		body     string
+		hijack   bool
+		expected error
+	}{
+		{"clean end after event", "data: a\n\n", false, io.EOF},
+		{"end in the middle of an event", "data: a\n\ndata: b\n", false, io.ErrUnexpectedEOF},
+		{"end in the middle of a line", "data: a\n\nda", false, io.ErrUnexpectedEOF},
+		{"connection dropped after event", "data: a\n\n", true, io.ErrUnexpectedEOF},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				_, _ = w.Write([]byte(tt.body))
+				w.(http.Flusher).Flush()
+				if tt.hijack {
+					// closing the connection without the final chunk of the chunked response
+					conn, _, err := w.(http.Hijacker).Hijack()
+					if err == nil {
+						_ = conn.Close()
+					}
+				}
+			}))
+			defer httpServer.Close()
+
+			stream := mustSubscribe(t, httpServer.URL, StreamOptionInitialRetry(time.Hour))
+			defer stream.Close()
+
+			<-stream.Events
+			select {
+			case err := <-stream.Errors:
+				assert.Equal(t, tt.expected, err)
+			case <-time.After(time.Second):
+				t.Error("Timed out waiting for error")
+			}
+		})
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/launchdarkly/go-test-helpers/v2/httphelpers"
 )
@@ -130,6 +131,44 @@ func TestStreamCanRetryInitialConnectionUntilFiniteTimeout(t *testing.T) {
 	assert.Equal(t, 2, len(requestsCh))
 }
 
+func TestStreamInitialRetryTimeoutInterruptsConnectionAttemptThatHangs(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done() // never sends a response
+	})
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+
+	start := time.Now()
+	stream, err := SubscribeWithURL(httpServer.URL, StreamOptionCanRetryFirstConnection(100*time.Millisecond))
+	if stream != nil {
+		stream.Close()
+	}
+	assert.Error(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestStreamInitialRetryTimeoutDoesNotLimitSuccessfulConnection(t *testing.T) {
+	streamHandler, streamControl := httphelpers.SSEHandler(nil)
+	defer streamControl.Close()
+	httpServer := httptest.NewServer(streamHandler)
+	defer httpServer.Close()
+
+	stream, err := SubscribeWithURL(httpServer.URL, StreamOptionCanRetryFirstConnection(50*time.Millisecond))
+	require.NoError(t, err)
+	defer stream.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	streamControl.Send(httphelpers.SSEEvent{Data: "a"})
+	select {
+	case ev := <-stream.Events:
+		assert.Equal(t, "a", ev.Data())
+	case err := <-stream.Errors:
+		t.Fatalf("unexpected error: %s", err)
+	case <-time.After(timeToWaitForEvent):
+		t.Fatal("timed out waiting for event")
+	}
+}
+
 func TestStreamErrorHandlerCanAllowRetryOfInitialConnectionAfterNetworkError(t *testing.T) {
 	testStreamErrorHandlerCanAllowRetryOfInitialConnection(t, handlerCausingNetworkError(), shouldBeNetworkError(t))
 }
@@ -194,3 +233,35 @@ func TestStreamErrorHandlerCanPreventRetryOfInitialConnection(t *testing.T) {
 
 	assert.Equal(t, 1, len(requestsCh))
 }
+
+func TestStreamCanRejectUnexpectedContentType(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html></html>"))
+	})
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+
+	stream, err := SubscribeWithURL(httpServer.URL, StreamOptionExpectContentType(true))
+	if stream != nil {
+		stream.Close()
+	}
+	assert.Equal(t, ContentTypeError{ContentType: "text/html"}, err)
+}
+
+func TestStreamAcceptsEventStreamContentType(t *testing.T) {
+	streamHandler, streamControl := httphelpers.SSEHandler(&httphelpers.SSEEvent{Data: "x"})
+	defer streamControl.Close()
+	httpServer := httptest.NewServer(streamHandler)
+	defer httpServer.Close()
+
+	stream := mustSubscribe(t, httpServer.URL, StreamOptionExpectContentType(true))
+	defer stream.Close()
+
+	select {
+	case ev := <-stream.Events:
+		assert.Equal(t, "x", ev.Data())
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+}
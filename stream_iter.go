@@ -0,0 +1,49 @@
+//go:build go1.23
+// +build go1.23
+
+package eventsource
+
+import "iter"
+
+// All returns an iterator over the events and errors received by the stream, so that they can be
+// consumed with a range loop instead of selecting on the Events and Errors channels:
+//
+//	for ev, err := range stream.All() {
+//	    if err != nil {
+//	        log.Printf("stream error: %s", err)
+//	        continue
+//	    }
+//	    handleEvent(ev)
+//	}
+//
+// Each iteration yields either an event with a nil error, or a nil event with an error. If an error
+// handler has been specified with StreamOptionErrorHandler, errors go to the handler instead and the
+// iterator only yields events. The iteration ends when the stream has been closed. Breaking out of the
+// loop does not close the stream.
+//
+// This method is only available in Go 1.23 and later.
+func (stream *Stream) All() iter.Seq2[Event, error] {
+	return func(yield func(Event, error) bool) {
+		events, errs := stream.Events, stream.Errors
+		for events != nil || errs != nil {
+			select {
+			case ev, ok := <-events:
+				if !ok {
+					events = nil
+					continue
+				}
+				if !yield(ev, nil) {
+					return
+				}
+			case err, ok := <-errs:
+				if !ok {
+					errs = nil
+					continue
+				}
+				if !yield(nil, err) {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,55 @@
+//go:build go1.23
+// +build go1.23
+
+package eventsource
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/launchdarkly/go-test-helpers/v2/httphelpers"
+)
+
+func TestStreamAllYieldsEventsAndErrorsUntilClosed(t *testing.T) {
+	streamHandler, streamControl := httphelpers.SSEHandler(nil)
+	defer streamControl.Close()
+	httpServer := httptest.NewServer(streamHandler)
+	defer httpServer.Close()
+
+	stream := mustSubscribe(t, httpServer.URL, StreamOptionInitialRetry(time.Hour))
+	defer stream.Close()
+
+	event := httphelpers.SSEEvent{ID: "123"}
+	streamControl.Enqueue(event)
+	go func() {
+		time.Sleep(timeToWaitForEvent)
+		streamControl.EndAll()
+	}()
+
+	var receivedEvents []Event
+	var receivedErrors []error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ev, err := range stream.All() {
+			if err != nil {
+				receivedErrors = append(receivedErrors, err)
+				stream.Close()
+			} else {
+				receivedEvents = append(receivedEvents, ev)
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for iteration to end")
+	}
+	assert.Equal(t, []Event{toPublication(event)}, receivedEvents)
+	assert.Equal(t, []error{io.EOF}, receivedErrors)
+}
@@ -1,7 +1,9 @@
 package eventsource
 
 import (
+	"io"
 	"net/http"
+	"net/url"
 	"time"
 )
 
@@ -16,6 +18,82 @@ type streamOptions struct {
 	retryResetInterval  time.Duration
 	initialRetryTimeout time.Duration
 	errorHandler        StreamErrorHandler
+	retryOnlyIdempotent bool
+	requestKeepAlive    time.Duration
+	retryDirectiveMode  RetryDirectiveMode
+	lastIDOnReconnect   bool
+	captureHeaders      []string
+	controlEvents       map[string]ControlAction
+	gapObserver         func(time.Duration)
+	dropInvalidJSON     bool
+	onDroppedJSON       func(Event)
+	reconnectDelayFunc  func(time.Duration, int) time.Duration
+	inBandErrorEvent    string
+	errorThrottle       time.Duration
+	preserveFields      bool
+	retryHandler        func(time.Duration, time.Duration)
+	progressInterval    time.Duration
+	progressHandler     func(string, int64)
+	stateListener       func(StreamState)
+	preserveOnRestart   bool
+	maxReconnects       int
+	retryStrategy       RetryDelayStrategy
+	method              string
+	body                func() io.ReadCloser
+	minServerRetry      time.Duration
+	neverSendLastID     bool
+	expectContentType   bool
+	bufferingThreshold  int
+	onBuffering         func()
+	recordTimings       bool
+	initialDataTimeout  time.Duration
+	contentSentinel     func(string) bool
+	rawBytes            bool
+	eventBuffer         int
+	dropOnFull          bool
+	circuitBreaker      circuitBreaker
+	queryParamsFunc     func(url.Values, int) url.Values
+	reconnectHandler    func(int, string)
+	noRedirects         bool
+	manualAck           bool
+	requestHeadersFunc  func() http.Header
+	batchHandler        func([]Event)
+}
+
+// StreamConfig describes the connection and retry settings of a Stream, as returned by Stream.Config.
+// Each field corresponds to a StreamOption; fields for options that were not specified have their default
+// values. It does not describe every option: only the ones that determine how the stream connects, times
+// out, and retries.
+type StreamConfig struct {
+	// InitialRetry is the value set by StreamOptionInitialRetry.
+	InitialRetry time.Duration
+	// BackoffMaxDelay is the value set by StreamOptionUseBackoff; zero means backoff is disabled.
+	BackoffMaxDelay time.Duration
+	// JitterRatio is the value set by StreamOptionUseJitter; zero means jitter is disabled.
+	JitterRatio float64
+	// ReadTimeout is the value set by StreamOptionReadTimeout; zero means there is no read timeout.
+	ReadTimeout time.Duration
+	// RetryResetInterval is the value set by StreamOptionRetryResetInterval.
+	RetryResetInterval time.Duration
+	// InitialRetryTimeout is the value set by StreamOptionCanRetryFirstConnection.
+	InitialRetryTimeout time.Duration
+	// InitialLastEventID is the value set by StreamOptionLastEventID.
+	InitialLastEventID string
+	// MaxReconnectAttempts is the value set by StreamOptionMaxReconnectAttempts; zero means there is no limit.
+	MaxReconnectAttempts int
+}
+
+func (s streamOptions) toConfig() StreamConfig {
+	return StreamConfig{
+		InitialRetry:         s.initialRetry,
+		BackoffMaxDelay:      s.backoffMaxDelay,
+		JitterRatio:          s.jitterRatio,
+		ReadTimeout:          s.readTimeout,
+		RetryResetInterval:   s.retryResetInterval,
+		InitialRetryTimeout:  s.initialRetryTimeout,
+		InitialLastEventID:   s.lastEventID,
+		MaxReconnectAttempts: s.maxReconnects,
+	}
 }
 
 // StreamOption is a common interface for optional configuration parameters that can be
@@ -106,7 +184,9 @@ func (o canRetryFirstConnectionOption) apply(s *streamOptions) error {
 // error result, but will trigger the same retry logic as if an existing connection had failed.
 // The stream constructor will not return until a connection has been made, or until the
 // specified timeout expires, if the timeout is positive; if the timeout is negative, it
-// will continue retrying indefinitely.
+// will continue retrying indefinitely. A positive timeout also applies to a connection attempt
+// that is still in progress, such as a request to a server that never responds: the attempt
+// is cancelled when the timeout expires.
 //
 // The default value is zero: an initial connection failure will not be retried.
 func StreamOptionCanRetryFirstConnection(initialRetryTimeout time.Duration) StreamOption {
@@ -177,6 +257,47 @@ func StreamOptionLastEventID(lastEventID string) StreamOption {
 	return lastEventIDOption{lastEventID: lastEventID}
 }
 
+type lastEventIDOnReconnectOnlyOption struct {
+	onReconnectOnly bool
+}
+
+func (o lastEventIDOnReconnectOnlyOption) apply(s *streamOptions) error {
+	s.lastIDOnReconnect = o.onReconnectOnly
+	return nil
+}
+
+// StreamOptionLastEventIDOnReconnectOnly returns an option that determines whether the Last-Event-ID
+// header is sent on the first connection.
+//
+// If onReconnectOnly is true, the stream does not send a Last-Event-ID header until it has successfully
+// connected once, even if an ID was specified with StreamOptionLastEventID; some servers will attempt to
+// replay events if they see that header. Reconnections after that will send the most recent ID that the
+// stream has received, or the configured ID if none has been received yet. This means the stream starts
+// with live events, but can still resume where it left off if the connection drops.
+//
+// The default value is false: the header is always sent if there is an ID.
+func StreamOptionLastEventIDOnReconnectOnly(onReconnectOnly bool) StreamOption {
+	return lastEventIDOnReconnectOnlyOption{onReconnectOnly}
+}
+
+type neverSendLastEventIDOption struct{}
+
+func (o neverSendLastEventIDOption) apply(s *streamOptions) error {
+	s.neverSendLastID = true
+	return nil
+}
+
+// StreamOptionNeverSendLastEventID returns an option that prevents the stream from ever sending a
+// Last-Event-ID header, even if an ID was specified with StreamOptionLastEventID or the request already
+// had that header. This is for applications that do not want to disclose the IDs they have received to
+// the server, but still want to know them: the stream keeps track of the most recent ID as usual, and it
+// is available from Stream.LastEventID.
+//
+// Note that this means the server cannot resume the stream where it left off after a reconnection.
+func StreamOptionNeverSendLastEventID() StreamOption {
+	return neverSendLastEventIDOption{}
+}
+
 type httpClientOption struct {
 	client *http.Client
 }
@@ -235,6 +356,819 @@ func StreamOptionErrorHandler(handler StreamErrorHandler) StreamOption {
 	return streamErrorHandlerOption{handler}
 }
 
+type retryOnlyIdempotentOption struct {
+	retryOnlyIdempotent bool
+}
+
+func (o retryOnlyIdempotentOption) apply(s *streamOptions) error {
+	s.retryOnlyIdempotent = o.retryOnlyIdempotent
+	return nil
+}
+
+// StreamOptionRetryOnlyIdempotent returns an option that determines whether the stream may
+// automatically reconnect when the request method is not idempotent.
+//
+// If retryOnlyIdempotent is true, and the request uses a method other than GET, HEAD, OPTIONS, or
+// TRACE, the stream will not reconnect after a connection failure; instead, it reports the error
+// and then closes as if Close had been called. This avoids resending a request body to a server
+// that might treat it as a new submission. As with Go's HTTP client, a request that has an
+// "Idempotency-Key" or "X-Idempotency-Key" header is treated as idempotent regardless of its
+// method, so that you can explicitly opt in to retrying a specific request. Calling Restart still
+// causes a reconnection, since that is an explicit request from the caller.
+//
+// The same rule applies to the first connection attempt if StreamOptionCanRetryFirstConnection
+// is used. The default value is false: all requests are retried.
+func StreamOptionRetryOnlyIdempotent(retryOnlyIdempotent bool) StreamOption {
+	return retryOnlyIdempotentOption{retryOnlyIdempotent}
+}
+
+type requestKeepAliveOption struct {
+	interval time.Duration
+}
+
+func (o requestKeepAliveOption) apply(s *streamOptions) error {
+	s.requestKeepAlive = o.interval
+	return nil
+}
+
+// StreamOptionRequestKeepAlive returns an option that causes the stream to periodically write to
+// the request body while the connection is open, for the benefit of proxies that drop connections
+// which do not see any activity from the client.
+//
+// This only applies if the request has a body (such as a POST or REPORT request). In that case, the
+// stream takes control of the request body: it sends the original body through a pipe, and then
+// writes a single newline character to the pipe each time the interval elapses, until the
+// connection is closed. The request is therefore sent with an unknown content length (chunked
+// encoding in HTTP/1.1), and the server must be able to tolerate trailing newlines in the body.
+// Requests without a body are not affected.
+//
+// By default, or if the interval is zero or negative, nothing is written after the original body.
+func StreamOptionRequestKeepAlive(interval time.Duration) StreamOption {
+	return requestKeepAliveOption{interval}
+}
+
+// RetryDirectiveMode is used with StreamOptionRetryDirectiveMode to determine how a "retry:" directive
+// from the server affects the stream's retry delay.
+type RetryDirectiveMode int
+
+const (
+	// RetryDirectiveResetBackoff means that a "retry:" directive replaces the base retry delay and starts
+	// the backoff progression over from that value. This is the default.
+	RetryDirectiveResetBackoff RetryDirectiveMode = iota
+	// RetryDirectiveSetFloor means that a "retry:" directive only sets a minimum for the retry delay. The
+	// configured base delay and the current backoff progression are unchanged, but no delay will be less
+	// than the value from the server.
+	RetryDirectiveSetFloor
+)
+
+type retryDirectiveModeOption struct {
+	mode RetryDirectiveMode
+}
+
+func (o retryDirectiveModeOption) apply(s *streamOptions) error {
+	s.retryDirectiveMode = o.mode
+	return nil
+}
+
+type retryDirectiveHandlerOption struct {
+	handler func(time.Duration, time.Duration)
+}
+
+func (o retryDirectiveHandlerOption) apply(s *streamOptions) error {
+	s.retryHandler = o.handler
+	return nil
+}
+
+// StreamOptionRetryDirectiveHandler returns an option that sets a function to be called whenever the
+// stream applies a "retry:" directive from the server. The parameters are the delay requested by the
+// server, and the base delay that was configured with StreamOptionInitialRetry (or the default).
+//
+// A "retry:" directive silently changes the stream's retry behavior (see StreamOptionRetryDirectiveMode),
+// so this can be used to detect that the server's retry policy does not match the application's, for
+// instance by logging a warning if serverRetry is different from configuredBase. The function is called
+// from the stream's reading goroutine, so it should return quickly.
+func StreamOptionRetryDirectiveHandler(handler func(serverRetry, configuredBase time.Duration)) StreamOption {
+	return retryDirectiveHandlerOption{handler}
+}
+
+// StreamOptionRetryDirectiveMode returns an option that determines how the stream responds when the
+// server sends a "retry:" directive.
+//
+// With the default mode, RetryDirectiveResetBackoff, the server's value becomes the new base delay and
+// the backoff (see StreamOptionUseBackoff) starts over, so the next reconnection will use that value
+// (minus jitter) and subsequent ones will increase from there. With RetryDirectiveSetFloor, the server's
+// value is only used as a lower bound: the backoff continues from wherever it was, but a delay will
+// never be shorter than what the server requested.
+func StreamOptionRetryDirectiveMode(mode RetryDirectiveMode) StreamOption {
+	return retryDirectiveModeOption{mode}
+}
+
+type captureHeadersOption struct {
+	names []string
+}
+
+func (o captureHeadersOption) apply(s *streamOptions) error {
+	for _, name := range o.names {
+		s.captureHeaders = append(s.captureHeaders, http.CanonicalHeaderKey(name))
+	}
+	return nil
+}
+
+// StreamOptionCaptureHeaders returns an option that causes the stream to remember the values of the
+// specified response headers, which can then be retrieved with Stream.CapturedHeader. This is meant for
+// diagnostic headers such as Server-Timing, where the application only cares about a few known names.
+//
+// The values are updated each time the stream successfully connects, so after a reconnection they
+// reflect the most recent response. If the most recent response did not have one of the headers, its
+// value is an empty string.
+func StreamOptionCaptureHeaders(names ...string) StreamOption {
+	return captureHeadersOption{names}
+}
+
+type interEventGapObserverOption struct {
+	observer func(time.Duration)
+}
+
+func (o interEventGapObserverOption) apply(s *streamOptions) error {
+	s.gapObserver = o.observer
+	return nil
+}
+
+// StreamOptionInterEventGapObserver returns an option that sets a function to be called whenever the
+// stream reads a line of data, including comments and the blank lines between events. The parameter is
+// the time since the previous line was read on the same connection, or, for the first line, since the
+// connection was made.
+//
+// The gap is measured in the same way as the read timeout (see StreamOptionReadTimeout), so collecting
+// these values over time is a good way to choose a read timeout: for instance, a value somewhat greater
+// than the 99th percentile of observed gaps. The function is called from the stream's reading goroutine,
+// so it should return quickly and must be safe to call concurrently with the application's own code.
+func StreamOptionInterEventGapObserver(observer func(gap time.Duration)) StreamOption {
+	return interEventGapObserverOption{observer}
+}
+
+type dropInvalidJSONOption struct {
+	onDropped func(Event)
+}
+
+func (o dropInvalidJSONOption) apply(s *streamOptions) error {
+	s.dropInvalidJSON = true
+	s.onDroppedJSON = o.onDropped
+	return nil
+}
+
+// StreamOptionDropInvalidJSON returns an option that causes the stream to discard any event whose data is
+// not valid JSON, rather than delivering it on the Events channel. This includes events with no data.
+//
+// If onDropped is not nil, it is called with each event that is discarded, from the stream's reading
+// goroutine; this can be used for logging or for counting bad events. The ID of a discarded event is
+// still used as the last event ID, so that the stream resumes from the right place if it reconnects.
+func StreamOptionDropInvalidJSON(onDropped func(Event)) StreamOption {
+	return dropInvalidJSONOption{onDropped}
+}
+
+type reconnectDelayFuncOption struct {
+	delayFunc func(time.Duration, int) time.Duration
+}
+
+func (o reconnectDelayFuncOption) apply(s *streamOptions) error {
+	s.reconnectDelayFunc = o.delayFunc
+	return nil
+}
+
+// StreamOptionReconnectDelayFunc returns an option that lets the application adjust each reconnection
+// delay. Whenever the stream is about to wait before reconnecting, it first computes the delay as usual
+// (based on StreamOptionInitialRetry, StreamOptionUseBackoff, etc.), and then calls delayFunc with that
+// value; the stream waits for whatever duration delayFunc returns instead.
+//
+// The attempt parameter is 1 for the first reconnection attempt after a successful connection, and
+// increases by 1 for each consecutive attempt that fails. The same applies to retries of the initial
+// connection if StreamOptionCanRetryFirstConnection is used.
+//
+// Changing the delay does not affect the stream's backoff state; the next computed delay will be the
+// same as if delayFunc had not been used.
+func StreamOptionReconnectDelayFunc(delayFunc func(computed time.Duration, attempt int) time.Duration) StreamOption {
+	return reconnectDelayFuncOption{delayFunc}
+}
+
+type inBandErrorEventOption struct {
+	eventName string
+}
+
+func (o inBandErrorEventOption) apply(s *streamOptions) error {
+	s.inBandErrorEvent = o.eventName
+	return nil
+}
+
+// StreamOptionInBandErrorEvent returns an option for servers that report errors with an event, because
+// they have already sent a successful HTTP status by the time they know there is a problem. If the first
+// event on a connection has the specified name, the stream treats it as a failure of the connection: it
+// reports an InBandError containing the event's data, and then reconnects in the same way as if there
+// had been a network error, instead of delivering the event on the Events channel.
+//
+// Like any other error, the InBandError is sent to the Errors channel, or to the error handler if one was
+// specified with StreamOptionErrorHandler. To stop the stream instead of reconnecting, the error handler
+// can return a StreamErrorHandlerResult with CloseNow set to true, or the application can call Close.
+// An event with the same name that is not the first event on the connection is delivered normally.
+func StreamOptionInBandErrorEvent(eventName string) StreamOption {
+	return inBandErrorEventOption{eventName}
+}
+
+type errorThrottleOption struct {
+	interval time.Duration
+}
+
+func (o errorThrottleOption) apply(s *streamOptions) error {
+	s.errorThrottle = o.interval
+	return nil
+}
+
+// StreamOptionErrorThrottle returns an option that limits how often the stream sends the same error to
+// the Errors channel. This is useful if the server is failing quickly and repeatedly, and the retry delay
+// is short, so that the application does not have to deal with a flood of identical errors.
+//
+// If an error has the same message as the last error that was sent to the channel, and less than the
+// specified interval has passed since then, it is not sent. The next time that error is sent, after the
+// interval has passed, it is wrapped in a RepeatedError that says how many times it was not sent. Errors
+// with a different message are always sent. The stream's reconnection behavior is not affected.
+//
+// This option has no effect if StreamOptionErrorHandler is used; the error handler is always called for
+// every error.
+func StreamOptionErrorThrottle(interval time.Duration) StreamOption {
+	return errorThrottleOption{interval}
+}
+
+type preserveFieldsOption struct {
+	preserveFields bool
+}
+
+func (o preserveFieldsOption) apply(s *streamOptions) error {
+	s.preserveFields = o.preserveFields
+	return nil
+}
+
+// StreamOptionPreserveFields returns an option that determines whether events received by the stream
+// keep a list of all their fields, including unrecognized ones. This is the same as the Decoder option
+// DecoderOptionPreserveFields; see that function and Encoder.EncodeExact.
+func StreamOptionPreserveFields(preserveFields bool) StreamOption {
+	return preserveFieldsOption{preserveFields}
+}
+
+type progressIntervalOption struct {
+	interval time.Duration
+	handler  func(string, int64)
+}
+
+func (o progressIntervalOption) apply(s *streamOptions) error {
+	if o.interval > 0 && o.handler != nil {
+		s.progressInterval = o.interval
+		s.progressHandler = o.handler
+	} else {
+		s.progressInterval = 0
+		s.progressHandler = nil
+	}
+	return nil
+}
+
+// StreamOptionProgressInterval returns an option that causes the stream to call a function at regular
+// intervals with its current progress: the last event ID that it has received (the same value that it
+// would send in a Last-Event-ID header if it reconnected now), and the total number of events it has
+// received since it was created. This can be used to report the state of a long-running stream, or to
+// save the last event ID somewhere so that a new stream can resume from it later.
+//
+// The function is called from the stream's reading goroutine, so it should return quickly; it will not
+// be called while the stream is waiting for the application to read from the Events channel. It is
+// called regardless of whether the stream is currently connected, and stops being called when the
+// stream is closed. If the interval is zero or negative, or the function is nil, this option has no
+// effect.
+func StreamOptionProgressInterval(interval time.Duration, handler func(lastEventID string, events int64)) StreamOption {
+	return progressIntervalOption{interval, handler}
+}
+
+type stateListenerOption struct {
+	listener func(StreamState)
+}
+
+func (o stateListenerOption) apply(s *streamOptions) error {
+	s.stateListener = o.listener
+	return nil
+}
+
+// StreamOptionStateListener returns an option that sets a function to be called whenever the stream's
+// connection state changes: when it starts a connection attempt (StateConnecting), when the server
+// accepts the request (StateOpen), when it is waiting to retry after a failure (StateWaitingToReconnect),
+// and when it has been closed permanently (StateClosed). This is useful for showing connection status in
+// a UI or a health check, or for debugging unreliable connections.
+//
+// The function is called on a separate goroutine, so it cannot delay the stream, but it is always called
+// with the states in the order that they occurred. If the stream fails to start, so that the Subscribe
+// function returns an error, the last state is still StateClosed.
+func StreamOptionStateListener(listener func(StreamState)) StreamOption {
+	return stateListenerOption{listener}
+}
+
+type preserveOnRestartOption struct{}
+
+func (o preserveOnRestartOption) apply(s *streamOptions) error {
+	s.preserveOnRestart = true
+	return nil
+}
+
+// StreamOptionPreserveOnRestart returns an option that changes what happens to events that have already
+// been read from the connection, but not yet delivered to the Events channel, when Stream.Restart is
+// called. By default they are discarded, so the application only gets them again if the server replays
+// them based on the Last-Event-ID header. With this option, they are delivered to the Events channel
+// before the stream reconnects.
+//
+// The preserved events are delivered in the order they were received, and all of them are delivered
+// before any event from the new connection; the Last-Event-ID for the new connection takes their IDs
+// into account. Only events that were fully received before the connection was closed are preserved.
+// The retry delay does not start until the application has read all of them from the Events channel.
+// This option does not apply when the connection fails or is ended by a control event (see
+// StreamOptionControlEvents).
+func StreamOptionPreserveOnRestart() StreamOption {
+	return preserveOnRestartOption{}
+}
+
+type maxReconnectAttemptsOption struct {
+	maxAttempts int
+}
+
+func (o maxReconnectAttemptsOption) apply(s *streamOptions) error {
+	if o.maxAttempts > 0 {
+		s.maxReconnects = o.maxAttempts
+	} else {
+		s.maxReconnects = 0
+	}
+	return nil
+}
+
+// StreamOptionMaxReconnectAttempts returns an option that makes the stream give up if it fails to
+// reconnect the specified number of times in a row. When that happens, the stream sends
+// ErrMaxRetriesExceeded to the Errors channel (or the error handler), after the error from the last
+// attempt, and then closes itself as if Close had been called.
+//
+// A connection attempt fails if the request could not be made or the server returned an error status.
+// A connection that ends before it has been open for the retry reset interval (see
+// StreamOptionRetryResetInterval) also counts as a failure; one that ends after that resets the count
+// to zero. This only applies after the stream has been created; to control retrying of the initial
+// connection, use StreamOptionCanRetryFirstConnection.
+//
+// By default, or if the value is zero or negative, the stream retries indefinitely.
+func StreamOptionMaxReconnectAttempts(maxAttempts int) StreamOption {
+	return maxReconnectAttemptsOption{maxAttempts}
+}
+
+type retryStrategyOption struct {
+	strategy RetryDelayStrategy
+}
+
+func (o retryStrategyOption) apply(s *streamOptions) error {
+	s.retryStrategy = o.strategy
+	return nil
+}
+
+// StreamOptionRetryStrategy returns an option that replaces the stream's built-in computation of
+// reconnection delays with a custom implementation, such as a fixed schedule of delays. See
+// RetryDelayStrategy.
+//
+// If this option is used, StreamOptionUseBackoff, StreamOptionUseJitter, and
+// StreamOptionRetryResetInterval have no effect, and StreamOptionInitialRetry only affects the value that
+// is passed to a function set with StreamOptionRetryDirectiveHandler. StreamOptionReconnectDelayFunc still
+// applies to the delays computed by the custom strategy. A nil strategy restores the default behavior.
+func StreamOptionRetryStrategy(strategy RetryDelayStrategy) StreamOption {
+	return retryStrategyOption{strategy}
+}
+
+type methodOption struct {
+	method string
+}
+
+func (o methodOption) apply(s *streamOptions) error {
+	s.method = o.method
+	return nil
+}
+
+// StreamOptionMethod returns an option that sets the HTTP method of the request, such as "POST" or
+// "REPORT", when the stream is created with SubscribeWithURL; the default is "GET". It has no effect
+// with the Subscribe functions that take an http.Request, since the request already has a method.
+//
+// Requests with methods other than GET might not be retried; see StreamOptionRetryOnlyIdempotent.
+func StreamOptionMethod(method string) StreamOption {
+	return methodOption{method}
+}
+
+type bodyOption struct {
+	body func() io.ReadCloser
+}
+
+func (o bodyOption) apply(s *streamOptions) error {
+	s.body = o.body
+	return nil
+}
+
+// StreamOptionBody returns an option that sets the body of the request when the stream is created with
+// SubscribeWithURL; this is normally used together with StreamOptionMethod. It has no effect with the
+// Subscribe functions that take an http.Request, since the request already has a body.
+//
+// The function is called to get a new copy of the body for each connection attempt, so it must return
+// the same content every time. The request is sent with an unknown content length (chunked encoding in
+// HTTP/1.1).
+func StreamOptionBody(body func() io.ReadCloser) StreamOption {
+	return bodyOption{body}
+}
+
+type minServerRetryOption struct {
+	minRetry time.Duration
+}
+
+func (o minServerRetryOption) apply(s *streamOptions) error {
+	s.minServerRetry = o.minRetry
+	return nil
+}
+
+// StreamOptionMinServerRetry returns an option that sets a lower limit for the delay that the server
+// can request with a "retry:" directive. If the server asks for a shorter delay, this value is used
+// instead. This guards against a misconfigured or malicious server that
+// tells clients to reconnect too aggressively.
+//
+// A function set with StreamOptionRetryDirectiveHandler still receives the value that the server sent.
+// A "retry:" directive of zero is always ignored. By default, there is no limit.
+func StreamOptionMinServerRetry(minRetry time.Duration) StreamOption {
+	return minServerRetryOption{minRetry}
+}
+
+type expectContentTypeOption struct {
+	expect bool
+}
+
+func (o expectContentTypeOption) apply(s *streamOptions) error {
+	s.expectContentType = o.expect
+	return nil
+}
+
+// StreamOptionExpectContentType returns an option that determines whether the stream checks the
+// Content-Type of the server's response, as the SSE specification requires.
+//
+// If expect is true, a response whose media type is not "text/event-stream" (parameters such as charset
+// are ignored) is treated as a failed connection attempt, with a ContentTypeError. This makes it easier to
+// diagnose a misconfigured endpoint that returns some other content, such as an HTML page, with a 200
+// status. The default value is false, meaning that the response is read as a stream regardless of its
+// Content-Type.
+func StreamOptionExpectContentType(expect bool) StreamOption {
+	return expectContentTypeOption{expect}
+}
+
+type bufferingDetectorOption struct {
+	threshold int
+	handler   func()
+}
+
+func (o bufferingDetectorOption) apply(s *streamOptions) error {
+	if o.handler != nil && o.threshold > 0 {
+		s.bufferingThreshold = o.threshold
+		s.onBuffering = o.handler
+	}
+	return nil
+}
+
+// StreamOptionBufferingDetector returns an option that helps to detect a proxy or other intermediary that
+// buffers the response, so that events are delivered in delayed batches rather than as soon as the server
+// sends them.
+//
+// The stream calls the handler whenever more than threshold complete events are received in a single read
+// from the connection, which would be unusual for a stream that is really being delivered in real time.
+// Since a single read is limited to the size of the Decoder's buffer (currently 4096 bytes), the threshold
+// should be small enough for that many events to fit in it. The handler is called from the goroutine that
+// reads the stream, so it should return quickly. This option has no effect if threshold is not positive.
+func StreamOptionBufferingDetector(threshold int, handler func()) StreamOption {
+	return bufferingDetectorOption{threshold: threshold, handler: handler}
+}
+
+type recordTimingsOption struct{}
+
+func (o recordTimingsOption) apply(s *streamOptions) error {
+	s.recordTimings = true
+	return nil
+}
+
+// StreamOptionRecordTimings returns an option that makes the stream keep track of how much time it spends
+// reading events and delivering them to the application, which can be obtained from Stream.Timings. This
+// is meant for profiling a consumer of a high-rate stream. By default, timings are not recorded.
+func StreamOptionRecordTimings() StreamOption {
+	return recordTimingsOption{}
+}
+
+type initialDataTimeoutOption struct {
+	timeout time.Duration
+}
+
+func (o initialDataTimeoutOption) apply(s *streamOptions) error {
+	s.initialDataTimeout = o.timeout
+	return nil
+}
+
+// StreamOptionInitialDataTimeout returns an option that sets how long the stream will wait, after the
+// server has accepted a connection, for the first data to arrive on it. If nothing at all is received
+// within that time, not even a comment, the stream reports ErrInitialDataTimeout and reconnects as it
+// would after any other connection failure.
+//
+// This helps to distinguish a connection that is not working, for instance because a proxy is buffering
+// the response, from a healthy stream that has no events to send yet, as long as the server sends some
+// data (such as a comment) as soon as a client connects. Unlike StreamOptionReadTimeout, it only applies
+// until the first data is received. By default, there is no timeout.
+func StreamOptionInitialDataTimeout(timeout time.Duration) StreamOption {
+	return initialDataTimeoutOption{timeout}
+}
+
+type contentSentinelOption struct {
+	sentinel func(string) bool
+}
+
+func (o contentSentinelOption) apply(s *streamOptions) error {
+	s.contentSentinel = o.sentinel
+	return nil
+}
+
+// StreamOptionContentSentinel returns an option that sets a function for detecting a response that has
+// stopped being a valid stream, such as a server that starts sending an HTML error page in the middle of
+// the stream without closing the connection.
+//
+// The function is called for every line that the stream reads, without the line ending; this includes
+// comments and the blank lines between events. If it returns true, the stream discards the event that it
+// was reading, reports a DecodeError with ErrUnexpectedContent, and reconnects as it would after any
+// other connection failure. For instance, the function could check whether the line starts with "<". It
+// is called from the stream's reading goroutine, so it should return quickly.
+func StreamOptionContentSentinel(sentinel func(line string) bool) StreamOption {
+	return contentSentinelOption{sentinel}
+}
+
+type withRawBytesOption struct{}
+
+func (o withRawBytesOption) apply(s *streamOptions) error {
+	s.rawBytes = true
+	return nil
+}
+
+// StreamOptionWithRawBytes returns an option that makes the stream keep the exact bytes that each event
+// was decoded from, which can be obtained by casting the Event to EventWithRawBytes. This is meant for
+// verifying a signature over the data that the server sent. See DecoderOptionRawBytes for details.
+func StreamOptionWithRawBytes() StreamOption {
+	return withRawBytesOption{}
+}
+
+type eventBufferOption struct {
+	size int
+}
+
+func (o eventBufferOption) apply(s *streamOptions) error {
+	if o.size > 0 {
+		s.eventBuffer = o.size
+	}
+	return nil
+}
+
+// StreamOptionEventBuffer returns an option that gives the stream's Events channel (and any channels
+// created with Stream.EventsForType) a buffer of the specified size. By default, the channel is
+// unbuffered, so the stream cannot read anything more from the connection until the application has
+// received the previous event; if the application is slow, this can even cause a read timeout (see
+// StreamOptionReadTimeout). A buffer allows the stream to keep reading while the application catches up.
+func StreamOptionEventBuffer(size int) StreamOption {
+	return eventBufferOption{size}
+}
+
+type dropOnFullOption struct {
+	dropOnFull bool
+}
+
+func (o dropOnFullOption) apply(s *streamOptions) error {
+	s.dropOnFull = o.dropOnFull
+	return nil
+}
+
+// StreamOptionDropOnFull returns an option that determines what the stream does with a new event when
+// the application has not yet received the events that are already waiting in the Events channel.
+//
+// By default, or if dropOnFull is false, the stream waits until there is room. If dropOnFull is true, it
+// discards the oldest event in the channel's buffer (see StreamOptionEventBuffer) instead, so that the
+// application gets the most recent events when it catches up; if there is no buffer, it discards the
+// new event unless the application is already waiting for one. Either way, the event is counted by
+// Stream.DroppedEventCount. This is only appropriate for applications that can tolerate losing events.
+func StreamOptionDropOnFull(dropOnFull bool) StreamOption {
+	return dropOnFullOption{dropOnFull}
+}
+
+type circuitBreaker struct {
+	maxAttempts int
+	window      time.Duration
+	cooldown    time.Duration
+}
+
+type circuitBreakerOption struct {
+	breaker circuitBreaker
+}
+
+func (o circuitBreakerOption) apply(s *streamOptions) error {
+	if o.breaker.maxAttempts > 0 && o.breaker.window > 0 {
+		s.circuitBreaker = o.breaker
+	}
+	return nil
+}
+
+// StreamOptionCircuitBreaker returns an option that protects a struggling server from a stream that keeps
+// reconnecting. If the stream has to reconnect more than maxAttempts times within any period of length
+// window, whether because connection attempts are failing or because connections are being closed soon
+// after they are made, it waits for the cooldown period before trying again.
+//
+// After the cooldown, the stream makes a single trial attempt. If that fails, it waits for the cooldown
+// period again, and so on; once a connection succeeds, the stream starts counting attempts over again.
+// The cooldown does not shorten the usual retry delay if that is longer. This option has no effect if
+// maxAttempts or window is not positive.
+func StreamOptionCircuitBreaker(maxAttempts int, window, cooldown time.Duration) StreamOption {
+	return circuitBreakerOption{circuitBreaker{maxAttempts: maxAttempts, window: window, cooldown: cooldown}}
+}
+
+type dynamicQueryParamsOption struct {
+	queryParams func(url.Values, int) url.Values
+}
+
+func (o dynamicQueryParamsOption) apply(s *streamOptions) error {
+	s.queryParamsFunc = o.queryParams
+	return nil
+}
+
+// StreamOptionDynamicQueryParams returns an option that sets a function for changing the query parameters
+// of the request's URL each time the stream connects, for instance to tell the server which reconnection
+// attempt a request represents, or to send a token that may have changed since the last connection.
+//
+// The function is called with the query parameters of the original request URL, which it may modify, and
+// returns the parameters to use. The attempt parameter is zero for the first connection, and otherwise
+// is the number of consecutive attempts that have been made since the last successful connection,
+// including this one; so it is 1 for the first reconnection after a connection ends.
+func StreamOptionDynamicQueryParams(queryParams func(existing url.Values, attempt int) url.Values) StreamOption {
+	return dynamicQueryParamsOption{queryParams}
+}
+
+type reconnectHandlerOption struct {
+	handler func(int, string)
+}
+
+func (o reconnectHandlerOption) apply(s *streamOptions) error {
+	s.reconnectHandler = o.handler
+	return nil
+}
+
+// StreamOptionReconnectHandler returns an option that sets a function to be called whenever the stream
+// has successfully reconnected after a connection ended or failed, for instance to clear an "offline"
+// indicator or to request the full current state from the application's backend. It is not called for
+// the first connection, even if that took several attempts (see StreamOptionCanRetryFirstConnection), or
+// when the stream reconnects because of Stream.Restart or a control event (see StreamOptionControlEvents)
+// without the connection having failed.
+//
+// The attempt parameter is the number of consecutive attempts it took to reconnect, including the
+// successful one, and lastEventID is the last event ID that the stream had received (see
+// Stream.LastEventID). The function is called synchronously from the stream's goroutine before any
+// events are read from the new connection, so it should return quickly.
+func StreamOptionReconnectHandler(handler func(attempt int, lastEventID string)) StreamOption {
+	return reconnectHandlerOption{handler}
+}
+
+type followRedirectsOption struct {
+	followRedirects bool
+}
+
+func (o followRedirectsOption) apply(s *streamOptions) error {
+	s.noRedirects = !o.followRedirects
+	return nil
+}
+
+// StreamOptionFollowRedirects returns an option that determines whether the stream follows HTTP redirects.
+//
+// By default, or if followRedirects is true, redirects are followed as usual for the HTTP client, and if
+// there are too many of them, the stream reports ErrTooManyRedirects. If followRedirects is false, a
+// redirect response is treated as a failed connection attempt, with a SubscriptionError whose Code is
+// the 3xx status; this can make it easier to find out why a stream is not reaching the intended endpoint.
+//
+// In either case, if the HTTP client's CheckRedirect function would be replaced, the stream makes its
+// own copy of the client rather than modifying the one that was specified with StreamOptionHTTPClient.
+func StreamOptionFollowRedirects(followRedirects bool) StreamOption {
+	return followRedirectsOption{followRedirects}
+}
+
+type manualAckOption struct{}
+
+func (o manualAckOption) apply(s *streamOptions) error {
+	s.manualAck = true
+	return nil
+}
+
+// StreamOptionManualAck returns an option that makes the stream's last event ID advance only when the
+// application acknowledges events, for at-least-once processing: if the stream reconnects, the server is
+// asked for everything after the last acknowledged event, so an event that was received but not fully
+// processed will be sent again.
+//
+// Each event that the stream delivers implements EventWithAck, and the application should call Ack once it
+// has finished with the event. Events can be acknowledged in any order, but Stream.LastEventID (and the
+// Last-Event-ID header on reconnection) only advances past an event once it and all of the events that
+// were delivered before it have been acknowledged. After a reconnection, acknowledging an event from the
+// previous connection has no effect, since the server will send it again. The stream keeps track of every
+// event that has not been acknowledged yet, so an application that uses this option must acknowledge
+// every event, including ones without an ID.
+func StreamOptionManualAck() StreamOption {
+	return manualAckOption{}
+}
+
+type requestHeadersFuncOption struct {
+	headersFunc func() http.Header
+}
+
+func (o requestHeadersFuncOption) apply(s *streamOptions) error {
+	s.requestHeadersFunc = o.headersFunc
+	return nil
+}
+
+// StreamOptionRequestHeadersFunc returns an option that sets a function to be called before each
+// connection attempt, to get headers to add to the request: for instance, a bearer token that has to be
+// refreshed periodically, so that it cannot simply be set in the original request.
+//
+// Each header that the function returns replaces any header with the same name in the request, including
+// the ones that the stream sets itself (Accept, Cache-Control, and Last-Event-ID); all other headers are
+// sent as usual. The original request is not modified, so a header returned by one call is not sent again
+// unless it is returned by the next call too.
+func StreamOptionRequestHeadersFunc(headersFunc func() http.Header) StreamOption {
+	return requestHeadersFuncOption{headersFunc}
+}
+
+type batchEventsOption struct {
+	handler func([]Event)
+}
+
+func (o batchEventsOption) apply(s *streamOptions) error {
+	s.batchHandler = o.handler
+	return nil
+}
+
+// StreamOptionBatchEvents returns an option that makes the stream pass events to a function in batches,
+// instead of sending them one at a time on the Events channel; this can be more efficient for an
+// application that processes events in bulk. Each batch contains all of the events that could be decoded
+// from the data that the stream had read at once, so if the server sends many events in quick succession
+// they are likely to arrive together, but a batch can also contain just one event.
+//
+// When this option is used, every event is passed to the function, including events whose type was
+// requested with Stream.EventsForType, and nothing is sent on the Events channel. The function is called
+// synchronously from the stream's goroutine, so the stream does not read any more events until it returns;
+// the slice is not used by the stream afterward. Any events that are waiting to be passed to the function
+// when the stream encounters an error or is restarted are passed to it first.
+func StreamOptionBatchEvents(handler func(events []Event)) StreamOption {
+	return batchEventsOption{handler}
+}
+
+// ControlAction is an action that the stream takes when it receives a control event. See
+// StreamOptionControlEvents.
+type ControlAction int
+
+const (
+	// ControlActionRestart means that the stream drops the current connection and reconnects, in the
+	// same way as if Stream.Restart had been called.
+	ControlActionRestart ControlAction = iota + 1
+	// ControlActionResetIDAndRestart is the same as ControlActionRestart, except that the stream also
+	// forgets the last event ID, so that the new request will not have a Last-Event-ID header.
+	ControlActionResetIDAndRestart
+	// ControlActionClose means that the stream is closed permanently, as if Stream.Close had been called.
+	ControlActionClose
+)
+
+type controlEventsOption struct {
+	actions map[string]ControlAction
+}
+
+func (o controlEventsOption) apply(s *streamOptions) error {
+	s.controlEvents = copyControlEvents(o.actions)
+	return nil
+}
+
+// StreamOptionControlEvents returns an option that designates certain event names as control signals
+// from the server. When the stream receives an event whose name is a key in the map, it performs the
+// corresponding ControlAction instead of delivering the event on the Events channel.
+//
+// The ID and retry fields of a control event are processed as usual, before the action is taken; so,
+// for instance, a control event with an ID and ControlActionRestart will cause the stream to send that
+// ID in the Last-Event-ID header when it reconnects.
+func StreamOptionControlEvents(actions map[string]ControlAction) StreamOption {
+	return controlEventsOption{actions}
+}
+
+func copyControlEvents(actions map[string]ControlAction) map[string]ControlAction {
+	if actions == nil {
+		return nil
+	}
+	ret := make(map[string]ControlAction, len(actions))
+	for name, action := range actions {
+		ret[name] = action
+	}
+	return ret
+}
+
 const (
 	// DefaultInitialRetry is the default value for StreamOptionalInitialRetry.
 	DefaultInitialRetry = time.Second * 3
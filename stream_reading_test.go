@@ -1,11 +1,20 @@
 package eventsource
 
 import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/launchdarkly/go-test-helpers/v2/httphelpers"
 )
@@ -23,7 +32,7 @@ func TestStreamSubscribeEventsChan(t *testing.T) {
 
 	select {
 	case receivedEvent := <-stream.Events:
-		assert.Equal(t, &publication{id: "123"}, receivedEvent)
+		assert.Equal(t, &publication{id: "123", dataLineCount: 1}, receivedEvent)
 	case <-time.After(timeToWaitForEvent):
 		t.Error("Timed out waiting for event")
 	}
@@ -97,6 +106,40 @@ ReadLoop:
 	}
 }
 
+func TestStreamInitialDataTimeout(t *testing.T) {
+	streamHandler1, streamControl1 := httphelpers.SSEHandler(nil)
+	defer streamControl1.Close()
+	streamHandler2, streamControl2 := httphelpers.SSEHandler(&httphelpers.SSEEvent{ID: "123"})
+	defer streamControl2.Close()
+	httpServer := httptest.NewServer(httphelpers.SequentialHandler(streamHandler1, streamHandler2))
+	defer httpServer.Close()
+
+	stream := mustSubscribe(t, httpServer.URL, StreamOptionInitialDataTimeout(time.Millisecond*50),
+		StreamOptionInitialRetry(time.Millisecond))
+	defer stream.Close()
+
+	select {
+	case err := <-stream.Errors:
+		assert.Equal(t, ErrInitialDataTimeout, err)
+		assert.Equal(t, StreamErrorTimeout, ClassifyStreamError(err))
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for error")
+	}
+	select {
+	case e := <-stream.Events:
+		assert.Equal(t, "123", e.Id())
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+
+	// the timeout no longer applies once data has been received
+	select {
+	case err := <-stream.Errors:
+		t.Errorf("unexpected error: %s", err)
+	case <-time.After(time.Millisecond * 150):
+	}
+}
+
 func TestStreamReadTimeoutIsPreventedByComment(t *testing.T) {
 	timeout := time.Millisecond * 200
 
@@ -142,3 +185,518 @@ ReadLoop:
 		t.Errorf("Expected 0 errors, received %d (%+v)", len(receivedErrors), receivedErrors)
 	}
 }
+
+func TestStreamCanTreatRetryDirectiveAsFloor(t *testing.T) {
+	streamHandler, streamControl := httphelpers.SSEHandler(nil)
+	defer streamControl.Close()
+	httpServer := httptest.NewServer(streamHandler)
+	defer httpServer.Close()
+
+	baseDelay := time.Millisecond * 100
+	stream := mustSubscribe(t, httpServer.URL,
+		StreamOptionInitialRetry(baseDelay),
+		StreamOptionUseBackoff(time.Minute),
+		StreamOptionRetryDirectiveMode(RetryDirectiveSetFloor))
+	defer stream.Close()
+
+	retry := stream.getRetryDelayStrategy()
+	_ = retry.NextRetryDelay(time.Now()) // now mid-backoff: the next delay would be 200ms
+
+	streamControl.Send(httphelpers.SSEEvent{Event: "event1", Data: "a", RetryMillis: 300})
+	<-stream.Events
+
+	d0 := retry.NextRetryDelay(time.Now())
+	d1 := retry.NextRetryDelay(time.Now())
+	assert.Equal(t, time.Millisecond*300, d0)
+	assert.Equal(t, baseDelay*4, d1)
+}
+
+func TestStreamCanObserveInterEventGaps(t *testing.T) {
+	streamHandler, streamControl := httphelpers.SSEHandler(nil)
+	defer streamControl.Close()
+	httpServer := httptest.NewServer(streamHandler)
+	defer httpServer.Close()
+
+	gapsCh := make(chan time.Duration, 10)
+	stream := mustSubscribe(t, httpServer.URL,
+		StreamOptionInterEventGapObserver(func(gap time.Duration) { gapsCh <- gap }))
+	defer stream.Close()
+
+	streamControl.Enqueue(httphelpers.SSEEvent{Data: "a"})
+	<-stream.Events
+	<-gapsCh // the "data:" line
+	<-gapsCh // the blank line
+
+	time.Sleep(time.Millisecond * 100)
+	streamControl.SendComment("")
+	select {
+	case gap := <-gapsCh:
+		assert.GreaterOrEqual(t, int64(gap), int64(time.Millisecond*100))
+	case <-time.After(time.Second):
+		assert.Fail(t, "timed out waiting for gap")
+	}
+}
+
+func TestStreamCanDropEventsWithInvalidJSON(t *testing.T) {
+	streamHandler1, streamControl1 := httphelpers.SSEHandler(nil)
+	defer streamControl1.Close()
+	streamHandler2, streamControl2 := httphelpers.SSEHandler(nil)
+	defer streamControl2.Close()
+	handler, requestsCh := httphelpers.RecordingHandler(httphelpers.SequentialHandler(streamHandler1, streamHandler2))
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+
+	droppedCh := make(chan Event, 10)
+	stream := mustSubscribe(t, httpServer.URL,
+		StreamOptionInitialRetry(time.Millisecond),
+		StreamOptionDropInvalidJSON(func(e Event) { droppedCh <- e }))
+	defer stream.Close()
+	<-requestsCh
+
+	streamControl1.Enqueue(httphelpers.SSEEvent{ID: "1", Data: `{"a":1}`})
+	streamControl1.Enqueue(httphelpers.SSEEvent{ID: "2", Data: `{"a":`})
+	streamControl1.Enqueue(httphelpers.SSEEvent{ID: "3", Data: `[true]`})
+
+	assert.Equal(t, `{"a":1}`, (<-stream.Events).Data())
+	assert.Equal(t, `[true]`, (<-stream.Events).Data())
+	assert.Equal(t, "2", (<-droppedCh).Id())
+
+	streamControl1.Enqueue(httphelpers.SSEEvent{ID: "4", Data: "not json"})
+	assert.Equal(t, "4", (<-droppedCh).Id())
+	streamControl1.EndAll()
+	<-stream.Errors
+
+	r1 := <-requestsCh
+	assert.Equal(t, "4", r1.Request.Header.Get("Last-Event-ID")) // the dropped event's ID is still used
+}
+
+func TestStreamCallsRetryDirectiveHandler(t *testing.T) {
+	streamHandler, streamControl := httphelpers.SSEHandler(nil)
+	defer streamControl.Close()
+	httpServer := httptest.NewServer(streamHandler)
+	defer httpServer.Close()
+
+	type retryParams struct{ serverRetry, configuredBase time.Duration }
+	paramsCh := make(chan retryParams, 10)
+	stream := mustSubscribe(t, httpServer.URL,
+		StreamOptionInitialRetry(time.Millisecond*5),
+		StreamOptionRetryDirectiveHandler(func(serverRetry, configuredBase time.Duration) {
+			paramsCh <- retryParams{serverRetry, configuredBase}
+		}))
+	defer stream.Close()
+
+	streamControl.Send(httphelpers.SSEEvent{Data: "a"})
+	streamControl.Send(httphelpers.SSEEvent{Data: "b", RetryMillis: 3000})
+	<-stream.Events
+	<-stream.Events
+
+	assert.Equal(t, retryParams{time.Second * 3, time.Millisecond * 5}, <-paramsCh)
+	assert.Len(t, paramsCh, 0)
+}
+
+func TestStreamReportsProgressAtInterval(t *testing.T) {
+	streamHandler, streamControl := httphelpers.SSEHandler(nil)
+	defer streamControl.Close()
+	httpServer := httptest.NewServer(streamHandler)
+	defer httpServer.Close()
+
+	type progress struct {
+		lastEventID string
+		events      int64
+	}
+	progressCh := make(chan progress, 100)
+	stream := mustSubscribe(t, httpServer.URL,
+		StreamOptionLastEventID("0"),
+		StreamOptionProgressInterval(time.Millisecond*10, func(lastEventID string, events int64) {
+			progressCh <- progress{lastEventID, events}
+		}))
+	defer stream.Close()
+
+	assert.Equal(t, progress{"0", 0}, <-progressCh)
+
+	streamControl.Send(httphelpers.SSEEvent{ID: "1", Data: "a"})
+	streamControl.Send(httphelpers.SSEEvent{Data: "b"})
+	<-stream.Events
+	<-stream.Events
+
+	for {
+		select {
+		case p := <-progressCh:
+			if p.events < 2 {
+				continue
+			}
+			assert.Equal(t, progress{"1", 2}, p)
+			return
+		case <-time.After(time.Second):
+			require.Fail(t, "timed out waiting for progress report")
+		}
+	}
+}
+
+func TestStreamCanSetMinimumForServerRetry(t *testing.T) {
+	streamHandler, streamControl := httphelpers.SSEHandler(nil)
+	defer streamControl.Close()
+	httpServer := httptest.NewServer(streamHandler)
+	defer httpServer.Close()
+
+	stream := mustSubscribe(t, httpServer.URL,
+		StreamOptionInitialRetry(time.Millisecond),
+		StreamOptionMinServerRetry(time.Second))
+	defer stream.Close()
+
+	streamControl.Send(httphelpers.SSEEvent{Data: "a", RetryMillis: 10})
+	<-stream.Events
+	assert.Equal(t, time.Second, stream.getRetryDelayStrategy().NextRetryDelay(time.Now()))
+
+	streamControl.Send(httphelpers.SSEEvent{Data: "b", RetryMillis: 3000})
+	<-stream.Events
+	assert.Equal(t, time.Second*3, stream.getRetryDelayStrategy().NextRetryDelay(time.Now()))
+}
+
+func TestBufferingDetectorCountsEventsInEachRead(t *testing.T) {
+	chunks := []string{
+		"data: a\n\ndata: b\r\n\r\n: comment\n\n", // 2 events; the comment does not count
+		"data: c\n\ndata: d\n\ndata: e\n",         // 2 events; the third is not finished yet
+		"\nid: 1\rdata: f\r\r\n\n\n",              // 2 events; extra blank lines do not count
+		"data: g\n\ndata: h\n\ndata: i\n\n",       // 3 events
+	}
+	var readers []io.Reader
+	for _, c := range chunks {
+		readers = append(readers, strings.NewReader(c))
+	}
+	calls := 0
+	d := newBufferingDetector(io.MultiReader(readers...), 2, func() { calls++ })
+	expectedCalls := []int{0, 0, 0, 1}
+	buf := make([]byte, 100)
+	for i := range chunks {
+		_, err := d.Read(buf)
+		require.NoError(t, err)
+		assert.Equal(t, expectedCalls[i], calls, "after chunk %d", i)
+	}
+}
+
+func TestStreamCanDetectBufferedEvents(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: a\n\ndata: b\n\ndata: c\n\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+
+	detected := make(chan struct{}, 10)
+	stream := mustSubscribe(t, httpServer.URL, StreamOptionBufferingDetector(2, func() { detected <- struct{}{} }))
+	defer stream.Close()
+
+	for _, expected := range []string{"a", "b", "c"} {
+		assert.Equal(t, expected, (<-stream.Events).Data())
+	}
+	select {
+	case <-detected:
+	case <-time.After(time.Second):
+		t.Error("timed out waiting for buffering to be detected")
+	}
+}
+
+func TestStreamLastEventIDCanBeReadWhileReceivingEvents(t *testing.T) {
+	streamHandler, streamControl := httphelpers.SSEHandler(nil)
+	defer streamControl.Close()
+	httpServer := httptest.NewServer(streamHandler)
+	defer httpServer.Close()
+
+	stream := mustSubscribe(t, httpServer.URL, StreamOptionLastEventID("0"))
+	defer stream.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= 20; i++ {
+			streamControl.Send(httphelpers.SSEEvent{ID: fmt.Sprint(i), Data: "x"})
+			<-stream.Events
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			assert.Equal(t, "20", stream.LastEventID())
+			return
+		case <-time.After(time.Millisecond):
+			assert.NotEqual(t, "", stream.LastEventID())
+		}
+	}
+}
+
+func TestStreamCanRecordTimings(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: a\n\ndata: b\n\ndata: c\n\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+
+	stream := mustSubscribe(t, httpServer.URL, StreamOptionRecordTimings())
+	defer stream.Close()
+
+	for i := 0; i < 3; i++ {
+		time.Sleep(time.Millisecond * 20) // a slow consumer
+		<-stream.Events
+	}
+	// The stream can take the first event without waiting, but then it has to wait about 20ms for the
+	// application to read each event before it can take the next one.
+	require.Eventually(t, func() bool { return stream.Timings().Send >= time.Millisecond*30 },
+		time.Second, time.Millisecond)
+	assert.Greater(t, int64(stream.Timings().Decode), int64(0))
+}
+
+func TestStreamDoesNotRecordTimingsByDefault(t *testing.T) {
+	streamHandler, streamControl := httphelpers.SSEHandler(&httphelpers.SSEEvent{Data: "x"})
+	defer streamControl.Close()
+	httpServer := httptest.NewServer(streamHandler)
+	defer httpServer.Close()
+
+	stream := mustSubscribe(t, httpServer.URL)
+	defer stream.Close()
+
+	<-stream.Events
+	assert.Equal(t, StreamTimings{}, stream.Timings())
+}
+
+func TestStreamCanDetectUnexpectedContentWithSentinel(t *testing.T) {
+	brokenHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: a\n\n<html>\n<body>Bad Gateway</body>\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	streamHandler, streamControl := httphelpers.SSEHandler(&httphelpers.SSEEvent{Data: "b"})
+	defer streamControl.Close()
+	httpServer := httptest.NewServer(httphelpers.SequentialHandler(brokenHandler, streamHandler))
+	defer httpServer.Close()
+
+	var lines []string
+	var linesLock sync.Mutex
+	stream := mustSubscribe(t, httpServer.URL,
+		StreamOptionContentSentinel(func(line string) bool {
+			linesLock.Lock()
+			lines = append(lines, line)
+			linesLock.Unlock()
+			return strings.HasPrefix(line, "<")
+		}),
+		StreamOptionInitialRetry(time.Millisecond))
+	defer stream.Close()
+
+	assert.Equal(t, "a", (<-stream.Events).Data())
+	assert.Equal(t, ErrUnexpectedContent, decodeErrorCause(<-stream.Errors))
+	assert.Equal(t, "b", (<-stream.Events).Data())
+	linesLock.Lock()
+	defer linesLock.Unlock()
+	assert.Equal(t, []string{"data: a", "", "<html>"}, lines[:3])
+}
+
+func TestStreamCanKeepRawBytesOfEvents(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("id: 1\r\ndata: a\r\n\r\ndata: b\n\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+
+	// The buffering detector also reads the data, but must not change the line endings.
+	stream := mustSubscribe(t, httpServer.URL, StreamOptionWithRawBytes(), StreamOptionBufferingDetector(10, func() {}))
+	defer stream.Close()
+
+	assert.Equal(t, "id: 1\r\ndata: a\r\n\r\n", string((<-stream.Events).(EventWithRawBytes).RawBytes()))
+	assert.Equal(t, "data: b\n\n", string((<-stream.Events).(EventWithRawBytes).RawBytes()))
+}
+
+func TestStreamCanDeliverEventsOfOneTypeOnSeparateChannel(t *testing.T) {
+	streamHandler, streamControl := httphelpers.SSEHandler(nil)
+	defer streamControl.Close()
+	httpServer := httptest.NewServer(streamHandler)
+	defer httpServer.Close()
+
+	stream := mustSubscribe(t, httpServer.URL)
+	defer stream.Close()
+
+	updates := stream.EventsForType("update")
+	assert.Equal(t, updates, stream.EventsForType("update"))
+
+	streamControl.Send(httphelpers.SSEEvent{Event: "update", Data: "1"})
+	streamControl.Send(httphelpers.SSEEvent{Data: "2"})
+	streamControl.Send(httphelpers.SSEEvent{Event: "update", Data: "3"})
+	assert.Equal(t, "1", (<-updates).Data())
+	assert.Equal(t, "2", (<-stream.Events).Data())
+	assert.Equal(t, "3", (<-updates).Data())
+
+	stream.Close()
+	_, ok := <-updates
+	assert.False(t, ok)
+	<-stream.Done()
+	_, ok = <-stream.EventsForType("other")
+	assert.False(t, ok)
+}
+
+func TestStreamCanBufferEvents(t *testing.T) {
+	streamHandler, streamControl := httphelpers.SSEHandler(nil)
+	defer streamControl.Close()
+	httpServer := httptest.NewServer(streamHandler)
+	defer httpServer.Close()
+
+	stream := mustSubscribe(t, httpServer.URL, StreamOptionEventBuffer(3))
+	defer stream.Close()
+
+	for _, data := range []string{"1", "2", "3"} {
+		streamControl.Send(httphelpers.SSEEvent{Data: data})
+	}
+	require.Eventually(t, func() bool { return len(stream.Events) == 3 }, time.Second, time.Millisecond)
+	for _, data := range []string{"1", "2", "3"} {
+		assert.Equal(t, data, (<-stream.Events).Data())
+	}
+	assert.Equal(t, 0, stream.DroppedEventCount())
+}
+
+func TestStreamCanDropOldestEventsWhenBufferIsFull(t *testing.T) {
+	streamHandler, streamControl := httphelpers.SSEHandler(nil)
+	defer streamControl.Close()
+	httpServer := httptest.NewServer(streamHandler)
+	defer httpServer.Close()
+
+	stream := mustSubscribe(t, httpServer.URL, StreamOptionEventBuffer(2), StreamOptionDropOnFull(true))
+	defer stream.Close()
+
+	for _, data := range []string{"1", "2", "3", "4", "5"} {
+		streamControl.Send(httphelpers.SSEEvent{Data: data})
+	}
+	require.Eventually(t, func() bool { return stream.DroppedEventCount() == 3 }, time.Second, time.Millisecond)
+	assert.Equal(t, "4", (<-stream.Events).Data())
+	assert.Equal(t, "5", (<-stream.Events).Data())
+}
+
+func TestStreamCanDropEventsWithoutBuffer(t *testing.T) {
+	streamHandler, streamControl := httphelpers.SSEHandler(nil)
+	defer streamControl.Close()
+	httpServer := httptest.NewServer(streamHandler)
+	defer httpServer.Close()
+
+	stream := mustSubscribe(t, httpServer.URL, StreamOptionDropOnFull(true))
+	defer stream.Close()
+
+	streamControl.Send(httphelpers.SSEEvent{Data: "1"})
+	require.Eventually(t, func() bool { return stream.DroppedEventCount() == 1 }, time.Second, time.Millisecond)
+
+	received := make(chan Event)
+	go func() { received <- <-stream.Events }()
+	time.Sleep(time.Millisecond * 20) // give the goroutine time to start waiting
+	streamControl.Send(httphelpers.SSEEvent{Data: "2"})
+	select {
+	case e := <-received:
+		assert.Equal(t, "2", e.Data())
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+}
+
+func TestStreamDecompressesGzipResponseThatClientDidNotDecompress(t *testing.T) {
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(time.Millisecond * 20) // the stream should not have to wait for the gzip header to connect
+		zw := gzip.NewWriter(w)
+		_, _ = zw.Write([]byte("id: 1\ndata: hello\n\n"))
+		_ = zw.Flush()
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer httpServer.Close()
+
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	stream := mustSubscribe(t, httpServer.URL, StreamOptionHTTPClient(client))
+	defer stream.Close()
+
+	select {
+	case ev := <-stream.Events:
+		assert.Equal(t, "1", ev.Id())
+		assert.Equal(t, "hello", ev.Data())
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+}
+
+func TestStreamCanReadFromReaderUntilItEnds(t *testing.T) {
+	rc := ioutil.NopCloser(strings.NewReader("id: 1\ndata: a\n\ndata: b\n\n"))
+	stream, err := SubscribeWithReader(rc)
+	require.NoError(t, err)
+	defer stream.Close()
+
+	ev1 := <-stream.Events
+	assert.Equal(t, "a", ev1.Data())
+	ev2 := <-stream.Events
+	assert.Equal(t, "b", ev2.Data())
+	assert.Equal(t, io.EOF, <-stream.Errors)
+
+	select {
+	case _, ok := <-stream.Events:
+		assert.False(t, ok, "stream should not reconnect")
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for stream to close")
+	}
+	assert.Equal(t, "1", stream.LastEventID())
+}
+
+func TestStreamFromReaderClosesReaderOnRestart(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	stream, err := SubscribeWithReader(clientConn)
+	require.NoError(t, err)
+
+	go func() { _, _ = serverConn.Write([]byte("data: a\n\n")) }()
+	ev := <-stream.Events
+	assert.Equal(t, "a", ev.Data())
+
+	stream.Restart()
+	select {
+	case <-stream.Done():
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for stream to close")
+	}
+	_, err = serverConn.Write([]byte("data: b\n\n"))
+	assert.Error(t, err) // the client end of the connection was closed
+}
+
+func TestStreamCanDeliverEventsThatWereReadTogetherAsBatch(t *testing.T) {
+	chunks := []string{
+		"data: a\n\ndata: b\n\n: comment\n\ndata: c\n\n",
+		"id: 1\ndata: d\n\n",
+		"data: e\n\ndata: f\n", // the stream ends in the middle of an event
+	}
+	var readers []io.Reader
+	for _, c := range chunks {
+		readers = append(readers, strings.NewReader(c))
+	}
+	batches := make(chan []string, 10)
+	stream, err := SubscribeWithReader(ioutil.NopCloser(io.MultiReader(readers...)),
+		StreamOptionBatchEvents(func(events []Event) {
+			var data []string
+			for _, ev := range events {
+				data = append(data, ev.Data())
+			}
+			batches <- data
+		}))
+	require.NoError(t, err)
+	defer stream.Close()
+
+	assert.Equal(t, []string{"a", "b", "c"}, <-batches)
+	assert.Equal(t, []string{"d"}, <-batches)
+	assert.Equal(t, []string{"e"}, <-batches) // delivered before the error is reported
+	assert.Equal(t, io.ErrUnexpectedEOF, <-stream.Errors)
+	_, ok := <-stream.Events
+	assert.False(t, ok, "no events should be sent on the Events channel")
+	assert.Equal(t, "1", stream.LastEventID())
+}
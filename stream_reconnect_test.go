@@ -1,6 +1,7 @@
 package eventsource
 
 import (
+	"io"
 	"net/http/httptest"
 	"testing"
 	"time"
@@ -49,7 +50,7 @@ func TestStreamReconnectsIfConnectionIsBroken(t *testing.T) {
 			t.Error("Timed out waiting for event")
 			return
 		case receivedEvent := <-stream.Events:
-			assert.Equal(t, &publication{id: "123"}, receivedEvent)
+			assert.Equal(t, &publication{id: "123", dataLineCount: 1}, receivedEvent)
 			return
 		}
 	}
@@ -167,3 +168,238 @@ func TestStreamBackoffCanUseResetInterval(t *testing.T) {
 	d2 := retry.NextRetryDelay(time.Now().Add(resetInterval))
 	assert.Equal(t, baseDelay, d2)
 }
+
+func TestStreamCanOverrideReconnectDelay(t *testing.T) {
+	streamHandler1, streamControl1 := httphelpers.SSEHandler(nil)
+	defer streamControl1.Close()
+	streamHandler2, streamControl2 := httphelpers.SSEHandler(&httphelpers.SSEEvent{ID: "456"})
+	defer streamControl2.Close()
+	streamHandler3, streamControl3 := httphelpers.SSEHandler(nil)
+	defer streamControl3.Close()
+	httpServer := httptest.NewServer(httphelpers.SequentialHandler(
+		streamHandler1,
+		httphelpers.HandlerWithStatus(503),
+		httphelpers.HandlerWithStatus(503),
+		streamHandler2,
+		streamHandler3,
+	))
+	defer httpServer.Close()
+
+	type delayParams struct {
+		computed time.Duration
+		attempt  int
+	}
+	paramsCh := make(chan delayParams, 10)
+	stream := mustSubscribe(t, httpServer.URL,
+		StreamOptionInitialRetry(time.Hour),
+		StreamOptionReconnectDelayFunc(func(computed time.Duration, attempt int) time.Duration {
+			paramsCh <- delayParams{computed, attempt}
+			return time.Millisecond // if this were not used, the test would time out
+		}))
+	defer stream.Close()
+
+	streamControl1.EndAll()
+	<-stream.Errors // end of stream
+	<-stream.Errors // 503
+	<-stream.Errors // 503
+	assert.Equal(t, "456", (<-stream.Events).Id())
+	assert.Equal(t, delayParams{time.Hour, 1}, <-paramsCh)
+	assert.Equal(t, delayParams{time.Hour, 2}, <-paramsCh)
+	assert.Equal(t, delayParams{time.Hour, 3}, <-paramsCh)
+
+	stream.Restart() // a successful connection resets the attempt count
+	assert.Equal(t, delayParams{time.Hour, 1}, <-paramsCh)
+}
+
+func TestStreamClosesAfterMaxReconnectAttempts(t *testing.T) {
+	streamHandler, streamControl := httphelpers.SSEHandler(nil)
+	defer streamControl.Close()
+	httpServer := httptest.NewServer(httphelpers.SequentialHandler(streamHandler, httphelpers.HandlerWithStatus(503)))
+	defer httpServer.Close()
+
+	stream := mustSubscribe(t, httpServer.URL,
+		StreamOptionInitialRetry(time.Millisecond),
+		StreamOptionRetryResetInterval(time.Millisecond),
+		StreamOptionMaxReconnectAttempts(2))
+	defer stream.Close()
+
+	// The connection was open for longer than the reset interval, so its end does not count as a failure.
+	time.Sleep(time.Millisecond * 10)
+	streamControl.EndAll()
+
+	var errs []error
+	for err := range stream.Errors {
+		errs = append(errs, err)
+	}
+	if assert.Len(t, errs, 4) {
+		assert.Equal(t, io.EOF, errs[0])
+		assert.Equal(t, SubscriptionError{Code: 503}, errs[1])
+		assert.Equal(t, SubscriptionError{Code: 503}, errs[2])
+		assert.Equal(t, ErrMaxRetriesExceeded, errs[3])
+	}
+	<-stream.Done()
+}
+
+func TestStreamConnectionThatEndsQuicklyCountsTowardMaxReconnectAttempts(t *testing.T) {
+	streamHandler, streamControl := httphelpers.SSEHandler(nil)
+	defer streamControl.Close()
+	httpServer := httptest.NewServer(httphelpers.SequentialHandler(streamHandler, httphelpers.HandlerWithStatus(503)))
+	defer httpServer.Close()
+
+	stream := mustSubscribe(t, httpServer.URL,
+		StreamOptionInitialRetry(time.Millisecond),
+		StreamOptionRetryResetInterval(time.Hour),
+		StreamOptionMaxReconnectAttempts(2))
+	defer stream.Close()
+
+	streamControl.EndAll()
+
+	var errs []error
+	for err := range stream.Errors {
+		errs = append(errs, err)
+	}
+	assert.Equal(t, []error{io.EOF, SubscriptionError{Code: 503}, ErrMaxRetriesExceeded}, errs)
+}
+
+// testRetryStrategy makes each delay one millisecond longer than the last.
+type testRetryStrategy struct {
+	count      int
+	delays     chan time.Duration
+	baseDelays chan time.Duration
+}
+
+func (s *testRetryStrategy) NextRetryDelay(time.Time) time.Duration {
+	s.count++
+	d := time.Millisecond * time.Duration(s.count)
+	s.delays <- d
+	return d
+}
+
+func (s *testRetryStrategy) SetBaseDelay(baseDelay time.Duration) {
+	s.baseDelays <- baseDelay
+}
+
+func TestStreamCanUseCustomRetryStrategy(t *testing.T) {
+	streamHandler1, streamControl1 := httphelpers.SSEHandler(&httphelpers.SSEEvent{Data: "a", RetryMillis: 3000})
+	defer streamControl1.Close()
+	streamHandler2, streamControl2 := httphelpers.SSEHandler(&httphelpers.SSEEvent{Data: "b"})
+	defer streamControl2.Close()
+	httpServer := httptest.NewServer(httphelpers.SequentialHandler(streamHandler1,
+		httphelpers.HandlerWithStatus(503), streamHandler2))
+	defer httpServer.Close()
+
+	strategy := &testRetryStrategy{delays: make(chan time.Duration, 10), baseDelays: make(chan time.Duration, 10)}
+	stream := mustSubscribe(t, httpServer.URL,
+		StreamOptionUseBackoff(time.Hour),
+		StreamOptionRetryStrategy(strategy),
+		StreamOptionErrorHandler(func(error) StreamErrorHandlerResult { return StreamErrorHandlerResult{} }))
+	defer stream.Close()
+
+	assert.Equal(t, "a", (<-stream.Events).Data())
+	assert.Equal(t, time.Second*3, <-strategy.baseDelays)
+	assert.Nil(t, stream.getRetryDelayStrategy())
+
+	streamControl1.EndAll()
+	assert.Equal(t, "b", (<-stream.Events).Data())
+	assert.Equal(t, time.Millisecond, <-strategy.delays)
+	assert.Equal(t, time.Millisecond*2, <-strategy.delays)
+	assert.Len(t, strategy.delays, 0)
+}
+
+func TestStreamCircuitBreakerWaitsForCooldownAfterTooManyAttempts(t *testing.T) {
+	streamHandler, streamControl := httphelpers.SSEHandler(nil)
+	defer streamControl.Close()
+	handler, requestsCh := httphelpers.RecordingHandler(
+		httphelpers.SequentialHandler(streamHandler, httphelpers.HandlerWithStatus(503)))
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+
+	cooldown := time.Millisecond * 200
+	stream := mustSubscribe(t, httpServer.URL,
+		StreamOptionInitialRetry(time.Millisecond),
+		StreamOptionCircuitBreaker(3, time.Minute, cooldown),
+		StreamOptionErrorHandler(func(error) StreamErrorHandlerResult { return StreamErrorHandlerResult{} }))
+	defer stream.Close()
+
+	<-requestsCh
+	streamControl.EndAll()
+
+	var times []time.Time
+	for i := 0; i < 5; i++ {
+		select {
+		case <-requestsCh:
+			times = append(times, time.Now())
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for request %d", i+1)
+		}
+	}
+	// the first three reconnection attempts are made right away
+	assert.Less(t, int64(times[2].Sub(times[0])), int64(cooldown/2))
+	// the fourth is too many, so the circuit opens; and when the trial attempt fails, it opens again
+	assert.GreaterOrEqual(t, int64(times[3].Sub(times[2])), int64(cooldown))
+	assert.GreaterOrEqual(t, int64(times[4].Sub(times[3])), int64(cooldown))
+}
+
+func TestStreamCallsReconnectHandlerOnlyAfterReconnecting(t *testing.T) {
+	streamHandler1, streamControl1 := httphelpers.SSEHandler(&httphelpers.SSEEvent{ID: "a", Data: "x"})
+	defer streamControl1.Close()
+	streamHandler2, streamControl2 := httphelpers.SSEHandler(nil)
+	defer streamControl2.Close()
+	httpServer := httptest.NewServer(httphelpers.SequentialHandler(
+		httphelpers.HandlerWithStatus(503),
+		streamHandler1,
+		httphelpers.HandlerWithStatus(503),
+		streamHandler2))
+	defer httpServer.Close()
+
+	type reconnection struct {
+		attempt     int
+		lastEventID string
+	}
+	reconnectionsCh := make(chan reconnection, 10)
+	stream := mustSubscribe(t, httpServer.URL,
+		StreamOptionInitialRetry(time.Millisecond),
+		StreamOptionCanRetryFirstConnection(time.Second),
+		StreamOptionReconnectHandler(func(attempt int, lastEventID string) {
+			reconnectionsCh <- reconnection{attempt, lastEventID}
+		}))
+	defer stream.Close()
+
+	<-stream.Events
+	assert.Len(t, reconnectionsCh, 0) // retrying the first connection is not a reconnection
+
+	streamControl1.EndAll()
+	<-stream.Errors // for the end of the first connection
+	<-stream.Errors // for the 503 error
+
+	select {
+	case r := <-reconnectionsCh:
+		assert.Equal(t, reconnection{attempt: 2, lastEventID: "a"}, r)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for reconnect handler")
+	}
+}
+
+func TestStreamDoesNotCallReconnectHandlerAfterControlEventRestart(t *testing.T) {
+	streamHandler1, streamControl1 := httphelpers.SSEHandler(nil)
+	defer streamControl1.Close()
+	streamHandler2, streamControl2 := httphelpers.SSEHandler(nil)
+	defer streamControl2.Close()
+	httpServer := httptest.NewServer(httphelpers.SequentialHandler(streamHandler1, streamHandler2))
+	defer httpServer.Close()
+
+	reconnectionsCh := make(chan int, 10)
+	stream := mustSubscribe(t, httpServer.URL,
+		StreamOptionInitialRetry(time.Millisecond),
+		StreamOptionControlEvents(map[string]ControlAction{"__reconnect__": ControlActionRestart}),
+		StreamOptionReconnectHandler(func(attempt int, lastEventID string) {
+			reconnectionsCh <- attempt
+		}))
+	defer stream.Close()
+
+	streamControl1.Enqueue(httphelpers.SSEEvent{ID: "123", Event: "__reconnect__"})
+	streamControl2.Enqueue(httphelpers.SSEEvent{ID: "456"})
+	assert.Equal(t, "456", (<-stream.Events).Id()) // the stream has reconnected
+
+	assert.Len(t, reconnectionsCh, 0)
+}
@@ -1,13 +1,20 @@
 package eventsource
 
 import (
+	"bufio"
 	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/launchdarkly/go-test-helpers/v2/httphelpers"
 )
@@ -79,3 +86,436 @@ func TestStreamReconnectWithRequestBodySendsBodyTwice(t *testing.T) {
 	assert.Equal(t, body, r0.Body)
 	assert.Equal(t, body, r1.Body)
 }
+
+func TestStreamCanSetMethodAndBodyWithOptions(t *testing.T) {
+	body := []byte("my-body")
+
+	streamHandler, streamControl := httphelpers.SSEHandler(nil)
+	defer streamControl.Close()
+	handler, requestsCh := httphelpers.RecordingHandler(streamHandler)
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+
+	stream := mustSubscribe(t, httpServer.URL,
+		StreamOptionInitialRetry(time.Millisecond),
+		StreamOptionMethod("REPORT"),
+		StreamOptionBody(func() io.ReadCloser { return ioutil.NopCloser(bytes.NewReader(body)) }))
+	defer stream.Close()
+
+	r0 := <-requestsCh
+	streamControl.EndAll()
+	<-stream.Errors
+	r1 := <-requestsCh
+
+	assert.Equal(t, "REPORT", r0.Request.Method)
+	assert.Equal(t, body, r0.Body)
+	assert.Equal(t, "REPORT", r1.Request.Method)
+	assert.Equal(t, body, r1.Body)
+}
+
+func TestStreamDoesNotReconnectNonIdempotentRequestIfConfigured(t *testing.T) {
+	streamHandler, streamControl := httphelpers.SSEHandler(nil)
+	defer streamControl.Close()
+	handler, requestsCh := httphelpers.RecordingHandler(streamHandler)
+
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+
+	req, _ := http.NewRequest("POST", httpServer.URL, bytes.NewBufferString("my-body"))
+	stream, err := SubscribeWithRequestAndOptions(req,
+		StreamOptionInitialRetry(time.Millisecond),
+		StreamOptionRetryOnlyIdempotent(true))
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %s", err)
+		return
+	}
+	defer stream.Close()
+
+	<-requestsCh
+
+	streamControl.EndAll()
+	<-stream.Errors
+
+	select {
+	case _, ok := <-stream.Events:
+		assert.False(t, ok, "expected stream.Events channel to be closed")
+	case <-time.After(timeToWaitForEvent):
+		t.Error("Timed out waiting for stream.Events channel to close")
+	}
+	assert.Equal(t, 0, len(requestsCh))
+}
+
+func TestStreamDoesNotRetryFailedReconnectOfNonIdempotentRequestAfterRestart(t *testing.T) {
+	streamHandler, streamControl := httphelpers.SSEHandler(nil)
+	defer streamControl.Close()
+	handler, requestsCh := httphelpers.RecordingHandler(httphelpers.SequentialHandler(
+		streamHandler,
+		httphelpers.HandlerWithStatus(503)))
+
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+
+	req, _ := http.NewRequest("POST", httpServer.URL, bytes.NewBufferString("my-body"))
+	stream, err := SubscribeWithRequestAndOptions(req,
+		StreamOptionInitialRetry(time.Millisecond),
+		StreamOptionRetryOnlyIdempotent(true))
+	require.NoError(t, err)
+	defer stream.Close()
+
+	<-requestsCh
+	stream.Restart()
+	<-requestsCh // the reconnection that was explicitly requested
+	assert.Equal(t, SubscriptionError{Code: 503}, <-stream.Errors)
+
+	select {
+	case _, ok := <-stream.Events:
+		assert.False(t, ok, "expected stream.Events channel to be closed")
+	case <-time.After(timeToWaitForEvent):
+		t.Error("Timed out waiting for stream.Events channel to close")
+	}
+	assert.Equal(t, 0, len(requestsCh))
+}
+
+func TestStreamReconnectsNonIdempotentRequestWithIdempotencyKey(t *testing.T) {
+	streamHandler, streamControl := httphelpers.SSEHandler(nil)
+	defer streamControl.Close()
+	handler, requestsCh := httphelpers.RecordingHandler(streamHandler)
+
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+
+	req, _ := http.NewRequest("POST", httpServer.URL, bytes.NewBufferString("my-body"))
+	req.Header.Set("Idempotency-Key", "abc")
+	stream, err := SubscribeWithRequestAndOptions(req,
+		StreamOptionInitialRetry(time.Millisecond),
+		StreamOptionRetryOnlyIdempotent(true))
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %s", err)
+		return
+	}
+	defer stream.Close()
+
+	<-requestsCh
+
+	streamControl.EndAll()
+	<-stream.Errors
+
+	select {
+	case <-requestsCh:
+	case <-time.After(time.Second):
+		t.Error("Timed out waiting for reconnect")
+	}
+}
+
+func TestStreamRequestKeepAliveWritesToRequestBody(t *testing.T) {
+	// We use a raw TCP listener here, because Go's HTTP server will not start a response until it has
+	// consumed the entire request body, which in this case never ends.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	body := "my-body"
+	expected := body + requestKeepAliveData + requestKeepAliveData
+	bodyCh := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		buf := make([]byte, len(expected))
+		_, _ = io.ReadFull(req.Body, buf)
+		bodyCh <- string(buf)
+		_, _ = io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\n\r\n")
+		_, _ = io.Copy(ioutil.Discard, req.Body)
+	}()
+
+	req, _ := http.NewRequest("REPORT", "http://"+listener.Addr().String(), bytes.NewBufferString(body))
+	stream, err := SubscribeWithRequestAndOptions(req, StreamOptionRequestKeepAlive(time.Millisecond*10))
+	require.NoError(t, err)
+	defer stream.Close()
+
+	select {
+	case b := <-bodyCh:
+		assert.Equal(t, expected, b)
+	case <-time.After(time.Second):
+		t.Error("Timed out waiting for request body")
+	}
+}
+
+func TestStreamConfigReportsOptions(t *testing.T) {
+	streamHandler, streamControl := httphelpers.SSEHandler(nil)
+	defer streamControl.Close()
+	httpServer := httptest.NewServer(streamHandler)
+	defer httpServer.Close()
+
+	stream := mustSubscribe(t, httpServer.URL,
+		StreamOptionReadTimeout(time.Minute),
+		StreamOptionUseBackoff(time.Hour),
+		StreamOptionLastEventID("xyz"),
+		StreamOptionMaxReconnectAttempts(3))
+	defer stream.Close()
+
+	assert.Equal(t, StreamConfig{
+		InitialRetry:         DefaultInitialRetry,
+		BackoffMaxDelay:      time.Hour,
+		ReadTimeout:          time.Minute,
+		RetryResetInterval:   DefaultRetryResetInterval,
+		InitialLastEventID:   "xyz",
+		MaxReconnectAttempts: 3,
+	}, stream.Config())
+}
+
+func TestStreamCanSendLastEventIDOnReconnectOnly(t *testing.T) {
+	streamHandler1, streamControl1 := httphelpers.SSEHandler(nil)
+	defer streamControl1.Close()
+	streamHandler2, streamControl2 := httphelpers.SSEHandler(nil)
+	defer streamControl2.Close()
+	handler, requestsCh := httphelpers.RecordingHandler(httphelpers.SequentialHandler(streamHandler1, streamHandler2))
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+
+	stream := mustSubscribe(t, httpServer.URL,
+		StreamOptionLastEventID("xyz"),
+		StreamOptionLastEventIDOnReconnectOnly(true),
+		StreamOptionInitialRetry(time.Millisecond))
+	defer stream.Close()
+
+	r0 := <-requestsCh
+	assert.Equal(t, "", r0.Request.Header.Get("Last-Event-ID"))
+
+	streamControl1.EndAll()
+	<-stream.Errors
+
+	r1 := <-requestsCh
+	assert.Equal(t, "xyz", r1.Request.Header.Get("Last-Event-ID"))
+}
+
+func TestStreamCanNeverSendLastEventID(t *testing.T) {
+	streamHandler1, streamControl1 := httphelpers.SSEHandler(&httphelpers.SSEEvent{ID: "abc", Data: "x"})
+	defer streamControl1.Close()
+	streamHandler2, streamControl2 := httphelpers.SSEHandler(nil)
+	defer streamControl2.Close()
+	handler, requestsCh := httphelpers.RecordingHandler(httphelpers.SequentialHandler(streamHandler1, streamHandler2))
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+
+	stream := mustSubscribe(t, httpServer.URL,
+		StreamOptionLastEventID("xyz"),
+		StreamOptionNeverSendLastEventID(),
+		StreamOptionInitialRetry(time.Millisecond))
+	defer stream.Close()
+
+	r0 := <-requestsCh
+	assert.Equal(t, "", r0.Request.Header.Get("Last-Event-ID"))
+	assert.Equal(t, "xyz", stream.LastEventID())
+
+	<-stream.Events
+	assert.Equal(t, "abc", stream.LastEventID())
+
+	streamControl1.EndAll()
+	<-stream.Errors
+
+	r1 := <-requestsCh
+	assert.Equal(t, "", r1.Request.Header.Get("Last-Event-ID"))
+	assert.Equal(t, "abc", stream.LastEventID())
+}
+
+func TestStreamCanSetDynamicQueryParamsWithAttemptNumber(t *testing.T) {
+	streamHandler1, streamControl1 := httphelpers.SSEHandler(nil)
+	defer streamControl1.Close()
+	streamHandler2, streamControl2 := httphelpers.SSEHandler(nil)
+	defer streamControl2.Close()
+	handler, requestsCh := httphelpers.RecordingHandler(httphelpers.SequentialHandler(
+		streamHandler1, httphelpers.HandlerWithStatus(503), streamHandler2))
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+
+	stream := mustSubscribe(t, httpServer.URL+"/path?a=b",
+		StreamOptionDynamicQueryParams(func(existing url.Values, attempt int) url.Values {
+			existing.Set("attempt", strconv.Itoa(attempt))
+			return existing
+		}),
+		StreamOptionInitialRetry(time.Millisecond))
+	defer stream.Close()
+
+	r0 := <-requestsCh
+	assert.Equal(t, "/path?a=b&attempt=0", r0.Request.URL.RequestURI())
+
+	streamControl1.EndAll()
+	<-stream.Errors
+
+	r1 := <-requestsCh
+	assert.Equal(t, "/path?a=b&attempt=1", r1.Request.URL.RequestURI())
+	<-stream.Errors
+
+	r2 := <-requestsCh
+	assert.Equal(t, "/path?a=b&attempt=2", r2.Request.URL.RequestURI())
+}
+
+func TestStreamCanSetRequestHeadersForEachAttempt(t *testing.T) {
+	streamHandler1, streamControl1 := httphelpers.SSEHandler(nil)
+	defer streamControl1.Close()
+	streamHandler2, streamControl2 := httphelpers.SSEHandler(nil)
+	defer streamControl2.Close()
+	handler, requestsCh := httphelpers.RecordingHandler(httphelpers.SequentialHandler(streamHandler1, streamHandler2))
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+
+	req, err := http.NewRequest("GET", httpServer.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("User-Agent", "original")
+	req.Header.Set("X-Fixed", "fixed")
+	calls := 0
+	stream, err := SubscribeWithRequestAndOptions(req,
+		StreamOptionRequestHeadersFunc(func() http.Header {
+			calls++
+			h := http.Header{"Authorization": []string{"Bearer token-" + strconv.Itoa(calls)}}
+			if calls == 1 {
+				h.Set("user-agent", "dynamic")
+			}
+			return h
+		}),
+		StreamOptionInitialRetry(time.Millisecond))
+	require.NoError(t, err)
+	defer stream.Close()
+
+	r0 := <-requestsCh
+	assert.Equal(t, "Bearer token-1", r0.Request.Header.Get("Authorization"))
+	assert.Equal(t, "dynamic", r0.Request.Header.Get("User-Agent"))
+	assert.Equal(t, "fixed", r0.Request.Header.Get("X-Fixed"))
+
+	streamControl1.EndAll()
+	<-stream.Errors
+
+	r1 := <-requestsCh
+	assert.Equal(t, "Bearer token-2", r1.Request.Header.Get("Authorization"))
+	assert.Equal(t, "original", r1.Request.Header.Get("User-Agent"))
+	assert.Equal(t, "fixed", r1.Request.Header.Get("X-Fixed"))
+	assert.Equal(t, "", req.Header.Get("Authorization"))
+}
+
+func TestStreamWithManualAckSendsLastAcknowledgedEventIDOnReconnect(t *testing.T) {
+	streamHandler1, streamControl1 := httphelpers.SSEHandler(nil)
+	defer streamControl1.Close()
+	streamHandler2, streamControl2 := httphelpers.SSEHandler(nil)
+	defer streamControl2.Close()
+	handler, requestsCh := httphelpers.RecordingHandler(httphelpers.SequentialHandler(streamHandler1, streamHandler2))
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+
+	reconnectedCh := make(chan struct{}, 1)
+	stream := mustSubscribe(t, httpServer.URL,
+		StreamOptionLastEventID("0"),
+		StreamOptionManualAck(),
+		StreamOptionInitialRetry(time.Millisecond),
+		StreamOptionReconnectHandler(func(int, string) { reconnectedCh <- struct{}{} }))
+	defer stream.Close()
+	<-requestsCh
+
+	var events []EventWithAck
+	for _, id := range []string{"1", "2", "3"} {
+		streamControl1.Send(httphelpers.SSEEvent{ID: id, Data: "x"})
+		ev := <-stream.Events
+		require.Implements(t, (*EventWithAck)(nil), ev)
+		events = append(events, ev.(EventWithAck))
+	}
+	assert.Equal(t, "0", stream.LastEventID())
+
+	events[1].Ack()
+	assert.Equal(t, "0", stream.LastEventID()) // event 1 has not been acknowledged yet
+	events[0].Ack()
+	assert.Equal(t, "2", stream.LastEventID())
+
+	streamControl1.EndAll()
+	<-stream.Errors
+
+	r1 := <-requestsCh
+	assert.Equal(t, "2", r1.Request.Header.Get("Last-Event-ID"))
+
+	<-reconnectedCh
+	events[2].Ack() // from the previous connection, so it has no effect
+	assert.Equal(t, "2", stream.LastEventID())
+}
+
+func TestStreamCapturesResponseHeaders(t *testing.T) {
+	streamHandler1, streamControl1 := httphelpers.SSEHandler(nil)
+	defer streamControl1.Close()
+	streamHandler2, streamControl2 := httphelpers.SSEHandler(&httphelpers.SSEEvent{Data: "x"})
+	defer streamControl2.Close()
+	withHeaders := func(h http.Handler, shard string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Shard", shard)
+			if shard == "a" {
+				w.Header().Set("Server-Timing", "db;dur=53")
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+	handler := httphelpers.SequentialHandler(withHeaders(streamHandler1, "a"), withHeaders(streamHandler2, "b"))
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+
+	stream := mustSubscribe(t, httpServer.URL,
+		StreamOptionCaptureHeaders("x-shard", "Server-Timing"),
+		StreamOptionInitialRetry(time.Millisecond))
+	defer stream.Close()
+
+	assert.Equal(t, "a", stream.CapturedHeader("X-Shard"))
+	assert.Equal(t, "db;dur=53", stream.CapturedHeader("server-timing"))
+	assert.Equal(t, "", stream.CapturedHeader("Content-Type"))
+
+	streamControl1.EndAll()
+	<-stream.Errors
+	<-stream.Events
+
+	assert.Equal(t, "b", stream.CapturedHeader("X-Shard"))
+	assert.Equal(t, "", stream.CapturedHeader("Server-Timing"))
+}
+
+func TestStreamReportsRedirectLoop(t *testing.T) {
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, r.URL.Path, http.StatusFound)
+	}))
+	defer httpServer.Close()
+
+	_, err := SubscribeWithURL(httpServer.URL)
+	require.Error(t, err)
+	urlErr, ok := err.(*url.Error)
+	require.True(t, ok, "unexpected error: %s", err)
+	assert.Equal(t, ErrTooManyRedirects, urlErr.Err)
+}
+
+func TestStreamFollowsRedirectsByDefault(t *testing.T) {
+	streamHandler, streamControl := httphelpers.SSEHandler(&httphelpers.SSEEvent{Data: "x"})
+	defer streamControl.Close()
+	mux := http.NewServeMux()
+	mux.Handle("/old", http.RedirectHandler("/new", http.StatusFound))
+	mux.Handle("/new", streamHandler)
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	stream := mustSubscribe(t, httpServer.URL+"/old")
+	defer stream.Close()
+
+	ev := <-stream.Events
+	assert.Equal(t, "x", ev.Data())
+}
+
+func TestStreamCanDisableFollowingRedirects(t *testing.T) {
+	handler, requestsCh := httphelpers.RecordingHandler(http.RedirectHandler("/new", http.StatusFound))
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+
+	client := *http.DefaultClient
+	_, err := SubscribeWithURL(httpServer.URL, StreamOptionHTTPClient(&client), StreamOptionFollowRedirects(false))
+	if assert.IsType(t, SubscriptionError{}, err) {
+		assert.Equal(t, http.StatusFound, err.(SubscriptionError).Code)
+	}
+	assert.Len(t, requestsCh, 1)
+	assert.Nil(t, client.CheckRedirect) // the stream's copy of the client was changed, not this one
+}
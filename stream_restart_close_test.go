@@ -1,6 +1,7 @@
 package eventsource
 
 import (
+	"net/http"
 	"net/http/httptest"
 	"testing"
 	"time"
@@ -15,6 +16,8 @@ func toPublication(e httphelpers.SSEEvent) *publication {
 		id:    e.ID,
 		event: e.Event,
 		data:  e.Data,
+		// httphelpers always writes the data as a single "data:" line
+		dataLineCount: 1,
 	}
 }
 
@@ -45,6 +48,39 @@ func TestStreamRestart(t *testing.T) {
 	assert.Equal(t, 0, len(stream.Errors)) // restart is not reported as an error
 }
 
+func TestStreamRestartCanPreserveEventsAlreadyRead(t *testing.T) {
+	// The first handler writes several events at once, so that the stream has read all of them by the time
+	// the application has received the first one.
+	streamHandler1 := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("id: 1\ndata: a\n\nid: 2\ndata: b\n\nid: 3\ndata: c\n\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	streamHandler2, streamControl2 := httphelpers.SSEHandler(&httphelpers.SSEEvent{ID: "4", Data: "d"})
+	defer streamControl2.Close()
+	handler, requestsCh := httphelpers.RecordingHandler(httphelpers.SequentialHandler(streamHandler1, streamHandler2))
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+
+	stream := mustSubscribe(t, httpServer.URL,
+		StreamOptionInitialRetry(time.Millisecond),
+		StreamOptionPreserveOnRestart())
+	defer stream.Close()
+
+	assert.Equal(t, "a", (<-stream.Events).Data())
+	<-requestsCh
+
+	stream.Restart()
+
+	assert.Equal(t, "b", (<-stream.Events).Data())
+	assert.Equal(t, "c", (<-stream.Events).Data())
+	assert.Equal(t, "d", (<-stream.Events).Data())
+
+	r := <-requestsCh
+	assert.Equal(t, "3", r.Request.Header.Get("Last-Event-ID"))
+}
+
 func TestStreamClose(t *testing.T) {
 	streamHandler, streamControl := httphelpers.SSEHandler(nil)
 	defer streamControl.Close()
@@ -123,3 +159,105 @@ func TestStreamCloseWhileReconnecting(t *testing.T) {
 		t.Error("Timed out waiting for stream.Errors channel to close")
 	}
 }
+
+func TestStreamDoneChannelIsClosedAfterClose(t *testing.T) {
+	streamHandler, streamControl := httphelpers.SSEHandler(nil)
+	defer streamControl.Close()
+	httpServer := httptest.NewServer(streamHandler)
+	defer httpServer.Close()
+
+	stream := mustSubscribe(t, httpServer.URL)
+
+	select {
+	case <-stream.Done():
+		t.Fatal("Done channel was closed before the stream was closed")
+	case <-time.After(timeToWaitForEvent):
+	}
+
+	stream.Close()
+
+	select {
+	case <-stream.Done():
+	case <-time.After(timeToWaitForEvent):
+		t.Fatal("Timed out waiting for Done channel to close")
+	}
+	_, ok := <-stream.Events
+	assert.False(t, ok)
+}
+
+func TestStreamControlEventCanRestartStream(t *testing.T) {
+	streamHandler1, streamControl1 := httphelpers.SSEHandler(nil)
+	defer streamControl1.Close()
+	streamHandler2, streamControl2 := httphelpers.SSEHandler(nil)
+	defer streamControl2.Close()
+	handler, requestsCh := httphelpers.RecordingHandler(httphelpers.SequentialHandler(streamHandler1, streamHandler2))
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+
+	stream := mustSubscribe(t, httpServer.URL,
+		StreamOptionInitialRetry(time.Millisecond),
+		StreamOptionControlEvents(map[string]ControlAction{"__reconnect__": ControlActionRestart}))
+	defer stream.Close()
+	<-requestsCh
+
+	streamControl1.Enqueue(httphelpers.SSEEvent{ID: "123", Event: "__reconnect__"})
+
+	eventIn2 := httphelpers.SSEEvent{ID: "456"}
+	streamControl2.Enqueue(eventIn2)
+	eventOut2 := <-stream.Events // the control event was not delivered
+	assert.Equal(t, toPublication(eventIn2), eventOut2)
+
+	r1 := <-requestsCh
+	assert.Equal(t, "123", r1.Request.Header.Get("Last-Event-ID"))
+	assert.Equal(t, 0, len(stream.Errors))
+}
+
+func TestStreamControlEventCanResetLastEventIDAndRestartStream(t *testing.T) {
+	streamHandler1, streamControl1 := httphelpers.SSEHandler(nil)
+	defer streamControl1.Close()
+	streamHandler2, streamControl2 := httphelpers.SSEHandler(nil)
+	defer streamControl2.Close()
+	handler, requestsCh := httphelpers.RecordingHandler(httphelpers.SequentialHandler(streamHandler1, streamHandler2))
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+
+	stream := mustSubscribe(t, httpServer.URL,
+		StreamOptionInitialRetry(time.Millisecond),
+		StreamOptionLastEventID("abc"),
+		StreamOptionControlEvents(map[string]ControlAction{"__reset__": ControlActionResetIDAndRestart}))
+	defer stream.Close()
+	r0 := <-requestsCh
+	assert.Equal(t, "abc", r0.Request.Header.Get("Last-Event-ID"))
+
+	eventIn1 := httphelpers.SSEEvent{ID: "123"}
+	streamControl1.Enqueue(eventIn1)
+	assert.Equal(t, toPublication(eventIn1), <-stream.Events)
+	streamControl1.Enqueue(httphelpers.SSEEvent{Event: "__reset__"})
+
+	eventIn2 := httphelpers.SSEEvent{ID: "456"}
+	streamControl2.Enqueue(eventIn2)
+	assert.Equal(t, toPublication(eventIn2), <-stream.Events)
+
+	r1 := <-requestsCh
+	assert.Equal(t, "", r1.Request.Header.Get("Last-Event-ID"))
+}
+
+func TestStreamControlEventCanCloseStream(t *testing.T) {
+	streamHandler, streamControl := httphelpers.SSEHandler(nil)
+	defer streamControl.Close()
+	httpServer := httptest.NewServer(streamHandler)
+	defer httpServer.Close()
+
+	stream := mustSubscribe(t, httpServer.URL,
+		StreamOptionControlEvents(map[string]ControlAction{"__close__": ControlActionClose}))
+	defer stream.Close()
+
+	streamControl.Enqueue(httphelpers.SSEEvent{Event: "__close__"})
+
+	select {
+	case _, ok := <-stream.Events:
+		assert.False(t, ok, "Expected stream.Events channel to be closed")
+	case <-time.After(timeToWaitForEvent):
+		t.Error("Timed out waiting for stream.Events channel to close")
+	}
+}
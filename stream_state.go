@@ -0,0 +1,83 @@
+package eventsource
+
+import "sync"
+
+// StreamState describes the connection state of a Stream, as reported to a listener specified with
+// StreamOptionStateListener. It is similar to the readyState property of the browser EventSource API,
+// except that the time between a failed connection and the next attempt is a separate state.
+type StreamState int
+
+const (
+	// StateConnecting means that the stream is making an HTTP request to the server.
+	StateConnecting StreamState = iota
+	// StateOpen means that the server has accepted the request and the stream is reading events.
+	StateOpen
+	// StateClosed means that the stream has been closed permanently. No other state follows this one.
+	StateClosed
+	// StateWaitingToReconnect means that a connection attempt failed or an existing connection was
+	// ended, and the stream is waiting for the retry delay before it tries again.
+	StateWaitingToReconnect
+)
+
+// String returns a description of the state.
+func (s StreamState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateOpen:
+		return "open"
+	case StateClosed:
+		return "closed"
+	case StateWaitingToReconnect:
+		return "waiting to reconnect"
+	default:
+		return "unknown"
+	}
+}
+
+// stateNotifier delivers state changes to a listener on its own goroutine, in the order they happened,
+// so that a slow listener cannot hold up the stream. The zero value is not used; a nil *stateNotifier
+// means there is no listener.
+type stateNotifier struct {
+	listener func(StreamState)
+	pending  []StreamState
+	lock     sync.Mutex
+	wakeCh   chan struct{}
+}
+
+func newStateNotifier(listener func(StreamState)) *stateNotifier {
+	if listener == nil {
+		return nil
+	}
+	n := &stateNotifier{listener: listener, wakeCh: make(chan struct{}, 1)}
+	go n.run()
+	return n
+}
+
+func (n *stateNotifier) notify(state StreamState) {
+	if n == nil {
+		return
+	}
+	n.lock.Lock()
+	n.pending = append(n.pending, state)
+	n.lock.Unlock()
+	select {
+	case n.wakeCh <- struct{}{}:
+	default: // the goroutine has already been woken up and will see this state
+	}
+}
+
+func (n *stateNotifier) run() {
+	for range n.wakeCh {
+		n.lock.Lock()
+		states := n.pending
+		n.pending = nil
+		n.lock.Unlock()
+		for _, state := range states {
+			n.listener(state)
+			if state == StateClosed {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package eventsource
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/launchdarkly/go-test-helpers/v2/httphelpers"
+)
+
+func TestStreamStateListenerReceivesTransitions(t *testing.T) {
+	streamHandler1, streamControl1 := httphelpers.SSEHandler(nil)
+	defer streamControl1.Close()
+	streamHandler2, streamControl2 := httphelpers.SSEHandler(nil)
+	defer streamControl2.Close()
+	httpServer := httptest.NewServer(httphelpers.SequentialHandler(streamHandler1, streamHandler2))
+	defer httpServer.Close()
+
+	statesCh := make(chan StreamState, 10)
+	stream := mustSubscribe(t, httpServer.URL,
+		StreamOptionInitialRetry(time.Millisecond),
+		StreamOptionErrorHandler(func(error) StreamErrorHandlerResult { return StreamErrorHandlerResult{} }),
+		StreamOptionStateListener(func(state StreamState) { statesCh <- state }))
+
+	assert.Equal(t, StateConnecting, <-statesCh)
+	assert.Equal(t, StateOpen, <-statesCh)
+
+	streamControl1.EndAll()
+	assert.Equal(t, StateWaitingToReconnect, <-statesCh)
+	assert.Equal(t, StateConnecting, <-statesCh)
+	assert.Equal(t, StateOpen, <-statesCh)
+
+	stream.Close()
+	assert.Equal(t, StateClosed, <-statesCh)
+	<-stream.Done()
+	assert.Len(t, statesCh, 0)
+}
+
+func TestStreamStateListenerReceivesClosedIfSubscribeFails(t *testing.T) {
+	httpServer := httptest.NewServer(httphelpers.HandlerWithStatus(401))
+	defer httpServer.Close()
+
+	statesCh := make(chan StreamState, 10)
+	_, err := SubscribeWithURL(httpServer.URL,
+		StreamOptionStateListener(func(state StreamState) { statesCh <- state }))
+	assert.Error(t, err)
+
+	assert.Equal(t, StateConnecting, <-statesCh)
+	assert.Equal(t, StateClosed, <-statesCh)
+}
+
+func TestStreamStateListenerDoesNotBlockStream(t *testing.T) {
+	streamHandler, streamControl := httphelpers.SSEHandler(nil)
+	defer streamControl.Close()
+	httpServer := httptest.NewServer(streamHandler)
+	defer httpServer.Close()
+
+	releaseCh := make(chan struct{})
+	stream := mustSubscribe(t, httpServer.URL,
+		StreamOptionStateListener(func(StreamState) { <-releaseCh }))
+	defer close(releaseCh)
+	defer stream.Close()
+
+	streamControl.Send(httphelpers.SSEEvent{Data: "a"})
+	select {
+	case ev := <-stream.Events:
+		assert.Equal(t, "a", ev.Data())
+	case <-time.After(timeToWaitForEvent):
+		t.Error("Timed out waiting for event")
+	}
+}